@@ -6,9 +6,18 @@ package main
 
 import (
     "bufio"
+    "errors"
+    "flag"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
     "fmt"
+    "io"
+    "math/rand"
+    "os/signal"
+    "syscall"
     "os"
-    "os/exec"
     "strings"
     "strconv"
     "time"
@@ -27,36 +36,266 @@ type Message struct {
     LoadFive float64
     LoadFifteen float64
     SwapUsed float64
+    MemUsed float64
     KernelVer string
     Release string
     Uptime string
     DiskReport string
+    Disks []DiskInfo
+    Collectors []string
+    CollectorErrors map[string]string
+    Checks []CheckResult
 }
 
+//
+// Usage of one mounted filesystem
+//
+
+type DiskInfo struct {
+    MountPoint string
+    Device string
+    FSType string
+    TotalBytes int64
+    UsedBytes int64
+    AvailBytes int64
+    UsedPct float64
+    InodesTotal int64
+    InodesUsed int64
+    InodesUsedPct float64
+}
+
+
+// Default collection interval and jitter in daemon mode
+const defaultInterval = 10*time.Minute
+const defaultJitterFraction = 10
 
 func main() {
-    var m Message
-    var t string
+    var sp *spool
+    var err error
+
+    server := flag.String("h", "", "`server` to send reports to")
+    port := flag.Int("p", defaultServerPort, "server `port`")
+    confFile := flag.String("c", "", "configuration `file`")
+    logFile := flag.String("l", "", "log `file` (default standard error)")
+    daemon := flag.Bool("daemon", false, "keep running and report every interval")
+    interval := flag.Duration("i", defaultInterval, "`interval` between reports in daemon mode")
+    jitter := flag.Duration("j", -1, "up to this much random `delay` added to each interval (default interval/10)")
+    spoolDir := flag.String("spool", "", "`directory` to keep reports in while the server can't be reached")
+    spoolMaxAge := flag.Duration("spool-age", defaultSpoolMaxAge, "drop spooled reports older than `age`")
+    spoolMaxBytes := flag.Int64("spool-size", defaultSpoolMaxBytes, "most `bytes` of reports to spool")
+
+    flag.Usage = func() {
+        fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -h server [-p port] [-c configfile] [-l logfile] [-daemon [-i interval] [-j jitter]] [-spool dir [-spool-age age] [-spool-size bytes]]\n", os.Args[0])
+        flag.PrintDefaults()
+    }
+
+    flag.Parse()
+
+    switch {
+        case flag.NArg() != 0:
+            usageError("unexpected argument %s", flag.Arg(0))
+        case *interval <= 0:
+            usageError("invalid interval %v for -i", *interval)
+        case *jitter < -1:
+            usageError("invalid jitter %v for -j", *jitter)
+        case *spoolMaxAge < 0:
+            usageError("invalid age %v for -spool-age", *spoolMaxAge)
+        case *spoolMaxBytes <= 0:
+            usageError("invalid size %d for -spool-size", *spoolMaxBytes)
+    }
+
+    // Jitter defaults to a fraction of the interval so that a fleet of
+    //  agents started at the same time spreads out over the interval
+    if (*jitter < 0) {
+        *jitter = *interval/defaultJitterFraction
+    }
 
-    if ((len(os.Args) != 3) || (os.Args[1] != "-h")) {
-        log.Fatalf("Usage: %s -h server\n", os.Args[0])
+    //
+    // Flags given on the command line win over the configuration file, on
+    //  startup and whenever it's reread
+    //
+
+    setFlags := make(map[string]bool)
+    flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+    loadConfig := func() (*agentConfig, error) {
+        c := defaultAgentConfig()
+
+        if (*confFile != "") {
+            c, err = readAgentConfig(*confFile)
+            if (err != nil) {
+                return nil, err
+            }
+        }
+
+        if (setFlags["h"]) {
+            c.server = *server
+        }
+        if (setFlags["p"]) {
+            c.port = *port
+        }
+        if (setFlags["l"]) {
+            c.logFile = *logFile
+        }
+
+        if (c.server == "") {
+            return nil, errors.New("no server given with -h or in the configuration file")
+        }
+        if ((c.port < 1) || (c.port > 65535)) {
+            return nil, fmt.Errorf("bad port %d, must be between 1 and 65535", c.port)
+        }
+
+        return c, nil
     }
 
-    m.NumCPUs = getNumCPUs()
+    g_conf, err = loadConfig()
+    if (err != nil) {
+        usageError("%v", err)
+    }
 
-    m.LoadOne, m.LoadFive, m.LoadFifteen = getLoadAvgs()
+    err = openLog(g_conf.logFile)
+    if (err != nil) {
+        log.Fatalf("Fatal opening log file: %v\n", err)
+    }
 
-    m.KernelVer = getKernelVer()
-    m.Release = getRelease()
-
-    m.Uptime = getUptime()
+    if (*spoolDir != "") {
+        sp, err = newSpool(*spoolDir, *spoolMaxBytes, *spoolMaxAge)
+        if (err != nil) {
+            log.Fatalf("Fatal creating spool directory %s: %v\n", *spoolDir, err)
+        }
+    }
+
+    // One client for the life of the agent so connections get reused
+    cc, err := g_conf.newHTTPClient()
+    if (err != nil) {
+        log.Fatalf("Fatal setting up TLS: %v\n", err)
+    }
+
+    if (!*daemon) {
+        err = deliverReport(cc, g_conf.serverAddr(), sp, collectReport())
+        if (err != nil) {
+            log.Fatalf("Fatal sending report: %v\n", err)
+        }
+        return
+    }
+
+    runDaemon(cc, sp, loadConfig, *interval, *jitter)
+}
+
+//
+// Complain about the command line and exit
+//
+
+func usageError(format string, args ...interface{}) {
+    fmt.Fprintf(flag.CommandLine.Output(), "%s: %s\n", os.Args[0], fmt.Sprintf(format, args...))
+    flag.Usage()
+    os.Exit(2)
+}
+
+//
+// Send the log to a file, appending to it, or to standard error if path is
+//  empty. Reopening on SIGHUP lets the log be rotated.
+//
+
+var logOut *os.File
+
+func openLog(path string) error {
+    var f *os.File
+
+    if (path != "") {
+        var err error
+
+        f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+        if (err != nil) {
+            return err
+        }
+        log.SetOutput(f)
+    } else {
+        log.SetOutput(os.Stderr)
+    }
+
+    if (logOut != nil) {
+        logOut.Close()
+    }
+    logOut = f
+
+    return nil
+}
+
+//
+// Collect and send a report every interval (plus up to jitter) until we are
+//  told to stop. SIGHUP rereads the configuration with loadConfig, reopens
+//  the log file and triggers an immediate collection.
+//
 
-    mt, _, st, sf := getMemInfo()
-    m.Memtotal = mt
-    m.SwapUsed = ((float64(st)-float64(sf))/float64(st))*100.0
+func runDaemon(cc *http.Client, sp *spool, loadConfig func() (*agentConfig, error), interval time.Duration, jitter time.Duration) {
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+    log.Printf("Host monitor agent starting in daemon mode, interval %v jitter %v\n", interval, jitter)
+
+    next := func() time.Duration {
+        if (jitter <= 0) {
+            return interval
+        }
+        return interval + time.Duration(rand.Int63n(int64(jitter)))
+    }
+
+    timer := time.NewTimer(0)
+
+    for {
+        select {
+            case sig := <-sigs:
+                if (sig != syscall.SIGHUP) {
+                    log.Printf("Got %v, host monitor agent shutting down\n", sig)
+                    timer.Stop()
+                    return
+                }
+
+                log.Printf("Got SIGHUP, collecting now\n")
+                timer.Stop()
+
+                c, err := loadConfig()
+                if (err == nil) {
+                    var ncc *http.Client
+
+                    ncc, err = c.newHTTPClient()
+                    if (err == nil) {
+                        cc.CloseIdleConnections()
+                        g_conf, cc = c, ncc
+                    }
+                }
+                if (err != nil) {
+                    log.Printf("Keeping previous configuration, failed rereading: %v\n", err)
+                }
+
+                err = openLog(g_conf.logFile)
+                if (err != nil) {
+                    log.Printf("Failed reopening log file: %v\n", err)
+                }
+            case <-timer.C:
+        }
+
+        err := deliverReport(cc, g_conf.serverAddr(), sp, collectReport())
+        if (err != nil) {
+            log.Printf("Failed sending report: %v\n", err)
+        }
+
+        timer.Reset(next())
+    }
+}
+
+//
+// Gather all of the data points for this host into a report
+//
+
+func collectReport() Message {
+    var m Message
+
+    m.Uptime = "unknown"
+
+    runCollectors(&m)
 
-    m.DiskReport = getDiskInfo()
-    fmt.Printf("getDiskInfo() returned: %s\n", m.DiskReport)
     m.Timestamp = time.Now().Unix()
 
     m.Hostname, _ = os.Hostname()
@@ -64,6 +303,119 @@ func main() {
     if (strings.Index(m.Hostname, ".") != -1) {
         m.Hostname = m.Hostname[0:strings.Index(m.Hostname, ".")]
     }
+
+    if (g_conf.certHost != "") {
+        m.Hostname = g_conf.certHost
+    }
+
+    return m
+}
+
+//
+// Send a report, along with anything spooled from earlier failures. If the
+//  server can't be reached the report is spooled and only an error spooling
+//  it is returned.
+//
+
+func deliverReport(cc *http.Client, server string, sp *spool, m Message) error {
+    send := func(sm Message) error {
+        return sendReport(cc, server, sm)
+    }
+
+    if (sp == nil) {
+        return send(m)
+    }
+
+    // Replay first so the server receives reports in timestamp order
+    err := sp.replay(send)
+    if (err == nil) {
+        err = send(m)
+        if ((err == nil) || (!retryable(err))) {
+            return err
+        }
+    }
+
+    log.Printf("Server unavailable (%v), spooling report\n", err)
+
+    return sp.add(m)
+}
+
+//
+// Returned by sendReport when the server answers with anything but success
+//
+
+type statusError struct {
+    code int
+    status string
+}
+
+func (e *statusError) Error() string {
+    return "server returned " + e.status
+}
+
+//
+// Network failures and server side errors are worth trying again later, as
+//  are authentication failures since fixing the token will fix those. A
+//  report the server refused as bad will be refused again.
+//
+
+func retryable(err error) bool {
+    se, ok := err.(*statusError)
+    if (!ok) {
+        return true
+    }
+
+    return (se.code >= 500) || (se.code == http.StatusRequestTimeout) || (se.code == http.StatusTooManyRequests) ||
+        (se.code == http.StatusUnauthorized)
+}
+
+//
+// The JSON report schema version this agent sends
+//
+
+const schemaVersion = 1
+
+type jsonReport struct {
+    SchemaVersion int
+    Message
+}
+
+// Set once the server turns out not to take JSON reports
+var formOnly bool
+
+//
+// POST a report to the server, as JSON if the server takes it and as form
+//  fields otherwise
+//
+
+func sendReport(cc *http.Client, server string, m Message) error {
+    if (formOnly) {
+        return sendFormReport(cc, server, m)
+    }
+
+    b, err := json.Marshal(jsonReport{SchemaVersion: schemaVersion, Message: m})
+    if (err != nil) {
+        return err
+    }
+
+    err = postReport(cc, serverURL(server, "/report/"+m.Hostname), "application/json", b)
+
+    // Servers that predate JSON reports don't have the endpoint at all
+    if se, ok := err.(*statusError); ok && (se.code == http.StatusNotFound) {
+        log.Printf("Server does not take JSON reports, falling back to form reports\n")
+        formOnly = true
+        return sendFormReport(cc, server, m)
+    }
+
+    return err
+}
+
+//
+// POST a report to the server as form fields
+//
+
+func sendFormReport(cc *http.Client, server string, m Message) error {
+    var t string
 
     // Compose the URI-encoded body of the POST request
     p := url.Values{}
@@ -82,25 +434,94 @@ func main() {
     p.Set("LoadFifteen", t)
     t = fmt.Sprintf("%f", m.SwapUsed)
     p.Set("SwapUsed", t)
+    t = fmt.Sprintf("%f", m.MemUsed)
+    p.Set("MemUsed", t)
     p.Set("KernelVer", m.KernelVer)
     p.Set("Release", m.Release)
     p.Set("Uptime", m.Uptime)
     p.Set("DiskReport", m.DiskReport)
 
-    cc := &http.Client{}
-    r, err := http.NewRequest("POST", "http://"+os.Args[2]+":8962/host/"+m.Hostname, bytes.NewBufferString(p.Encode()))
+    // The structured disk list travels as JSON within the form
+    dj, err := json.Marshal(m.Disks)
     if (err != nil) {
-      log.Fatalf("Fatal calling http.NewRequest()")
+        return err
     }
-    r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-    r.Header.Add("Content-Length", strconv.Itoa(len(p.Encode())))
+    p.Set("Disks", string(dj))
 
-    re, errr := cc.Do(r)
-    if (errr != nil) {
-      log.Fatalf("Fatal calling http.Client.Do()")
+    cj, err := json.Marshal(m.Collectors)
+    if (err != nil) {
+        return err
     }
-    
-    log.Printf(re.Status)
+    p.Set("Collectors", string(cj))
+
+    ej, err := json.Marshal(m.CollectorErrors)
+    if (err != nil) {
+        return err
+    }
+    p.Set("CollectorErrors", string(ej))
+
+    kj, err := json.Marshal(m.Checks)
+    if (err != nil) {
+        return err
+    }
+    p.Set("Checks", string(kj))
+
+    return postReport(cc, serverURL(server, "/host/"+m.Hostname), "application/x-www-form-urlencoded", []byte(p.Encode()))
+}
+
+//
+// URL of a path on the server, where server is host:port
+//
+
+func serverURL(server string, path string) string {
+    scheme := "http"
+    if (g_conf.useTLS()) {
+        scheme = "https"
+    }
+
+    return scheme + "://" + server + path
+}
+
+func postReport(cc *http.Client, u string, contentType string, b []byte) error {
+    r, err := http.NewRequest("POST", u, bytes.NewReader(b))
+    if (err != nil) {
+        return err
+    }
+    r.Header.Add("Content-Type", contentType)
+    r.Header.Add("Content-Length", strconv.Itoa(len(b)))
+
+    //
+    // Sign the report with our token: hex HMAC-SHA256 of the method, path,
+    //  the time it is sent and body, separated by newlines. The server refuses
+    //  signatures too far from its own clock.
+    //
+
+    if (g_conf.token != "") {
+        ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+        mac := hmac.New(sha256.New, []byte(g_conf.token))
+        mac.Write([]byte("POST\n" + r.URL.Path + "\n" + ts + "\n"))
+        mac.Write(b)
+        r.Header.Add("Hostmon-Timestamp", ts)
+        r.Header.Add("Hostmon-Signature", hex.EncodeToString(mac.Sum(nil)))
+    }
+
+    re, err := cc.Do(r)
+    if (err != nil) {
+        return err
+    }
+
+    // Read the body so the connection can be reused
+    body, _ := io.ReadAll(io.LimitReader(re.Body, 4096))
+    re.Body.Close()
+
+    log.Printf("%s\n", re.Status)
+
+    if ((re.StatusCode < 200) || (re.StatusCode > 299)) {
+        return &statusError{code: re.StatusCode, status: re.Status + ": " + strings.TrimSpace(string(body))}
+    }
+
+    return nil
 }
 
 //
@@ -110,7 +531,7 @@ func main() {
 func getNumCPUs() int64 {
     var numCPUs int64
 
-    f,err := os.Open("/proc/cpuinfo")
+    f,err := os.Open(procPath("cpuinfo"))
 
     if ( err != nil ) {
         return 0
@@ -139,7 +560,7 @@ func getNumCPUs() int64 {
 func getLoadAvgs() (float64, float64, float64) {
     var loadOneMin, loadFiveMin, loadFifteenMin float64
 
-    f,err := os.Open("/proc/loadavg")
+    f,err := os.Open(procPath("loadavg"))
 
     if ( err != nil ) {
         return 0.0, 0.0, 0.0
@@ -205,7 +626,7 @@ func getRelease() (string) {
 //
 
 func getKernelVer() (string) {
-    f, err := os.Open("/proc/version")
+    f, err := os.Open(procPath("version"))
 
     if (err != nil) {
         return "unknown"
@@ -227,7 +648,7 @@ func getKernelVer() (string) {
 //
 
 func getUptime() (string) {
-    f, err := os.Open("/proc/uptime")
+    f, err := os.Open(procPath("uptime"))
 
     if (err != nil) {
         return "unknown"
@@ -245,13 +666,13 @@ func getUptime() (string) {
 }
 
 //
-// Get memory and swap information
+// Get total and available memory and swap information, in kB
 //
 
 func getMemInfo() (int64, int64, int64, int64) {
-    var memTotal, memFree, swapTotal, swapFree int64
+    var memTotal, memFree, memAvailable, swapTotal, swapFree int64
 
-    f, err := os.Open("/proc/meminfo")
+    f, err := os.Open(procPath("meminfo"))
 
     if ( err != nil ) {
         return 0, 0, 0, 0
@@ -272,6 +693,10 @@ func getMemInfo() (int64, int64, int64, int64) {
 	    memFree, _ = strconv.ParseInt(data[1], 10, 64)
 	}
 
+	if ( data[0] == "MemAvailable:" ) {
+	    memAvailable, _ = strconv.ParseInt(data[1], 10, 64)
+	}
+
 	if ( data[0] == "SwapTotal:" ) {
 	    swapTotal, _ = strconv.ParseInt(data[1], 10, 64)
 	}
@@ -284,80 +709,10 @@ func getMemInfo() (int64, int64, int64, int64) {
 
     f.Close()
 
-    return memTotal, memFree, swapTotal, swapFree
-}
-
-//
-// Get partition utilization
-//
-
-func getDiskInfo() string {
-    var returned string
-
-    command := "df"
-    args := []string{"-k", "-l"}
-
-    cmd := exec.Command(command, args...)
-
-    reader, err := cmd.StdoutPipe()
-    if (err != nil) {
-        return ""
+    // Kernels before 3.14 don't estimate what is available
+    if ( memAvailable == 0 ) {
+        memAvailable = memFree
     }
-
-    err = cmd.Start()
-    if (err != nil) {
-        return ""
-    }
-
-    scanner := bufio.NewScanner(reader)
-
-    returned = ""
-
-    for scanner.Scan() {
-        inp := scanner.Text()
-	data := strings.Fields(inp)
-
-	data[4] = strings.Trim(data[4], "%")
-
-	if ( data[5] == "/" ) {
-	    returned = returned + data[5] + " " + data[4] + " "
-	}
-
-	if ( data[5] == "/exports" ) {
-	    returned = returned + data[5] + " " + data[4] + " "
-	}
-
-	if ( data[5] == "/incoming" ) {
-	    returned = returned + data[5] + " " + data[4] + " "
-	}
-
-	if ( data[5] == "/working" ) {
-	    returned = returned + data[5] + " " + data[4] + " "
-	}
-
-	if ( data[5] == "/home" ) {
-	    returned = returned + data[5] + " " + data[4] + " "
-	}
-
-  if (data[5] == "/exports/home") {
-	    returned = returned + data[5] + " " + data[4] + " "
-  }
 
-	if (data[5] == "/var") {
-	    returned = returned + data[5] + " " + data[4] + " "
-	}
-
-	if (data[5] == "/tmp") {
-	    returned = returned + data[5] + " " + data[4] + " "
-	}
-    }
-
-    err = cmd.Wait()
-    if (err != nil) {
-        return ""
-    }
-
-    returned = strings.Trim(returned, " ")
-
-    return returned
+    return memTotal, memAvailable, swapTotal, swapFree
 }
@@ -0,0 +1,224 @@
+//
+// Host monitor agent, metric collectors
+//  Sean Caron, scaron@umich.edu
+//
+
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "time"
+)
+
+//
+// A Collector gathers one group of data points. Collect returns a function
+//  that fills those data points into the report; it's only applied if the
+//  collector finishes within its timeout, so a collector that hangs can't
+//  leave a half written report behind.
+//
+
+type Collector interface {
+    Name() string
+    Collect(ctx context.Context) (func(m *Message), error)
+}
+
+// Used when the configuration doesn't give a collector its own timeout
+const defaultCollectorTimeout = 10*time.Second
+
+// Longest collector error we send to the server
+const maxCollectorErrorLen = 255
+
+//
+// Registered collectors by name, and whether each runs when the configuration
+//  doesn't say otherwise
+//
+
+var collectors = make(map[string]Collector)
+var collectorDefaults = make(map[string]bool)
+
+func registerCollector(c Collector, enabled bool) {
+    if _, ok := collectors[c.Name()]; ok {
+        log.Fatalf("Fatal registering collector %s twice\n", c.Name())
+    }
+
+    collectors[c.Name()] = c
+    collectorDefaults[c.Name()] = enabled
+}
+
+//
+// Adapts a plain function to the Collector interface
+//
+
+type collectorFunc struct {
+    name string
+    fn func(ctx context.Context) (func(m *Message), error)
+}
+
+func (c collectorFunc) Name() string {
+    return c.name
+}
+
+func (c collectorFunc) Collect(ctx context.Context) (func(m *Message), error) {
+    return c.fn(ctx)
+}
+
+//
+// The built in collectors
+//
+
+func init() {
+    registerCollector(collectorFunc{"cpus", func(ctx context.Context) (func(m *Message), error) {
+        n := getNumCPUs()
+        if (n == 0) {
+            return nil, errors.New("no processors found in cpuinfo")
+        }
+        return func(m *Message) { m.NumCPUs = n }, nil
+    }}, true)
+
+    registerCollector(collectorFunc{"load", func(ctx context.Context) (func(m *Message), error) {
+        one, five, fifteen := getLoadAvgs()
+        return func(m *Message) { m.LoadOne, m.LoadFive, m.LoadFifteen = one, five, fifteen }, nil
+    }}, true)
+
+    registerCollector(collectorFunc{"kernel", func(ctx context.Context) (func(m *Message), error) {
+        k := getKernelVer()
+        if (k == "unknown") {
+            return nil, errors.New("kernel version unavailable")
+        }
+        return func(m *Message) { m.KernelVer = k }, nil
+    }}, true)
+
+    registerCollector(collectorFunc{"release", func(ctx context.Context) (func(m *Message), error) {
+        r := getRelease()
+        if (r == "unknown") {
+            return nil, errors.New("release unavailable")
+        }
+        return func(m *Message) { m.Release = r }, nil
+    }}, true)
+
+    registerCollector(collectorFunc{"uptime", func(ctx context.Context) (func(m *Message), error) {
+        u := getUptime()
+        if (u == "unknown") {
+            return nil, errors.New("uptime unavailable")
+        }
+        return func(m *Message) { m.Uptime = u }, nil
+    }}, true)
+
+    registerCollector(collectorFunc{"memory", func(ctx context.Context) (func(m *Message), error) {
+        var swapUsed float64
+
+        mt, ma, st, sf := getMemInfo()
+        if (mt == 0) {
+            return nil, errors.New("memory information unavailable")
+        }
+
+        memUsed := ((float64(mt)-float64(ma))/float64(mt))*100.0
+
+        // Hosts with no swap configured report zero rather than NaN
+        if (st > 0) {
+            swapUsed = ((float64(st)-float64(sf))/float64(st))*100.0
+        }
+
+        return func(m *Message) { m.Memtotal, m.MemUsed, m.SwapUsed = mt, memUsed, swapUsed }, nil
+    }}, true)
+
+    registerCollector(collectorFunc{"disk", func(ctx context.Context) (func(m *Message), error) {
+        disks, err := getDiskInfo()
+        if (err != nil) {
+            return nil, err
+        }
+        return func(m *Message) { m.Disks, m.DiskReport = disks, diskReport(disks) }, nil
+    }}, true)
+}
+
+//
+// Names of the registered collectors in a stable order
+//
+
+func collectorNames() []string {
+    var names []string
+
+    for n := range collectors {
+        names = append(names, n)
+    }
+
+    sort.Strings(names)
+
+    return names
+}
+
+//
+// Run every enabled collector against the report. The names of the
+//  collectors that succeeded go in m.Collectors and the errors from those
+//  that didn't go in m.CollectorErrors.
+//
+
+func runCollectors(m *Message) {
+    for _, n := range collectorNames() {
+        if (!g_conf.collectorEnabled(n)) {
+            continue
+        }
+
+        apply, err := runCollector(collectors[n], g_conf.collectorTimeout(n))
+        if (err != nil) {
+            msg := err.Error()
+            if (len(msg) > maxCollectorErrorLen) {
+                msg = msg[0:maxCollectorErrorLen]
+            }
+
+            log.Printf("Collector %s failed: %s\n", n, msg)
+
+            if (m.CollectorErrors == nil) {
+                m.CollectorErrors = make(map[string]string)
+            }
+            m.CollectorErrors[n] = msg
+            continue
+        }
+
+        apply(m)
+        m.Collectors = append(m.Collectors, n)
+    }
+}
+
+//
+// Run one collector with a timeout. A collector that panics is reported as
+//  failed rather than taking the agent down with it.
+//
+
+func runCollector(c Collector, timeout time.Duration) (func(m *Message), error) {
+    type result struct {
+        apply func(m *Message)
+        err error
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    // Buffered so a collector that finishes after its timeout doesn't block
+    done := make(chan result, 1)
+
+    go func() {
+        defer func() {
+            if r := recover(); r != nil {
+                done <- result{nil, fmt.Errorf("panic: %v", r)}
+            }
+        }()
+
+        apply, err := c.Collect(ctx)
+        if ((err == nil) && (apply == nil)) {
+            apply = func(m *Message) {}
+        }
+        done <- result{apply, err}
+    }()
+
+    select {
+        case r := <-done:
+            return r.apply, r.err
+        case <-ctx.Done():
+            return nil, fmt.Errorf("timed out after %v", timeout)
+    }
+}
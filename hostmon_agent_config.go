@@ -0,0 +1,339 @@
+//
+// Host monitor agent, configuration file
+//  Sean Caron, scaron@umich.edu
+//
+
+package main
+
+import (
+    "bufio"
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+//
+// Settings read from the agent configuration file. Every setting has a
+//  default so the agent runs without a configuration file at all.
+//
+
+type agentConfig struct {
+    server string
+    port int
+    logFile string
+    procRoot string
+    includeMounts []string
+    excludeMounts []string
+    includeFSTypes []string
+    excludeFSTypes []string
+    collectors map[string]bool
+    collectorTimeouts map[string]time.Duration
+    defaultCollectorTimeout time.Duration
+    scriptDir string
+    scriptTimeout time.Duration
+    token string
+    tls bool
+    caFile string
+    certFile string
+    keyFile string
+
+    // Loaded from certFile and keyFile; the host name is the certificate's CN
+    cert *tls.Certificate
+    certHost string
+}
+
+// Pseudo and image filesystems aren't interesting to report on
+var defaultExcludeFSTypes = []string{"tmpfs", "devtmpfs", "overlay", "squashfs"}
+
+var g_conf = defaultAgentConfig()
+
+// The server listens here unless told otherwise
+const defaultServerPort = 8962
+
+func defaultAgentConfig() *agentConfig {
+    return &agentConfig{
+        port: defaultServerPort,
+        procRoot: "/proc",
+        excludeFSTypes: defaultExcludeFSTypes,
+        collectors: make(map[string]bool),
+        collectorTimeouts: make(map[string]time.Duration),
+        defaultCollectorTimeout: defaultCollectorTimeout,
+        scriptTimeout: defaultScriptTimeout,
+    }
+}
+
+//
+// Read the configuration file. Lines are a directive followed by its values,
+//  blank lines and lines starting with # are ignored. Directives that take a
+//  list of patterns may be repeated.
+//
+
+func readAgentConfig(path string) (*agentConfig, error) {
+    var haveExcludeFSTypes bool
+
+    c := defaultAgentConfig()
+
+    f, err := os.Open(path)
+    if (err != nil) {
+        return nil, err
+    }
+
+    defer f.Close()
+
+    inp := bufio.NewScanner(f)
+
+    for n := 1; inp.Scan(); n++ {
+        theFields := strings.Fields(inp.Text())
+
+        if ((len(theFields) == 0) || strings.HasPrefix(theFields[0], "#")) {
+            continue
+        }
+
+        if (len(theFields) < 2) {
+            return nil, fmt.Errorf("%s line %d: %s needs a value", path, n, theFields[0])
+        }
+
+        key := strings.ToLower(theFields[0])
+        vals := theFields[1:]
+
+        switch key {
+            case "includemount", "excludemount", "includefstype", "excludefstype":
+                for _, v := range vals {
+                    _, err = filepath.Match(v, "")
+                    if (err != nil) {
+                        return nil, fmt.Errorf("%s line %d: bad pattern %s", path, n, v)
+                    }
+                }
+        }
+
+        switch key {
+            case "server":
+                c.server = vals[0]
+            case "port":
+                c.port, err = strconv.Atoi(vals[0])
+                if ((err != nil) || (c.port < 1) || (c.port > 65535)) {
+                    return nil, fmt.Errorf("%s line %d: bad port %s", path, n, vals[0])
+                }
+            case "logfile":
+                c.logFile = vals[0]
+            case "procroot":
+                c.procRoot = vals[0]
+            case "includemount":
+                c.includeMounts = append(c.includeMounts, vals...)
+            case "excludemount":
+                c.excludeMounts = append(c.excludeMounts, vals...)
+            case "includefstype":
+                c.includeFSTypes = append(c.includeFSTypes, vals...)
+            case "excludefstype":
+                // Naming any excluded types replaces the default list
+                if (!haveExcludeFSTypes) {
+                    c.excludeFSTypes = nil
+                    haveExcludeFSTypes = true
+                }
+                c.excludeFSTypes = append(c.excludeFSTypes, vals...)
+            case "enablecollector", "disablecollector":
+                for _, v := range vals {
+                    if _, ok := collectors[v]; !ok {
+                        return nil, fmt.Errorf("%s line %d: no such collector %s", path, n, v)
+                    }
+                    c.collectors[v] = (key == "enablecollector")
+                }
+            case "collectortimeout":
+                //
+                // Either collectorTimeout duration to set the default, or
+                //  collectorTimeout name duration for a single collector
+                //
+
+                d, err := time.ParseDuration(vals[len(vals)-1])
+                if ((err != nil) || (d <= 0) || (len(vals) > 2)) {
+                    return nil, fmt.Errorf("%s line %d: bad collector timeout", path, n)
+                }
+
+                if (len(vals) == 1) {
+                    c.defaultCollectorTimeout = d
+                } else {
+                    if _, ok := collectors[vals[0]]; !ok {
+                        return nil, fmt.Errorf("%s line %d: no such collector %s", path, n, vals[0])
+                    }
+                    c.collectorTimeouts[vals[0]] = d
+                }
+            case "scriptdir":
+                c.scriptDir = vals[0]
+            case "scripttimeout":
+                d, err := time.ParseDuration(vals[0])
+                if ((err != nil) || (d <= 0)) {
+                    return nil, fmt.Errorf("%s line %d: bad script timeout", path, n)
+                }
+                c.scriptTimeout = d
+            case "tls":
+                c.tls, err = strconv.ParseBool(vals[0])
+                if (err != nil) {
+                    return nil, fmt.Errorf("%s line %d: bad tls value %s", path, n, vals[0])
+                }
+            case "cafile":
+                c.caFile = vals[0]
+            case "certfile":
+                c.certFile = vals[0]
+            case "keyfile":
+                c.keyFile = vals[0]
+            case "token":
+                c.token = vals[0]
+            case "tokenfile":
+                // Keeps the token out of a configuration file that others can read
+                b, err := os.ReadFile(vals[0])
+                if (err != nil) {
+                    return nil, fmt.Errorf("%s line %d: %v", path, n, err)
+                }
+                c.token = strings.TrimSpace(string(b))
+            default:
+                log.Printf("Ignoring nonsense configuration parameter %s\n", theFields[0])
+        }
+    }
+
+    err = inp.Err()
+    if (err != nil) {
+        return nil, err
+    }
+
+    if ((c.certFile == "") != (c.keyFile == "")) {
+        return nil, fmt.Errorf("%s: certFile and keyFile must be given together", path)
+    }
+
+    //
+    // With a client certificate the server takes our host name from its CN,
+    //  so we report under that name too
+    //
+
+    if (c.certFile != "") {
+        cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+        if (err != nil) {
+            return nil, err
+        }
+
+        leaf, err := x509.ParseCertificate(cert.Certificate[0])
+        if (err != nil) {
+            return nil, err
+        }
+
+        c.cert = &cert
+        c.certHost = leaf.Subject.CommonName
+        if (strings.Index(c.certHost, ".") != -1) {
+            c.certHost = c.certHost[0:strings.Index(c.certHost, ".")]
+        }
+    }
+
+    return c, nil
+}
+
+//
+// The server's address as host:port
+//
+
+func (c *agentConfig) serverAddr() string {
+    return net.JoinHostPort(c.server, strconv.Itoa(c.port))
+}
+
+//
+// Reports go over TLS if asked for, or if we have a CA or client certificate
+//  to use with it
+//
+
+func (c *agentConfig) useTLS() bool {
+    return c.tls || (c.caFile != "") || (c.certFile != "")
+}
+
+//
+// Build the HTTP client used to talk to the server. With a CA file only that
+//  CA is trusted to sign the server's certificate, not the system roots.
+//
+
+func (c *agentConfig) newHTTPClient() (*http.Client, error) {
+    cc := &http.Client{Timeout: 30*time.Second}
+
+    if (!c.useTLS()) {
+        return cc, nil
+    }
+
+    tc := &tls.Config{MinVersion: tls.VersionTLS12}
+
+    if (c.caFile != "") {
+        pem, err := os.ReadFile(c.caFile)
+        if (err != nil) {
+            return nil, err
+        }
+
+        tc.RootCAs = x509.NewCertPool()
+        if (!tc.RootCAs.AppendCertsFromPEM(pem)) {
+            return nil, fmt.Errorf("no certificates found in %s", c.caFile)
+        }
+    }
+
+    if (c.cert != nil) {
+        tc.Certificates = []tls.Certificate{*c.cert}
+    }
+
+    cc.Transport = &http.Transport{TLSClientConfig: tc, Proxy: http.ProxyFromEnvironment}
+
+    return cc, nil
+}
+
+//
+// Whether a collector runs, and how long it gets to finish
+//
+
+func (c *agentConfig) collectorEnabled(name string) bool {
+    if e, ok := c.collectors[name]; ok {
+        return e
+    }
+
+    return collectorDefaults[name]
+}
+
+func (c *agentConfig) collectorTimeout(name string) time.Duration {
+    if d, ok := c.collectorTimeouts[name]; ok {
+        return d
+    }
+
+    // Scripts run side by side, each with its own timeout, so allow for the
+    //  slowest one plus a little time to clean up after it
+    if (name == "scripts") {
+        return c.scriptTimeout + 5*time.Second
+    }
+
+    return c.defaultCollectorTimeout
+}
+
+//
+// A filesystem is reported if it matches the include patterns (or there are
+//  none) and doesn't match any exclude pattern, by mount point and by type.
+//
+
+func (c *agentConfig) reportDisk(mountPoint string, fsType string) bool {
+    return selected(mountPoint, c.includeMounts, c.excludeMounts) && selected(fsType, c.includeFSTypes, c.excludeFSTypes)
+}
+
+func selected(s string, include []string, exclude []string) bool {
+    if ((len(include) > 0) && (!matchAny(s, include))) {
+        return false
+    }
+
+    return !matchAny(s, exclude)
+}
+
+func matchAny(s string, patterns []string) bool {
+    for _, p := range patterns {
+        if ok, _ := filepath.Match(p, s); ok {
+            return true
+        }
+    }
+
+    return false
+}
@@ -0,0 +1,238 @@
+//
+// Host monitor agent, disk usage collection
+//  Sean Caron, scaron@umich.edu
+//
+
+package main
+
+import (
+    "bufio"
+    "math"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+//
+// Network filesystems are left to the server that exports them, the same as
+//  df -l does, unless includeFSType names them
+//
+
+var remoteFSTypes = map[string]bool{
+    "nfs": true,
+    "nfs4": true,
+    "cifs": true,
+    "smbfs": true,
+    "smb3": true,
+    "ncpfs": true,
+    "afs": true,
+    "ceph": true,
+    "glusterfs": true,
+    "lustre": true,
+    "gpfs": true,
+    "fuse.sshfs": true,
+}
+
+// Replaced by the tests, which have no filesystems of their own to stat
+var statfsFunc = syscall.Statfs
+
+//
+// Path of a file under the configured /proc root
+//
+
+func procPath(name string) string {
+    return filepath.Join(g_conf.procRoot, name)
+}
+
+//
+// Path of a mount point in the tree the /proc root belongs to, the directory
+//  holding it, so that with procRoot /host/proc /var is looked for at
+//  /host/var
+//
+
+func rootPath(mountPoint string) string {
+    return filepath.Join(filepath.Dir(g_conf.procRoot), mountPoint)
+}
+
+func skipRemoteFS(fsType string) bool {
+    if (!remoteFSTypes[fsType]) {
+        return false
+    }
+
+    for _, t := range g_conf.includeFSTypes {
+        if (t == fsType) {
+            return false
+        }
+    }
+
+    return true
+}
+
+//
+// A line of /proc/self/mountinfo
+//
+
+type mountInfo struct {
+    mountPoint string
+    device string
+    fsType string
+}
+
+//
+// Read the mount table. The fields of each line are
+//  id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+//
+
+func readMountInfo() ([]mountInfo, error) {
+    var mounts []mountInfo
+
+    f, err := os.Open(procPath("self/mountinfo"))
+    if (err != nil) {
+        return nil, err
+    }
+
+    defer f.Close()
+
+    input := bufio.NewScanner(f)
+
+    for input.Scan() {
+        data := strings.Fields(input.Text())
+
+        // The optional fields end with a lone hyphen
+        sep := -1
+        for i := 6; i < len(data); i++ {
+            if (data[i] == "-") {
+                sep = i
+                break
+            }
+        }
+
+        if ((len(data) < 5) || (sep == -1) || (sep+2 >= len(data))) {
+            continue
+        }
+
+        mounts = append(mounts, mountInfo{
+            mountPoint: unescapeMountField(data[4]),
+            fsType: data[sep+1],
+            device: unescapeMountField(data[sep+2]),
+        })
+    }
+
+    return mounts, input.Err()
+}
+
+//
+// The kernel writes space, tab, newline and backslash in mount fields as
+//  three digit octal escapes, e.g. \040 for a space
+//
+
+func unescapeMountField(s string) string {
+    if (strings.Index(s, "\\") == -1) {
+        return s
+    }
+
+    var b strings.Builder
+
+    for i := 0; i < len(s); i++ {
+        if ((s[i] == '\\') && (i+3 < len(s))) {
+            if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+                b.WriteByte(byte(c))
+                i += 3
+                continue
+            }
+        }
+        b.WriteByte(s[i])
+    }
+
+    return b.String()
+}
+
+//
+// Get partition utilization
+//
+
+func getDiskInfo() ([]DiskInfo, error) {
+    var disks []DiskInfo
+
+    mounts, err := readMountInfo()
+    if (err != nil) {
+        return nil, err
+    }
+
+    //
+    // A mount point may show up more than once if something was mounted over
+    //  it. Only the last mount is visible, so that's the one we report.
+    //
+
+    last := make(map[string]int)
+    for i, mi := range mounts {
+        last[mi.mountPoint] = i
+    }
+
+    for i, mi := range mounts {
+        var st syscall.Statfs_t
+
+        if ((last[mi.mountPoint] != i) || skipRemoteFS(mi.fsType) || (!g_conf.reportDisk(mi.mountPoint, mi.fsType))) {
+            continue
+        }
+
+        err = statfsFunc(rootPath(mi.mountPoint), &st)
+        if (err != nil) {
+            continue
+        }
+
+        // Pseudo filesystems like proc and sysfs have no blocks at all
+        if (st.Blocks == 0) {
+            continue
+        }
+
+        bs := int64(st.Frsize)
+        if (bs == 0) {
+            bs = int64(st.Bsize)
+        }
+
+        d := DiskInfo{MountPoint: mi.mountPoint, Device: mi.device, FSType: mi.fsType}
+
+        d.TotalBytes = int64(st.Blocks)*bs
+        d.UsedBytes = int64(st.Blocks-st.Bfree)*bs
+        d.AvailBytes = int64(st.Bavail)*bs
+        d.UsedPct = percentUsed(d.UsedBytes, d.UsedBytes+d.AvailBytes)
+
+        d.InodesTotal = int64(st.Files)
+        d.InodesUsed = int64(st.Files-st.Ffree)
+        d.InodesUsedPct = percentUsed(d.InodesUsed, d.InodesTotal)
+
+        disks = append(disks, d)
+    }
+
+    return disks, nil
+}
+
+//
+// Percentage used, rounded up the same way df does it
+//
+
+func percentUsed(used int64, total int64) float64 {
+    if (total <= 0) {
+        return 0.0
+    }
+
+    return math.Ceil(float64(used)*100.0/float64(total))
+}
+
+//
+// Flatten the disk list into the old "/ 45 /home 80" disk report format for
+//  servers that don't understand the structured list
+//
+
+func diskReport(disks []DiskInfo) string {
+    var r []string
+
+    for _, d := range disks {
+        r = append(r, d.MountPoint, strconv.FormatFloat(d.UsedPct, 'f', 0, 64))
+    }
+
+    return strings.Join(r, " ")
+}
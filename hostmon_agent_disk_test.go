@@ -0,0 +1,167 @@
+//
+// Host monitor agent, disk usage collection tests
+//  Sean Caron, scaron@umich.edu
+//
+
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "syscall"
+    "testing"
+)
+
+const fixtureMountInfo = `22 1 8:1 / / rw,relatime shared:1 - xfs /dev/sda1 rw
+23 22 0:5 / /proc rw,nosuid shared:2 - proc proc rw
+24 22 0:21 / /dev/shm rw shared:3 - tmpfs tmpfs rw
+25 22 8:2 / /home rw,relatime shared:4 master:1 - ext4 /dev/sda2 rw
+26 22 8:3 / /mnt/my\040disk rw - ext4 /dev/disk/by-label/my\134disk rw
+27 22 0:40 / /net/data rw - nfs4 filer:/export/data rw
+28 22 0:41 / /net/cifs rw - cifs //filer/share rw
+29 25 8:4 / /home rw - xfs /dev/sdb1 rw
+malformed line
+30 22 8:5 / /broken rw shared:5 xfs /dev/sda5 rw
+`
+
+//
+// Point the agent at a fixture tree and a fake statfs for the length of a
+//  test
+//
+
+func useFixture(t *testing.T, conf *agentConfig, blocks map[string]uint64) string {
+    root := t.TempDir()
+
+    err := os.MkdirAll(filepath.Join(root, "proc", "self"), 0755)
+    if (err == nil) {
+        err = os.WriteFile(filepath.Join(root, "proc", "self", "mountinfo"), []byte(fixtureMountInfo), 0644)
+    }
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    conf.procRoot = filepath.Join(root, "proc")
+
+    oldConf, oldStatfs := g_conf, statfsFunc
+    t.Cleanup(func() { g_conf, statfsFunc = oldConf, oldStatfs })
+
+    g_conf = conf
+    statfsFunc = func(path string, st *syscall.Statfs_t) error {
+        rel, err := filepath.Rel(root, path)
+        if (err != nil) {
+            return err
+        }
+
+        b, ok := blocks[filepath.Join("/", rel)]
+        if (!ok) {
+            return syscall.ENOENT
+        }
+
+        *st = syscall.Statfs_t{Bsize: 4096, Frsize: 4096, Blocks: b, Bfree: b/4, Bavail: b/4, Files: 1000, Ffree: 900}
+        return nil
+    }
+
+    return root
+}
+
+func TestUnescapeMountField(t *testing.T) {
+    tests := []struct {
+        in string
+        want string
+    }{
+        {"/home", "/home"},
+        {"/mnt/my\\040disk", "/mnt/my disk"},
+        {"/mnt/tab\\011and\\012newline", "/mnt/tab\tand\nnewline"},
+        {"/mnt/back\\134slash", "/mnt/back\\slash"},
+        {"/mnt/trailing\\04", "/mnt/trailing\\04"},
+        {"/mnt/not\\08octal", "/mnt/not\\08octal"},
+        {"\\040\\040", "  "},
+    }
+
+    for _, tt := range tests {
+        got := unescapeMountField(tt.in)
+        if (got != tt.want) {
+            t.Errorf("unescapeMountField(%q) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestReadMountInfo(t *testing.T) {
+    useFixture(t, defaultAgentConfig(), nil)
+
+    mounts, err := readMountInfo()
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    want := []mountInfo{
+        {"/", "/dev/sda1", "xfs"},
+        {"/proc", "proc", "proc"},
+        {"/dev/shm", "tmpfs", "tmpfs"},
+        {"/home", "/dev/sda2", "ext4"},
+        {"/mnt/my disk", "/dev/disk/by-label/my\\disk", "ext4"},
+        {"/net/data", "filer:/export/data", "nfs4"},
+        {"/net/cifs", "//filer/share", "cifs"},
+        {"/home", "/dev/sdb1", "xfs"},
+    }
+
+    if (!reflect.DeepEqual(mounts, want)) {
+        t.Errorf("readMountInfo() = %+v, want %+v", mounts, want)
+    }
+}
+
+func TestGetDiskInfo(t *testing.T) {
+    blocks := map[string]uint64{"/": 1000, "/proc": 0, "/dev/shm": 100, "/home": 2000, "/mnt/my disk": 400,
+        "/net/data": 800, "/net/cifs": 800}
+
+    tests := []struct {
+        name string
+        includeFSTypes []string
+        excludeFSTypes []string
+        excludeMounts []string
+        want []string
+    }{
+        {"defaults", nil, defaultExcludeFSTypes, nil, []string{"/", "/mnt/my disk", "/home"}},
+        {"network type named", []string{"xfs", "nfs4"}, defaultExcludeFSTypes, nil, []string{"/", "/net/data", "/home"}},
+        {"network type not named", []string{"*"}, nil, nil, []string{"/", "/dev/shm", "/mnt/my disk", "/home"}},
+        {"mount excluded", nil, defaultExcludeFSTypes, []string{"/home"}, []string{"/", "/mnt/my disk"}},
+    }
+
+    for _, tt := range tests {
+        conf := defaultAgentConfig()
+        conf.includeFSTypes, conf.excludeFSTypes, conf.excludeMounts = tt.includeFSTypes, tt.excludeFSTypes, tt.excludeMounts
+
+        useFixture(t, conf, blocks)
+
+        disks, err := getDiskInfo()
+        if (err != nil) {
+            t.Fatalf("%s: %v", tt.name, err)
+        }
+
+        var got []string
+        for _, d := range disks {
+            got = append(got, d.MountPoint)
+        }
+
+        if (!reflect.DeepEqual(got, tt.want)) {
+            t.Errorf("%s: got mount points %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestGetDiskInfoUsage(t *testing.T) {
+    useFixture(t, defaultAgentConfig(), map[string]uint64{"/": 1000})
+
+    disks, err := getDiskInfo()
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    want := []DiskInfo{{MountPoint: "/", Device: "/dev/sda1", FSType: "xfs", TotalBytes: 4096000, UsedBytes: 3072000,
+        AvailBytes: 1024000, UsedPct: 75, InodesTotal: 1000, InodesUsed: 100, InodesUsedPct: 10}}
+
+    if (!reflect.DeepEqual(disks, want)) {
+        t.Errorf("getDiskInfo() = %+v, want %+v", disks, want)
+    }
+}
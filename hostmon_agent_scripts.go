@@ -0,0 +1,301 @@
+//
+// Host monitor agent, external check scripts
+//  Sean Caron, scaron@umich.edu
+//
+
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+//
+// Check states, the same as the Nagios plugin exit codes
+//
+
+const (
+    checkOK = 0
+    checkWarning = 1
+    checkCritical = 2
+    checkUnknown = 3
+)
+
+// Default time allowed for each script
+const defaultScriptTimeout = 10*time.Second
+
+//
+// Limits on what we send to the server for each check
+//
+
+const (
+    maxCheckNameLen = 64
+    maxCheckOutputLen = 255
+    maxCheckMetrics = 32
+    maxScriptOutput = 64*1024
+)
+
+//
+// The result of running one check script
+//
+
+type CheckResult struct {
+    Name string
+    Status int
+    Output string
+    Metrics map[string]float64
+}
+
+func init() {
+    registerCollector(collectorFunc{"scripts", collectScripts}, true)
+}
+
+//
+// Run every executable in the script directory, all at once, and report
+//  each one's result. Nothing happens unless a script directory is set.
+//
+
+func collectScripts(ctx context.Context) (func(m *Message), error) {
+    var wg sync.WaitGroup
+
+    dir := g_conf.scriptDir
+    if (dir == "") {
+        return func(m *Message) {}, nil
+    }
+
+    scripts, err := listScripts(dir)
+    if (err != nil) {
+        return nil, err
+    }
+
+    results := make([]CheckResult, len(scripts))
+
+    for i, s := range scripts {
+        wg.Add(1)
+        go func(i int, s string) {
+            defer wg.Done()
+            results[i] = runScript(ctx, dir, s, g_conf.scriptTimeout)
+        }(i, s)
+    }
+
+    wg.Wait()
+
+    return func(m *Message) { m.Checks = results }, nil
+}
+
+//
+// Executable regular files in the script directory, skipping hidden files
+//  and editor backups
+//
+
+func listScripts(dir string) ([]string, error) {
+    var scripts []string
+
+    des, err := os.ReadDir(dir)
+    if (err != nil) {
+        return nil, err
+    }
+
+    for _, de := range des {
+        n := de.Name()
+
+        if (strings.HasPrefix(n, ".") || strings.HasSuffix(n, "~") || (!validCheckName(n))) {
+            continue
+        }
+
+        fi, err := os.Stat(filepath.Join(dir, n))
+        if ((err != nil) || (!fi.Mode().IsRegular()) || (fi.Mode().Perm() & 0111 == 0)) {
+            continue
+        }
+
+        scripts = append(scripts, n)
+    }
+
+    sort.Strings(scripts)
+
+    return scripts, nil
+}
+
+//
+// Run one script and turn its exit code and output into a check result. A
+//  script that runs too long is killed, along with anything it started.
+//
+
+func runScript(ctx context.Context, dir string, name string, timeout time.Duration) CheckResult {
+    var out bytes.Buffer
+
+    r := CheckResult{Name: name}
+
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(ctx, filepath.Join(dir, name))
+    cmd.Dir = dir
+    cmd.Stdout = &limitedBuffer{buf: &out, max: maxScriptOutput}
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    cmd.Cancel = func() error {
+        return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    }
+    cmd.WaitDelay = time.Second
+
+    err := cmd.Run()
+
+    r.Output, r.Metrics = parseScriptOutput(out.String())
+
+    var ee *exec.ExitError
+
+    switch {
+        case ctx.Err() != nil:
+            r.Status = checkUnknown
+            r.Output = "timed out after " + timeout.String()
+        case err == nil:
+            r.Status = checkOK
+        case errors.As(err, &ee) && (ee.ExitCode() >= checkOK) && (ee.ExitCode() <= checkCritical):
+            r.Status = ee.ExitCode()
+        default:
+            r.Status = checkUnknown
+            if (r.Output == "") {
+                r.Output = err.Error()
+            }
+    }
+
+    // The server won't take control characters
+    r.Output = strings.Map(func(c rune) rune {
+        if ((c < ' ') || (c == 0x7f)) {
+            return ' '
+        }
+        return c
+    }, r.Output)
+
+    if (len(r.Output) > maxCheckOutputLen) {
+        r.Output = r.Output[0:maxCheckOutputLen]
+    }
+
+    return r
+}
+
+//
+// Script output follows the Nagios plugin conventions: the first line is the
+//  status text, optionally followed by | and performance data of the form
+//  label=value[unit][;warn;crit;min;max]. Later lines may carry more
+//  performance data after a |, and any line that is just key=value with a
+//  numeric value is taken as a metric too.
+//
+
+func parseScriptOutput(out string) (string, map[string]float64) {
+    var text string
+
+    metrics := make(map[string]float64)
+
+    for i, line := range strings.Split(out, "\n") {
+        left, perf, _ := strings.Cut(line, "|")
+        left = strings.TrimSpace(left)
+
+        if (i == 0) {
+            text = left
+        } else if k, v, ok := parseMetric(left); ok {
+            metrics[k] = v
+        }
+
+        for _, p := range strings.Fields(perf) {
+            if k, v, ok := parseMetric(p); ok {
+                metrics[k] = v
+            }
+        }
+    }
+
+    // Don't let a chatty script blow up the report
+    if (len(metrics) > maxCheckMetrics) {
+        var keys []string
+        for k := range metrics {
+            keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        for _, k := range keys[maxCheckMetrics:] {
+            delete(metrics, k)
+        }
+    }
+
+    if (len(metrics) == 0) {
+        metrics = nil
+    }
+
+    return text, metrics
+}
+
+//
+// Parse label=value, where value may have a unit and Nagios thresholds
+//  after it: e.g. used=85%;90;95;0;100
+//
+
+func parseMetric(s string) (string, float64, bool) {
+    k, v, ok := strings.Cut(s, "=")
+    k = strings.Trim(strings.TrimSpace(k), "'")
+
+    if ((!ok) || (!validCheckName(k))) {
+        return "", 0, false
+    }
+
+    v, _, _ = strings.Cut(strings.TrimSpace(v), ";")
+    v = strings.TrimRightFunc(v, func(c rune) bool {
+        return !(((c >= '0') && (c <= '9')) || (c == '.'))
+    })
+
+    f, err := strconv.ParseFloat(v, 64)
+    if (err != nil) {
+        return "", 0, false
+    }
+
+    return k, f, true
+}
+
+//
+// Check and metric names are what the server will accept: letters, digits,
+//  '.', '-' and '_'
+//
+
+func validCheckName(s string) bool {
+    if ((len(s) == 0) || (len(s) > maxCheckNameLen)) {
+        return false
+    }
+
+    for _, c := range s {
+        if (!(((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) || ((c >= '0') && (c <= '9')) || (c == '.') || (c == '-') || (c == '_'))) {
+            return false
+        }
+    }
+
+    return true
+}
+
+//
+// Keeps the first max bytes written to it and quietly drops the rest, so a
+//  runaway script can't eat all of our memory
+//
+
+type limitedBuffer struct {
+    buf *bytes.Buffer
+    max int
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+    if room := l.max - l.buf.Len(); room > 0 {
+        if (len(p) > room) {
+            l.buf.Write(p[0:room])
+        } else {
+            l.buf.Write(p)
+        }
+    }
+
+    return len(p), nil
+}
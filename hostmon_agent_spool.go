@@ -0,0 +1,199 @@
+//
+// Host monitor agent, on-disk spool for undeliverable reports
+//  Sean Caron, scaron@umich.edu
+//
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Default spool bounds
+const defaultSpoolMaxBytes = 16*1024*1024
+const defaultSpoolMaxAge = 7*24*time.Hour
+
+//
+// Reports that could not be delivered are written to the spool directory,
+//  one JSON file per report. File names start with the zero padded report
+//  timestamp so that sorting the names sorts the reports.
+//
+
+type spool struct {
+    dir string
+    maxBytes int64
+    maxAge time.Duration
+}
+
+type spoolEntry struct {
+    name string
+    timestamp int64
+    size int64
+}
+
+func newSpool(dir string, maxBytes int64, maxAge time.Duration) (*spool, error) {
+    err := os.MkdirAll(dir, 0700)
+    if (err != nil) {
+        return nil, err
+    }
+
+    return &spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge}, nil
+}
+
+//
+// Write a report to the spool, then trim the spool back within its bounds.
+//
+
+func (s *spool) add(m Message) error {
+    b, err := json.Marshal(m)
+    if (err != nil) {
+        return err
+    }
+
+    name := fmt.Sprintf("%020d-%d.json", m.Timestamp, time.Now().UnixNano())
+
+    // Write to a temporary name first so replay never sees a partial file
+    tmp := filepath.Join(s.dir, "." + name + ".tmp")
+
+    err = os.WriteFile(tmp, b, 0600)
+    if (err != nil) {
+        return err
+    }
+
+    err = os.Rename(tmp, filepath.Join(s.dir, name))
+    if (err != nil) {
+        os.Remove(tmp)
+        return err
+    }
+
+    s.trim()
+
+    return nil
+}
+
+//
+// List the spooled reports, oldest first.
+//
+
+func (s *spool) entries() ([]spoolEntry, error) {
+    var el []spoolEntry
+
+    des, err := os.ReadDir(s.dir)
+    if (err != nil) {
+        return nil, err
+    }
+
+    for _, de := range des {
+        n := de.Name()
+
+        if ((!de.Type().IsRegular()) || (!strings.HasSuffix(n, ".json")) || (strings.Index(n, "-") == -1)) {
+            continue
+        }
+
+        ts, err := strconv.ParseInt(n[0:strings.Index(n, "-")], 10, 64)
+        if (err != nil) {
+            continue
+        }
+
+        fi, err := de.Info()
+        if (err != nil) {
+            continue
+        }
+
+        el = append(el, spoolEntry{name: n, timestamp: ts, size: fi.Size()})
+    }
+
+    sort.Slice(el, func(i, j int) bool { return el[i].name < el[j].name })
+
+    return el, nil
+}
+
+//
+// Drop reports older than the maximum age, then the oldest reports until the
+//  spool fits within its maximum size.
+//
+
+func (s *spool) trim() {
+    var total int64
+
+    el, err := s.entries()
+    if (err != nil) {
+        log.Printf("Failed listing spool directory %s: %v\n", s.dir, err)
+        return
+    }
+
+    cutoff := time.Now().Add(-s.maxAge).Unix()
+
+    var kept []spoolEntry
+    for _, e := range el {
+        if (e.timestamp < cutoff) {
+            log.Printf("Dropping spooled report %s, older than %v\n", e.name, s.maxAge)
+            os.Remove(filepath.Join(s.dir, e.name))
+            continue
+        }
+        kept = append(kept, e)
+        total += e.size
+    }
+
+    for len(kept) > 0 && total > s.maxBytes {
+        log.Printf("Dropping spooled report %s, spool larger than %d bytes\n", kept[0].name, s.maxBytes)
+        os.Remove(filepath.Join(s.dir, kept[0].name))
+        total -= kept[0].size
+        kept = kept[1:]
+    }
+}
+
+//
+// Send every spooled report in timestamp order, removing each one once it
+//  has been delivered. Stops at the first report that could not be delivered
+//  and returns that error; the rest stay spooled for next time.
+//
+
+func (s *spool) replay(send func(Message) error) error {
+    s.trim()
+
+    el, err := s.entries()
+    if (err != nil) {
+        return err
+    }
+
+    for _, e := range el {
+        var m Message
+
+        path := filepath.Join(s.dir, e.name)
+
+        b, err := os.ReadFile(path)
+        if (err == nil) {
+            err = json.Unmarshal(b, &m)
+        }
+        if (err != nil) {
+            log.Printf("Dropping unreadable spooled report %s: %v\n", e.name, err)
+            os.Remove(path)
+            continue
+        }
+
+        err = send(m)
+        if ((err != nil) && retryable(err)) {
+            return err
+        }
+
+        // Delivered, or refused by the server in which case retrying won't help
+        if (err != nil) {
+            log.Printf("Dropping spooled report %s refused by server: %v\n", e.name, err)
+        } else {
+            log.Printf("Delivered spooled report %s\n", e.name)
+        }
+
+        os.Remove(path)
+    }
+
+    return nil
+}
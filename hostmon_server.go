@@ -7,15 +7,14 @@ package main
 
 import (
   "os"
+  "flag"
+  "net"
   "fmt"
   "strings"
   "strconv"
   "bufio"
-  "math"
-  "database/sql"
-  _ "github.com/go-sql-driver/mysql"
-  "net/smtp"
   "bytes"
+  "io"
   "log"
   "time"
   "encoding/json"
@@ -31,12 +30,55 @@ type Message struct {
   LoadFive float64
   LoadFifteen float64
   SwapUsed float64
+  MemUsed *float64 `json:",omitempty"`
   KernelVer string
   Release string
   Uptime string
   DiskReport string
+  Disks []DiskInfo
+  Collectors []string
+  CollectorErrors map[string]string
+  Checks []CheckResult
 }
 
+//
+// Usage of one mounted filesystem on a host, as reported by the agent
+//
+
+type DiskInfo struct {
+  MountPoint string
+  Device string
+  FSType string
+  TotalBytes int64
+  UsedBytes int64
+  AvailBytes int64
+  UsedPct float64
+  InodesTotal int64
+  InodesUsed int64
+  InodesUsedPct float64
+}
+
+//
+// The result of one of the agent's check scripts. Status follows the Nagios
+//  plugin exit codes.
+//
+
+type CheckResult struct {
+  Name string
+  Status int
+  Output string
+  Metrics map[string]float64
+}
+
+const (
+  checkOK = 0
+  checkWarning = 1
+  checkCritical = 2
+  checkUnknown = 3
+)
+
+var checkStatusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
 type Config struct {
   DBUser string
   DBPass string
@@ -55,29 +97,51 @@ type Config struct {
 // Configuration parameters go in global variables.
 //
 
-var g_dbUser, g_dbPass, g_dbHost, g_dbName, g_eMailTo, g_eMailFrom string
+var g_storage = "mysql"
+var g_dbUser, g_dbPass, g_dbHost, g_dbName, g_sqlitePath, g_eMailTo, g_eMailFrom string
 var g_loadThreshold, g_swapThreshold, g_loadFirstDThreshold, g_swapFirstDThreshold float64
 var g_diskThreshold, g_diskReportInterval int64
+var g_adminToken string
+var g_requireAuth bool
+var g_tlsCert, g_tlsKey, g_tlsClientCA string
+var g_tlsRequireClientCert bool
+var g_bindAddr, g_logFile string
+var g_port = defaultPort
 
-var lastDNotify = make(map[string]int64)
+// The port agents and the dashboard talk to unless told otherwise
+const defaultPort = 8962
 
-var dbconn *sql.DB
+var store Store
 
 func main() {
-  //var bindaddr, conffile string
-  var conffile string
+  var err error
+
+  bindFlag := flag.String("b", "", "`address` to listen on (default all addresses)")
+  portFlag := flag.Int("p", defaultPort, "`port` to listen on")
+  conffile := flag.String("f", "", "configuration `file` (required)")
+  logFlag := flag.String("l", "", "log `file` (default standard error)")
 
-  if (len(os.Args) != 5) {
-    log.Fatalf("Usage: %s -b bindaddr -f configfile", os.Args[0])
+  flag.Usage = func() {
+    fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-b bindaddr] [-p port] [-l logfile] -f configfile\n", os.Args[0])
+    flag.PrintDefaults()
   }
 
-  for i := 1; i < len(os.Args); i++ {
-    switch os.Args[i] {
-      //case "-b":
-        //bindaddr = os.Args[i+1]
-      case "-f":
-        conffile = os.Args[i+1]
-    }
+  flag.Parse()
+
+  if (flag.NArg() != 0) {
+    usageError("unexpected argument %s", flag.Arg(0))
+  }
+
+  if (*conffile == "") {
+    usageError("a configuration file must be given with -f")
+  }
+
+  // Flags given on the command line win over the configuration file
+  setFlags := make(map[string]bool)
+  flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+  if (setFlags["l"]) {
+    openLog(*logFlag)
   }
 
   log.Printf("Host monitor data server starting up\n")
@@ -88,52 +152,167 @@ func main() {
 
   haveParam := make(map[string]bool)
 
-  confFile, err := os.Open(conffile)
+  confFile, err := os.Open(*conffile)
 
   if err != nil {
-    log.Fatalf("Failed opening configuration file for reading\n")
+    log.Fatalf("Failed opening configuration file for reading: %v\n", err)
   }
 
   inp := bufio.NewScanner(confFile)
 
-  for inp.Scan() {
-    line := inp.Text()
-
-    if (len(line) > 0) {
-      theFields := strings.Fields(line)
-      key := strings.ToLower(theFields[0])
-
-      haveParam[theFields[0]] = true
-
-      switch key {
-        case "dbuser":
-          g_dbUser = theFields[1]
-        case "dbpass":
-	        g_dbPass = theFields[1]
-	      case "dbhost":
-	        g_dbHost = theFields[1]
-	      case "dbname":
-          g_dbName = theFields[1]
-        case "emailto":
-	        g_eMailTo = theFields[1]
-	      case "emailfrom":
-	        g_eMailFrom = theFields[1]
-	      case "loadthreshold":
-          g_loadThreshold, _ = strconv.ParseFloat(theFields[1], 64)
-	      case "swapthreshold":
-	        g_swapThreshold, _ = strconv.ParseFloat(theFields[1], 64)
-        case "loadfirstdthreshold":
-	        g_loadFirstDThreshold, _ = strconv.ParseFloat(theFields[1], 64)
-	      case "swapfirstdthreshold":
-	        g_swapFirstDThreshold, _ = strconv.ParseFloat(theFields[1], 64)
-	      case "diskthreshold":
-	        g_diskThreshold, _ = strconv.ParseInt(theFields[1], 10, 64)
-        case "diskreportinterval":
-          g_diskReportInterval, _ = strconv.ParseInt(theFields[1], 10, 64)
-        default:
-          log.Printf("Ignoring nonsense configuration parameter %s\n", theFields[1])
-      }
-	   }
+  for n := 1; inp.Scan(); n++ {
+    theFields := strings.Fields(inp.Text())
+
+    if ((len(theFields) == 0) || strings.HasPrefix(theFields[0], "#")) {
+      continue
+    }
+
+    if (len(theFields) < 2) {
+      log.Fatalf("Fatal %s line %d: %s needs a value\n", *conffile, n, theFields[0])
+    }
+
+    key := strings.ToLower(theFields[0])
+    val := theFields[1]
+
+    haveParam[theFields[0]] = true
+
+    // Thresholds have to be numbers
+    var fval float64
+    var ival int64
+
+    switch key {
+      case "loadthreshold", "swapthreshold", "loadfirstdthreshold", "swapfirstdthreshold":
+        fval, err = strconv.ParseFloat(val, 64)
+      case "diskthreshold", "diskreportinterval":
+        ival, err = strconv.ParseInt(val, 10, 64)
+      default:
+        err = nil
+    }
+
+    if (err != nil) {
+      log.Fatalf("Fatal %s line %d: bad %s value %s\n", *conffile, n, theFields[0], val)
+    }
+
+    switch key {
+      case "bindaddress":
+        g_bindAddr = val
+      case "port":
+        g_port, err = strconv.Atoi(val)
+        if (err != nil) {
+          log.Fatalf("Fatal %s line %d: bad port %s\n", *conffile, n, val)
+        }
+      case "logfile":
+        g_logFile = val
+      case "storage":
+        g_storage = strings.ToLower(val)
+      case "sqlitepath":
+        g_sqlitePath = val
+      case "admintoken":
+        g_adminToken = val
+      case "requireauth":
+        g_requireAuth, err = strconv.ParseBool(val)
+        if (err != nil) {
+          log.Fatalf("Fatal bad requireAuth value %s\n", val)
+        }
+      case "tlscert":
+        g_tlsCert = val
+      case "tlskey":
+        g_tlsKey = val
+      case "tlsclientca":
+        g_tlsClientCA = val
+      case "tlsrequireclientcert":
+        g_tlsRequireClientCert, err = strconv.ParseBool(val)
+        if (err != nil) {
+          log.Fatalf("Fatal bad tlsRequireClientCert value %s\n", val)
+        }
+      case "dbuser":
+        g_dbUser = val
+      case "dbpass":
+        g_dbPass = val
+      case "dbhost":
+        g_dbHost = val
+      case "dbname":
+        g_dbName = val
+      case "emailto":
+        g_eMailTo = val
+      case "emailfrom":
+        g_eMailFrom = val
+      case "loadthreshold":
+        g_loadThreshold = fval
+      case "swapthreshold":
+        g_swapThreshold = fval
+      case "loadfirstdthreshold":
+        g_loadFirstDThreshold = fval
+      case "swapfirstdthreshold":
+        g_swapFirstDThreshold = fval
+      case "diskthreshold":
+        g_diskThreshold = ival
+      case "diskreportinterval":
+        g_diskReportInterval = ival
+      case "rule":
+        ru, err := parseRule(theFields[1:])
+        if (err != nil) {
+          log.Fatalf("Fatal %s line %d: %v\n", *conffile, n, err)
+        }
+        g_rules = append(g_rules, ru)
+      case "notifier":
+        nn, err := parseNotifier(theFields[1:])
+        if (err != nil) {
+          log.Fatalf("Fatal %s line %d: %v\n", *conffile, n, err)
+        }
+        g_notifiers = append(g_notifiers, nn)
+      case "route":
+        err = addRoute(theFields[1:])
+        if (err != nil) {
+          log.Fatalf("Fatal %s line %d: %v\n", *conffile, n, err)
+        }
+      case "notifytemplate":
+        err = addNotifyTemplate(theFields[1:])
+        if (err != nil) {
+          log.Fatalf("Fatal %s line %d: %v\n", *conffile, n, err)
+        }
+      case "maintenance":
+        err = addConfigMaintenance(theFields[1:])
+        if (err != nil) {
+          log.Fatalf("Fatal %s line %d: %v\n", *conffile, n, err)
+        }
+      case "hostgroup":
+        err = addHostgroup(val, theFields[2:])
+        if (err != nil) {
+          log.Fatalf("Fatal %s line %d: %v\n", *conffile, n, err)
+        }
+      case "threshold":
+        err = addThresholdOverride(theFields[1:])
+        if (err != nil) {
+          log.Fatalf("Fatal %s line %d: %v\n", *conffile, n, err)
+        }
+      case "staleintervals":
+        g_staleIntervals, err = strconv.ParseInt(val, 10, 64)
+        if ((err != nil) || (g_staleIntervals < 1)) {
+          log.Fatalf("Fatal %s line %d: bad staleIntervals value %s\n", *conffile, n, val)
+        }
+      case "alertrepeat":
+        g_alertRepeat, err = time.ParseDuration(val)
+        if ((err != nil) || (g_alertRepeat < 0)) {
+          log.Fatalf("Fatal %s line %d: bad alertRepeat value %s\n", *conffile, n, val)
+        }
+      case "hostinterval":
+        // hostInterval host duration
+        if (len(theFields) != 3) {
+          log.Fatalf("Fatal %s line %d: hostInterval needs a host and an interval\n", *conffile, n)
+        }
+        d, err := time.ParseDuration(theFields[2])
+        if ((err != nil) || (d <= 0) || (!validHostname(val))) {
+          log.Fatalf("Fatal %s line %d: bad hostInterval %s %s\n", *conffile, n, val, theFields[2])
+        }
+        g_hostIntervals[val] = d
+      default:
+        log.Printf("Ignoring nonsense configuration parameter %s\n", theFields[0])
+    }
+  }
+
+  if (inp.Err() != nil) {
+    log.Fatalf("Fatal reading configuration file: %v\n", inp.Err())
   }
 
   confFile.Close()
@@ -142,50 +321,131 @@ func main() {
   // Make sure no configuration directives are missing
   //
 
-  if ((haveParam["dbUser"] != true) ||
-    (haveParam["dbPass"] != true) ||
-    (haveParam["dbHost"] != true) ||
-    (haveParam["dbName"] != true) ||
-    (haveParam["eMailTo"] != true) ||
-    (haveParam["eMailFrom"] != true) ||
-    (haveParam["loadThreshold"] != true) ||
-    (haveParam["swapThreshold"] != true) ||
-    (haveParam["loadFirstDThreshold"] != true) ||
-    (haveParam["swapFirstDThreshold"] != true) ||
-    (haveParam["diskThreshold"] != true) ||
-    (haveParam["diskReportInterval"] != true)) {
-      log.Fatalf("Fatal missing configuration directive\n")
+  err = setupNotifiers(haveParam)
+  if (err != nil) {
+    log.Fatalf("Fatal %v\n", err)
+  }
+
+  //
+  // The old threshold directives still work, as rules of their own
+  //
+
+  g_rules = append(legacyRules(haveParam), g_rules...)
+
+  ruleNames := make(map[string]bool)
+  for _, ru := range g_rules {
+    if (ruleNames[ru.name]) {
+      log.Fatalf("Fatal more than one rule named %s\n", ru.name)
+    }
+    ruleNames[ru.name] = true
+  }
+
+  err = checkGroupReferences()
+  if (err != nil) {
+    log.Fatalf("Fatal %v\n", err)
+  }
+
+  err = checkMaintenance()
+  if (err != nil) {
+    log.Fatalf("Fatal %v\n", err)
+  }
+
+  if (setFlags["b"]) {
+    g_bindAddr = *bindFlag
+  }
+
+  if (setFlags["p"]) {
+    g_port = *portFlag
+  }
+
+  if ((g_port < 1) || (g_port > 65535)) {
+    log.Fatalf("Fatal bad port %d, must be between 1 and 65535\n", g_port)
+  }
+
+  listenAddr := net.JoinHostPort(g_bindAddr, strconv.Itoa(g_port))
+
+  _, err = net.ResolveTCPAddr("tcp", listenAddr)
+  if (err != nil) {
+    log.Fatalf("Fatal bad bind address %s: %v\n", g_bindAddr, err)
+  }
+
+  if ((!setFlags["l"]) && (g_logFile != "")) {
+    openLog(g_logFile)
+  }
+
+  if ((g_tlsCert == "") != (g_tlsKey == "")) {
+    log.Fatalf("Fatal tlsCert and tlsKey must be given together\n")
+  }
+
+  if (((g_tlsClientCA != "") || g_tlsRequireClientCert) && (g_tlsCert == "")) {
+    log.Fatalf("Fatal client certificates need tlsCert and tlsKey\n")
+  }
+
+  if (g_tlsRequireClientCert && (g_tlsClientCA == "")) {
+    log.Fatalf("Fatal tlsRequireClientCert needs tlsClientCA\n")
+  }
+
+  switch g_storage {
+    case "mysql":
+      if ((haveParam["dbUser"] != true) ||
+        (haveParam["dbPass"] != true) ||
+        (haveParam["dbHost"] != true) ||
+        (haveParam["dbName"] != true)) {
+          log.Fatalf("Fatal missing database configuration directive\n")
+      }
+    case "sqlite":
+      if (haveParam["sqlitePath"] != true) {
+        log.Fatalf("Fatal missing sqlitePath configuration directive\n")
+      }
   }
 
   log.Printf("Configuration report follows\n")
-  log.Printf("  DB user: %s DB host: %s DB name: %s\n", g_dbUser, g_dbHost, g_dbName)
+  log.Printf("  Listen address: %s\n", listenAddr)
+  log.Printf("  Storage: %s\n", g_storage)
+  switch g_storage {
+    case "mysql":
+      log.Printf("  DB user: %s DB host: %s DB name: %s\n", g_dbUser, g_dbHost, g_dbName)
+    case "sqlite":
+      log.Printf("  SQLite path: %s\n", g_sqlitePath)
+  }
   log.Printf("  E-mail to: %s E-mail from: %s\n", g_eMailTo, g_eMailFrom)
-  log.Printf("  Thresholds: %f %f %f %f %d\n", g_loadThreshold, g_swapThreshold, g_loadFirstDThreshold, g_swapFirstDThreshold, g_diskThreshold)
-  log.Printf("  Disk report interval: %d sec\n", g_diskReportInterval)
+  for _, nn := range g_notifiers {
+    log.Printf("  Notifier %s\n", nn)
+  }
+  for _, ru := range g_rules {
+    log.Printf("  Rule %s\n", ru)
+  }
+  log.Printf("  Alert repeat: %v\n", g_alertRepeat)
+  for _, mw := range maintenances {
+    log.Printf("  Maintenance %s\n", mw)
+  }
+  for _, g := range g_hostgroups {
+    log.Printf("  Hostgroup %s: %s\n", g.name, strings.Join(g.members, " "))
+  }
+  log.Printf("  Threshold overrides: %d hosts, %d hostgroups\n", len(g_hostThresholds), len(g_groupThresholds))
+  log.Printf("  Stale after: %d missed reports, %d hosts with their own interval\n", g_staleIntervals, len(g_hostIntervals))
+  log.Printf("  Require authentication: %t Token issuing: %t\n", g_requireAuth, g_adminToken != "")
+  log.Printf("  TLS: %t Client CA: %s Require client certificate: %t\n", g_tlsCert != "", g_tlsClientCA, g_tlsRequireClientCert)
+
+  if (!g_requireAuth) {
+    log.Printf("  WARNING: hosts without a token may submit unsigned reports\n")
+  }
 
   log.Printf("Configuration report ends\n")
 
   //
-  // The DSN used to connect to the database should look like this:
-  //   hostmon:xyzzy123@tcp(192.168.1.253:3306)/hostmonitor
+  // Open the storage backend. This also makes sure that we're in business.
   //
 
-  myDSN := g_dbUser + ":" + g_dbPass + "@tcp(" + g_dbHost + ":3306)/" + g_dbName
-
-  // When dbconn is global, this needs to be =, not := !!
-  dbconn, err = sql.Open("mysql", myDSN)
+  store, err = openStore(g_storage)
 
   if err != nil {
-    log.Fatalf("Fatal connecting to database\n")
+    log.Fatalf("Fatal opening %s storage: %v\n", g_storage, err)
   }
 
-  //
-  // Test the database connection to make sure that we're in business.
-  //
-
-  err = dbconn.Ping()
-  if err != nil {
-    log.Fatalf("Fatal attempting to ping database")
+  err = loadMaintenance()
+  if (err != nil) {
+    log.Fatalf("Fatal reading maintenance windows: %v\n", err)
   }
 
   //
@@ -193,15 +453,65 @@ func main() {
   //
 
   go task_scan_and_notify()
+  go task_retry_notifications()
 
   //
-  // Start listening for connections from the dashboard
+  // Start listening for connections from agents and browsers
   //
 
   http.HandleFunc("/host/", task_handle_host)
-  http.ListenAndServe(":8962", nil)
+  http.HandleFunc("/report/", task_handle_report)
+  http.HandleFunc("/token/", task_handle_token)
+  http.HandleFunc("/alert/", task_handle_alert)
+  http.HandleFunc("/notification/", task_handle_notification)
+  http.HandleFunc("/maintenance/", task_handle_maintenance)
+  http.HandleFunc("/dashboard/", task_handle_dashboard)
+  http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+    if (r.URL.Path != "/") {
+      http.NotFound(w, r)
+      return
+    }
+    http.Redirect(w, r, "/dashboard/", http.StatusFound)
+  })
+  if (g_tlsCert == "") {
+    err = http.ListenAndServe(listenAddr, nil)
+  } else {
+    srv := &http.Server{Addr: listenAddr}
+
+    srv.TLSConfig, err = serverTLSConfig()
+    if (err != nil) {
+      log.Fatalf("Fatal setting up TLS: %v\n", err)
+    }
 
-  dbconn.Close()
+    err = srv.ListenAndServeTLS(g_tlsCert, g_tlsKey)
+  }
+
+  log.Printf("Server stopped: %v\n", err)
+
+  store.Close()
+}
+
+//
+// Complain about the command line and exit
+//
+
+func usageError(format string, args ...interface{}) {
+  fmt.Fprintf(flag.CommandLine.Output(), "%s: %s\n", os.Args[0], fmt.Sprintf(format, args...))
+  flag.Usage()
+  os.Exit(2)
+}
+
+//
+// Send the log to a file instead of standard error, appending to it
+//
+
+func openLog(path string) {
+  f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+  if (err != nil) {
+    log.Fatalf("Fatal opening log file %s: %v\n", path, err)
+  }
+
+  log.SetOutput(f)
 }
 
 //
@@ -209,8 +519,6 @@ func main() {
 //
 
 func task_handle_host(w http.ResponseWriter, r *http.Request) {
-  var m Message
-
   // Extract hostname component of the path and the method
   h := r.URL.Path[len("/host/"):]
   me := r.Method
@@ -219,161 +527,112 @@ func task_handle_host(w http.ResponseWriter, r *http.Request) {
 
   // We will key off r.Method = "GET" or "POST"
 
-  // /host/        GET -> list all POST -> do nothing
-  // /host/name    GET -> list one POST -> update (or create) one
+  // /host/                GET -> list all POST -> do nothing
+  // /host/name            GET -> list one POST -> update (or create) one
+  // /host/name/history    GET -> time series for one
+
+  if name, rest, ok := strings.Cut(h, "/"); ok {
+    if (rest != "history") {
+      http.NotFound(w, r)
+      return
+    }
+
+    task_host_history(w, r, name)
+    return
+  }
 
   switch me {
     case "GET":
       if (len(h) == 0) {
-        // If we get no host parameter, we'll dump the whole list, so, first
-        //  execute (1) and for each result in (1) execute (2).
-        rs, er := dbconn.Query("SELECT host from hosts ORDER BY host ASC")
-        if (er != nil) {
-          http.Error(w, "Fatal attempting to dump hosts", http.StatusInternalServerError)
-        }
-
-        var hh string
-        for rs.Next() {
-          er = rs.Scan(&hh)
-          if (er != nil) {
-            http.Error(w, "Fatal attempting to dump hosts", http.StatusInternalServerError)
-          }
-          dbCmd_2 := "SELECT * FROM reports WHERE hostname = '" + hh + "' ORDER BY timestamp DESC LIMIT 1;"
-          qe := dbconn.QueryRow(dbCmd_2).Scan(&m.Timestamp, &m.Hostname, &m.KernelVer, &m.Release, &m.Uptime,
-            &m.NumCPUs, &m.Memtotal, &m.LoadOne, &m.LoadFive, &m.LoadFifteen, &m.SwapUsed, &m.DiskReport)
-          if (qe  != nil) {
-            http.Error(w, "Fatal attempting to dump hosts", http.StatusInternalServerError)
-          }
-          rp, erro := json.Marshal(m)
-          if (erro != nil) {
-            http.Error(w, "Fatal attempting to marshal JSON", http.StatusInternalServerError)
-          }
-          fmt.Fprintf(w, "%s", rp)
-        }
+        // If we get no host parameter, we'll dump the whole list
+        task_list_hosts(w, r)
       } else {
-        // When we do have a host, just grab the most recent line for that host.
-        dbCmd := "SELECT * from reports where hostname = '" + h + "' ORDER BY timestamp DESC LIMIT 1;"
-
-        //
-        // For each field, specify a parameter to QueryRow().Scan() i.e.
-        //  db.QueryRow(cmd).Scan(&f1, &f2, &f3, &f3) and so on
-        //
+        if (!validHostname(h)) {
+          http.Error(w, "Invalid host name " + h, http.StatusBadRequest)
+          return
+        }
 
-        queryErr := dbconn.QueryRow(dbCmd).Scan(&m.Timestamp, &m.Hostname, &m.KernelVer, &m.Release, &m.Uptime,
-          &m.NumCPUs, &m.Memtotal, &m.LoadOne, &m.LoadFive, &m.LoadFifteen, &m.SwapUsed, &m.DiskReport)
+        // When we do have a host, just grab the most recent report for that host.
+        m, queryErr := store.LatestReport(h)
 
         switch {
-          case queryErr == sql.ErrNoRows:
+          case queryErr == errNoReports:
             http.Error(w, "No such host " + h, http.StatusNotFound)
             return
           case queryErr != nil:
-            dbconn.Close()
             http.Error(w, "Fatal attempting to execute SELECT for host " + h, http.StatusInternalServerError)
             return
           default:
         }
-        rpt, err := json.Marshal(m)
+        rpt, err := json.Marshal(newHostStatus(m, time.Now()))
 
         if (err != nil) {
           http.Error(w, "Fatal attempting to marshal JSON", http.StatusInternalServerError)
           return
         }
 
+        w.Header().Set("Content-Type", "application/json")
         fmt.Fprintf(w, "%s", rpt)
       }
   case "POST":
     if (len(h) == 0) {
       http.Error(w, "Must specify a host for a POST request", http.StatusInternalServerError)
+      return
     }
 
-    // Must call ParseForm() before accessing elements
-    r.ParseForm()
-    //bb := r.Form
-
-    // Populate message Fields
-    m.Timestamp, _ = strconv.ParseInt(r.FormValue("Timestamp"), 10, 64)
-    m.Hostname = r.FormValue("Hostname")
-    m.NumCPUs, _ = strconv.ParseInt(r.FormValue("NumCPUs"), 10, 64)
-    m.Memtotal, _ = strconv.ParseInt(r.FormValue("Memtotal"), 10, 64)
-    m.LoadOne, _ = strconv.ParseFloat(r.FormValue("LoadOne"), 64)
-    m.LoadFive, _ = strconv.ParseFloat(r.FormValue("LoadFive"), 64)
-    m.LoadFifteen, _ = strconv.ParseFloat(r.FormValue("LoadFifteen"), 64)
-    m.SwapUsed, _ = strconv.ParseFloat(r.FormValue("SwapUsed"), 64)
-    m.KernelVer = r.FormValue("KernelVer")
-    m.Release = r.FormValue("Release")
-    m.Uptime = r.FormValue("Uptime")
-    m.DiskReport = r.FormValue("DiskReport")
-
-    //
-    // Check to see if the host exists in the host tracking table
-    //
-
-    dbCmd := "SELECT COUNT(*) FROM hosts where host = '" + m.Hostname + "';"
-  	_, dbExecErr := dbconn.Exec(dbCmd)
-  	if dbExecErr != nil {
-      http.Error(w, "Fatal executing select for host " + m.Hostname, http.StatusInternalServerError)
+    // Read the body ourselves so the signature can be checked before parsing
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxReportBytes))
+    if (err != nil) {
+      http.Error(w, "Failed reading report: " + err.Error(), http.StatusRequestEntityTooLarge)
+      return
     }
 
-    var hostp string
-    _ = dbconn.QueryRow(dbCmd).Scan(&hostp)
-    hostpi, _ := strconv.Atoi(hostp)
-
-    //
-    // If not, add it to the hosts table. MySQL will generate an ID
-    //
-
-    if (hostpi == 0) {
-      dbCmd = "INSERT INTO hosts (host) VALUES ('" + m.Hostname + "');"
-      _, dbExecErr = dbconn.Exec(dbCmd)
-      if dbExecErr != nil {
-        http.Error(w, "Failed executing host table INSERT for host " + m.Hostname, http.StatusInternalServerError)
-      }
+    err = authenticateReport(r, h, body)
+    if (err != nil) {
+      rejectUnauthenticated(w, r, h, err)
+      return
     }
 
-    //
-    // Retrieve previous set of data points for this host from the reports
-    //  table
-    //
-
-  	dbCmd = "SELECT * from reports where hostname = '" + m.Hostname + "' ORDER BY timestamp DESC LIMIT 1;"
-
-    //
-    // Note regarding db.QueryRow(): We should know how many fields we
-  	//  have in the table. For each field, specify a parameter to the
-  	//  QueryRow().Scan() method. i.e.
-  	//      db.QueryRow(cmd).Scan(&f1, &f2, &f3, &f4) and so on
-    //
+    r.Body = io.NopCloser(bytes.NewReader(body))
 
-    var dbTimeStamp, dbHostName, dbKernelVer, dbRelease, dbUptime, dbNumCPUs, dbPhysMem, dbLoadOne, dbLoadFive, dbLoadFifteen, dbSwapPctUsed, dbDiskReport string
+    // Populate message fields and make sure the report is sane before it
+    //  goes anywhere near the database
+    m, ve := parseFormMessage(r)
+    if (len(ve) == 0) {
+      ve = validateMessage(m, h)
+    }
 
-    queryErr := dbconn.QueryRow(dbCmd).Scan(&dbTimeStamp, &dbHostName, &dbKernelVer, &dbRelease, &dbUptime,
-      &dbNumCPUs, &dbPhysMem, &dbLoadOne, &dbLoadFive, &dbLoadFifteen, &dbSwapPctUsed, &dbDiskReport)
+    if (len(ve) != 0) {
+      log.Printf("Rejected POST for host %s from %s: %s\n", h, r.RemoteAddr, ve.Error())
+      http.Error(w, ve.Error(), http.StatusBadRequest)
+      return
+    }
 
+    prev, err := claimReportTimestamp(r, m)
     switch {
-  	    // If this happens, first database entry for the host in question
-  	    case queryErr == sql.ErrNoRows:
-  	        log.Printf("No rows returned executing SELECT for host %s\n", m.Hostname)
-  	    case queryErr != nil:
-  	        dbconn.Close()
-            http.Error(w, "Fatal attempting to execute SELECT for host" + m.Hostname, http.StatusInternalServerError)
-  	    default:
-  	}
+      case err == errReportReplayed:
+        log.Printf("Rejected POST for host %s from %s: %v\n", h, r.RemoteAddr, err)
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+      case err != nil:
+        log.Printf("Failed checking report order for host %s: %v\n", h, err)
+        http.Error(w, "Fatal checking report for host " + h, http.StatusInternalServerError)
+        return
+    }
 
     //
-  	// Insert the data points from the current report into the database.
+    // Insert the data points from the current report into the database. The
+    //  store takes care of adding the host to the hosts table if need be.
     //
 
-  	dbCmd = "INSERT INTO reports VALUES (" + strconv.FormatInt(m.Timestamp, 10) + ",'" + m.Hostname + "','" + m.KernelVer + "','" + m.Release + "','" + m.Uptime + "','" + strconv.FormatInt(m.NumCPUs, 10) + "','" + strconv.FormatInt(m.Memtotal, 10) + "','" + strconv.FormatFloat(m.LoadOne, 'f', 6, 64) + "','" + strconv.FormatFloat(m.LoadFive, 'f', 6, 64) + "','" + strconv.FormatFloat(m.LoadFifteen, 'f', 6, 64) + "','" + strconv.FormatFloat(m.SwapUsed, 'f', 6, 64) + "','" + m.DiskReport + "');"
-
-    log.Printf("Attempting to execute: %s\n", dbCmd)
-  	_, dbExecErr = dbconn.Exec(dbCmd)
-  	if dbExecErr != nil {
-  	    dbconn.Close()
-        http.Error(w, "Fatal executing reports table INSERT for host " + m.Hostname, http.StatusInternalServerError)
-  	}
+    dbExecErr := store.StoreReport(m)
+    if dbExecErr != nil {
+      releaseReportTimestamp(r, m, prev)
+      log.Printf("Failed storing report for host %s: %v\n", m.Hostname, dbExecErr)
+      http.Error(w, "Fatal storing report for host " + m.Hostname, http.StatusInternalServerError)
+      return
+    }
 
-    // r.Form is automatically a parsed map with appropriate keys and values
-    //log.Printf("Got POST <%s>\n", bb)
     log.Printf("POST from: %s %s %s\n", m.Hostname, m.KernelVer, m.Release)
 
   }
@@ -385,129 +644,53 @@ func task_handle_host(w http.ResponseWriter, r *http.Request) {
 //
 
 func task_scan_and_notify() {
-  t := time.NewTicker(time.Second*60) // Fixed for testing, configurable when done
-
-  var htt []string
+  t := time.NewTicker(scanInterval)
 
   for range t.C {
     // Dump the list of hosts
-    rs, er := dbconn.Query("SELECT host from hosts ORDER BY host ASC")
+    htt, er := store.ListHosts()
     if (er != nil) {
-      log.Fatalf("Fatal compiling list for scan and notify")
-    }
-
-    var hh string
-    for rs.Next() {
-      er = rs.Scan(&hh)
-      if (er != nil) {
-        log.Fatalf("Fatal compiling list for scan and notify")
-      }
-
-      htt = append(htt, hh)
+      log.Printf("Failed compiling list for scan and notify: %v\n", er)
+      continue
     }
 
     // For each host, run checks and send notifications
 
     for c, _ := range htt {
-      rss, err := dbconn.Query("SELECT * FROM reports WHERE hostname = '" + htt[c] + "' ORDER BY timestamp DESC LIMIT 2")
-      if (err != nil) {
-        log.Fatalf("Fatal attempting to scan and notify 1")
+      n := cadenceSamples
+      if (ruleSamples() > n) {
+        n = ruleSamples()
       }
 
-      var f0, f1, f2, f3, f4, f5, f6, f7, f8, f9, f10, f11 string
-      var f0h, f1h, f2h, f3h, f4h, f5h, f6h, f7h, f8h, f9h, f10h, f11h string
-      // Collect data point 1 for this host (most recent)
-      rss.Next()
-      err = rss.Scan(&f0, &f1, &f2, &f3, &f4, &f5, &f6, &f7, &f8, &f9, &f10, &f11)
+      rpts, err := store.LastReports(htt[c], n)
       if (err != nil) {
-        log.Printf("Skipping inconsistent host " + htt[c] + ", host in hosts table but no reports found")
+        log.Printf("Failed attempting to scan and notify for host %s: %v\n", htt[c], err)
         continue
       }
 
-      log.Printf("#1: %s %s %s %s %s", f0, f1, f2, f3, f4)
-
-      // Collect data point 2 for this host (historical)
-      rss.Next()
-      err = rss.Scan(&f0h, &f1h, &f2h, &f3h, &f4h, &f5h, &f6h, &f7h, &f8h, &f9h, &f10h, &f11h)
-      if (err != nil) {
-        log.Printf("Only one record for host " + htt[c])
+      // Collect data point 1 for this host (most recent)
+      if (len(rpts) < 1) {
+        log.Printf("Skipping inconsistent host %s, host in hosts table but no reports found\n", htt[c])
         continue
       }
 
-      log.Printf("#2: %s %s %s %s %s", f0, f1, f2, f3, f4)
+      cur := rpts[0]
 
-      lo, _ := strconv.ParseFloat(f7, 64)
-      loh, _ := strconv.ParseFloat(f7h, 64)
-      sw, _ := strconv.ParseFloat(f10, 64)
-      swh, _ := strconv.ParseFloat(f10h, 64)
+      observeCadence(htt[c], rpts)
 
-      dl := math.Abs(lo-loh)
-      ds := math.Abs(sw-swh)
-
-      log.Printf("%f %f", dl, ds)
-
-      // Look at system load and notify on positive differential exceeding Thresholds
-      if (lo > loh) {
-        if ((lo > g_loadThreshold) && (dl > g_loadFirstDThreshold)) {
-          send_email_notification("Subject: System load warning on " + htt[c], "System load has reached " + f7 + " from " + f7h)
-        }
-      }
-
-      // Look at swap utilization and notify on positive differential exceeding thresholds
-      if (sw > swh) {
-        if ((sw > g_swapThreshold) && (ds > g_swapFirstDThreshold)) {
-          send_email_notification("Subject: Swap utilization warning on " + htt[c], "Swap utilization has reached " + f10 + "% from " + f10h + "%")
-        }
+      // A host that has stopped reporting has nothing new to look at, so
+      //  its other alerts stay as they were
+      if sa, stale := checkStale(cur, time.Now()); stale {
+        updateAlerts(htt[c], append(heldAlerts(htt[c], "stale"), sa), ruleRepeats())
+        continue
       }
 
-      // Look at disk report and notify on threshold exceeded
-      diskReptComponents := strings.Fields(f11)
-
-      for i := 0; i < len(diskReptComponents)-1; i++ {
-        valueToTest, _ := strconv.ParseInt(diskReptComponents[i+1], 10, 64)
-
-        if ((valueToTest >= g_diskThreshold) && (math.Abs(float64(time.Now().Unix() - lastDNotify[htt[c]])) >= float64(g_diskReportInterval))) {
-          send_email_notification("Subject: Disk utilization warning on " + htt[c], "Disk utilization on " + diskReptComponents[i] + " has reached " + diskReptComponents[i+1] + "%")
-          lastDNotify[htt[c]] = time.Now().Unix()
-        }
-      }
+      // Evaluate the alert rules against the host's recent reports, and
+      //  look at its check scripts
+      observed := evaluateRules(htt[c], rpts)
 
+      updateAlerts(htt[c], append(observed, checkAlerts(cur)...), ruleRepeats())
     }
 
-    //log.Printf("Host dump follows")
-    //for c, _ := range htt {
-    //  log.Printf("  %s", htt[c])
-    //}
-
-    htt = nil
-
-  }
-}
-
-//
-// Send a notification e-mail
-//
-
-func send_email_notification(subj string, body string) {
-  eMailConn, eMailErr := smtp.Dial("localhost:25")
-  if eMailErr != nil {
-    log.Printf("SMTP server connection failure sending notification\n")
-  }
-
-  eMailConn.Mail(g_eMailFrom)
-  eMailConn.Rcpt(g_eMailTo)
-
-  wc, eMailErr := eMailConn.Data()
-  if eMailErr != nil {
-    log.Printf("Failure initiating DATA stage sending notification\n")
-  }
-
-  defer wc.Close()
-
-  buf := bytes.NewBufferString("From: " + g_eMailFrom + "\r\n" + "To: " + g_eMailTo + "\r\n" + subj + "\r\n\r\n" + body + "\r\n")
-
-  _, eMailErr = buf.WriteTo(wc)
-  if eMailErr != nil {
-    log.Printf("Failure writing notification message DATA\n")
   }
 }
@@ -0,0 +1,557 @@
+//
+// Host monitor data collection server, alert state
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "io"
+  "log"
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+//
+// A condition the scanner found on a host: a rule that fired, a failing
+//  check, a host that stopped reporting. Check is the name of the rule,
+//  "check:" and the script name, or "stale". Mount is set for disk rules so
+//  each filesystem is tracked on its own. Rule alerts carry the value that
+//  tripped the rule, its value in the report before, and the threshold.
+//
+// Each host, check and mount has its own alert, which moves through
+//
+//  pending       the condition holds but not yet for as many reports as the
+//                rule's for= asks; no notification yet
+//  firing        notified when it starts, and again every repeat interval
+//  acknowledged  someone is on it; no more repeats
+//  resolved      the condition has cleared; a recovery notice goes out if
+//                the alert was notified
+//
+// An alert that is silenced keeps its state but sends nothing, recovery
+//  included, until the silence runs out. One whose host is in a maintenance
+//  window, named by Maintenance, has its notifications recorded but not
+//  sent, and is notified if it is still firing once the window is over.
+//
+
+type Alert struct {
+  Hostname string
+  Check string
+  Mount string `json:",omitempty"`
+  Severity string
+  Message string
+  State string
+  Op string `json:",omitempty"`
+  Value *float64 `json:",omitempty"`
+  Previous *float64 `json:",omitempty"`
+  Threshold *float64 `json:",omitempty"`
+  Since int64
+  FiringSince int64 `json:",omitempty"`
+  ResolvedAt int64 `json:",omitempty"`
+  LastNotified int64 `json:",omitempty"`
+  AckedBy string `json:",omitempty"`
+  AckComment string `json:",omitempty"`
+  SilencedUntil int64 `json:",omitempty"`
+  Maintenance string `json:",omitempty"`
+
+  // Whether the alert has been sent while firing, so we know to send the
+  //  recovery notice, and whether it has been recorded as suppressed in the
+  //  current maintenance window
+  notified bool
+  suppressed bool
+}
+
+const (
+  alertPending = "pending"
+  alertFiring = "firing"
+  alertAcknowledged = "acknowledged"
+  alertResolved = "resolved"
+)
+
+func (a Alert) key() string {
+  return a.Hostname + "\x00" + a.Check + "\x00" + a.Mount
+}
+
+func (a Alert) active() bool {
+  return a.State != alertResolved
+}
+
+//
+// Default repeat interval for firing alerts, set with alertRepeat in the
+//  configuration file; rules may have their own. Zero means notify once.
+//
+
+var g_alertRepeat time.Duration
+
+// How long resolved alerts are kept to be looked at
+const resolvedRetention = 24*time.Hour
+
+//
+// Every alert by key, and the silences
+//
+
+var alertsMu sync.Mutex
+var alerts = make(map[string]*Alert)
+var silences []*Silence
+
+var errNoAlert = errors.New("no such active alert")
+
+//
+// A silence stops notifications for a host's alerts until it runs out. Check
+//  and Mount narrow it to one alert; empty matches everything.
+//
+
+type Silence struct {
+  ID int
+  Hostname string
+  Check string `json:",omitempty"`
+  Mount string `json:",omitempty"`
+  Until int64
+  Comment string `json:",omitempty"`
+  By string `json:",omitempty"`
+}
+
+var nextSilenceID = 1
+
+func (s *Silence) matches(a *Alert) bool {
+  return (s.Hostname == a.Hostname) && ((s.Check == "") || (s.Check == a.Check)) && ((s.Mount == "") || (s.Mount == a.Mount))
+}
+
+//
+// One notification to send once the lock is dropped
+//
+
+type alertNotice struct {
+  kind string
+  alert Alert
+}
+
+//
+// Bring a host's alerts up to date with what the scanner just observed, each
+//  either pending or firing, and send whatever notifications are due. Alerts
+//  for the host that weren't observed are resolved. repeat holds the repeat
+//  intervals of the checks that don't use the default.
+//
+
+func updateAlerts(host string, observed []Alert, repeat map[string]time.Duration) {
+  var notices []alertNotice
+
+  now := time.Now()
+  seen := make(map[string]bool)
+
+  maint := ""
+  if mw := maintenanceFor(host, now); mw != nil {
+    maint = mw.ID
+  }
+
+  alertsMu.Lock()
+
+  for _, o := range observed {
+    k := o.key()
+    seen[k] = true
+
+    a, ok := alerts[k]
+    if ((!ok) || (!a.active())) {
+      a = &Alert{Hostname: o.Hostname, Check: o.Check, Mount: o.Mount, State: alertPending, Since: now.Unix()}
+      alerts[k] = a
+    }
+
+    // Only a worse severity is worth telling anyone about, even once
+    //  acknowledged; a better one is just recorded
+    escalated := (a.State != alertPending) && (severityRank[o.Severity] > severityRank[a.Severity])
+    a.Severity, a.Message = o.Severity, o.Message
+    a.Op, a.Value, a.Previous, a.Threshold = o.Op, o.Value, o.Previous, o.Threshold
+    a.Maintenance = maint
+
+    if (o.State == alertPending) {
+      continue
+    }
+
+    if (a.State == alertPending) {
+      a.State, a.FiringSince = alertFiring, now.Unix()
+    }
+
+    a.SilencedUntil = silencedUntil(a, now)
+    if (a.SilencedUntil != 0) {
+      continue
+    }
+
+    if (maint != "") {
+      if (!a.suppressed) {
+        notices = append(notices, alertNotice{"firing", *a})
+        a.suppressed = true
+      }
+      continue
+    }
+    a.suppressed = false
+
+    ri := g_alertRepeat
+    if r, ok := repeat[a.Check]; ok {
+      ri = r
+    }
+
+    switch {
+      case escalated:
+        notices = append(notices, alertNotice{"escalated", *a})
+      case a.State == alertAcknowledged:
+        continue
+      case !a.notified:
+        notices = append(notices, alertNotice{"firing", *a})
+      case (ri > 0) && (now.Sub(time.Unix(a.LastNotified, 0)) >= ri):
+        notices = append(notices, alertNotice{"repeat", *a})
+      default:
+        continue
+    }
+
+    a.notified, a.LastNotified = true, now.Unix()
+  }
+
+  for k, a := range alerts {
+    if ((a.Hostname != host) || seen[k]) {
+      continue
+    }
+
+    if (a.active()) {
+      silenced := silencedUntil(a, now) != 0
+      a.State, a.ResolvedAt, a.SilencedUntil, a.Maintenance = alertResolved, now.Unix(), 0, maint
+      if ((a.notified || ((maint != "") && a.suppressed)) && (!silenced)) {
+        notices = append(notices, alertNotice{"recovered", *a})
+      }
+    } else if (now.Sub(time.Unix(a.ResolvedAt, 0)) > resolvedRetention) {
+      delete(alerts, k)
+    }
+  }
+
+  alertsMu.Unlock()
+
+  for _, n := range notices {
+    notifyAlert(n.kind, n.alert)
+  }
+}
+
+//
+// A host's active alerts as the scanner last saw them, other than those for
+//  check, to pass back to updateAlerts when there's nothing new to say about
+//  them
+//
+
+func heldAlerts(host string, check string) []Alert {
+  var held []Alert
+
+  alertsMu.Lock()
+  defer alertsMu.Unlock()
+
+  for _, a := range alerts {
+    if ((a.Hostname == host) && (a.Check != check) && a.active()) {
+      h := *a
+      if (h.State != alertPending) {
+        h.State = alertFiring
+      }
+      held = append(held, h)
+    }
+  }
+
+  return held
+}
+
+//
+// When the silence covering an alert runs out, or zero if there isn't one
+//
+
+func silencedUntil(a *Alert, now time.Time) int64 {
+  var until int64
+
+  for _, s := range silences {
+    if ((s.Until > now.Unix()) && s.matches(a) && (s.Until > until)) {
+      until = s.Until
+    }
+  }
+
+  return until
+}
+
+//
+// Notify about an alert, with the host's latest report and hostgroups for
+//  the templates
+//
+
+func notifyAlert(kind string, a Alert) {
+  n := &Notification{Kind: kind, Alert: a, Groups: hostGroups(a.Hostname)}
+
+  m, err := store.LatestReport(a.Hostname)
+  if (err == nil) {
+    n.Host = &m
+  }
+
+  err = renderNotification(n)
+  if (err != nil) {
+    log.Printf("Failed rendering %s notification for %s on %s: %v\n", kind, a.Check, a.Hostname, err)
+    return
+  }
+
+  if (a.Maintenance != "") {
+    log.Printf("Alert %s during maintenance %s, not sent: %s\n", kind, a.Maintenance, n.Subject)
+  } else {
+    log.Printf("Alert %s: %s\n", kind, n.Subject)
+  }
+
+  dispatchNotification(n)
+}
+
+//
+// Alerts ordered by host, check and mount point, for every host if host is
+//  empty. Resolved alerts are left out unless asked for.
+//
+
+func listAlerts(host string, resolved bool) []Alert {
+  alertsMu.Lock()
+  defer alertsMu.Unlock()
+
+  out := make([]Alert, 0)
+
+  for _, a := range alerts {
+    if (((host == "") || (a.Hostname == host)) && (resolved || a.active())) {
+      out = append(out, *a)
+    }
+  }
+
+  sort.Slice(out, func(i int, j int) bool { return out[i].key() < out[j].key() })
+
+  return out
+}
+
+func activeAlerts(host string) []Alert {
+  return listAlerts(host, false)
+}
+
+//
+// Acknowledge a host's firing alert
+//
+
+func ackAlert(host string, check string, mount string, by string, comment string) (Alert, error) {
+  alertsMu.Lock()
+  defer alertsMu.Unlock()
+
+  a, ok := alerts[Alert{Hostname: host, Check: check, Mount: mount}.key()]
+  if ((!ok) || (!a.active())) {
+    return Alert{}, errNoAlert
+  }
+
+  if (a.State == alertPending) {
+    return Alert{}, errors.New("alert is still pending")
+  }
+
+  a.State, a.AckedBy, a.AckComment = alertAcknowledged, by, comment
+
+  return *a, nil
+}
+
+//
+// Silence a host's alerts, or one of them, for a while
+//
+
+func addSilence(s Silence) Silence {
+  alertsMu.Lock()
+  defer alertsMu.Unlock()
+
+  now := time.Now()
+
+  // Drop silences that have run out while we're here
+  var live []*Silence
+  for _, o := range silences {
+    if (o.Until > now.Unix()) {
+      live = append(live, o)
+    }
+  }
+
+  s.ID = nextSilenceID
+  nextSilenceID++
+  silences = append(live, &s)
+
+  for _, a := range alerts {
+    if (a.active() && s.matches(a)) {
+      a.SilencedUntil = silencedUntil(a, now)
+    }
+  }
+
+  return s
+}
+
+//
+// Lift a host's silences, or those for one check if check isn't empty, and
+//  say how many there were
+//
+
+func removeSilences(host string, check string) int {
+  var live []*Silence
+
+  alertsMu.Lock()
+  defer alertsMu.Unlock()
+
+  for _, s := range silences {
+    if ((s.Hostname != host) || ((check != "") && (s.Check != check))) {
+      live = append(live, s)
+    }
+  }
+
+  n := len(silences) - len(live)
+  silences = live
+
+  now := time.Now()
+  for _, a := range alerts {
+    if ((a.Hostname == host) && a.active()) {
+      a.SilencedUntil = silencedUntil(a, now)
+    }
+  }
+
+  return n
+}
+
+func listSilences(host string) []Silence {
+  alertsMu.Lock()
+  defer alertsMu.Unlock()
+
+  out := make([]Silence, 0)
+  now := time.Now().Unix()
+
+  for _, s := range silences {
+    if ((s.Until > now) && ((host == "") || (s.Hostname == host))) {
+      out = append(out, *s)
+    }
+  }
+
+  return out
+}
+
+//
+// Handle a connection to /alert/. Acknowledging and silencing take the admin
+//  token, like /token/.
+//
+//  /alert/                GET -> every active alert, ?resolved=true adds
+//                                recently resolved ones
+//  /alert/name            GET -> alerts for one host
+//  /alert/name/ack        POST -> acknowledge {"Check", "Mount", "Comment"}
+//  /alert/name/silence    GET -> the host's silences
+//                         POST -> silence {"Check", "Mount", "For", "Comment"}
+//                         DELETE -> lift the host's silences, ?check= for one
+//
+
+func task_handle_alert(w http.ResponseWriter, r *http.Request) {
+  h, action, _ := strings.Cut(r.URL.Path[len("/alert/"):], "/")
+
+  if ((h != "") && (!validHostname(h))) {
+    http.Error(w, "Invalid host name " + h, http.StatusBadRequest)
+    return
+  }
+
+  switch {
+    case action == "":
+      if (r.Method != "GET") {
+        w.Header().Set("Allow", "GET")
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+      }
+      writeAlertJSON(w, listAlerts(h, r.URL.Query().Get("resolved") == "true"))
+      return
+    case (h == "") || ((action != "ack") && (action != "silence")):
+      http.NotFound(w, r)
+      return
+    case (action == "silence") && (r.Method == "GET"):
+      writeAlertJSON(w, listSilences(h))
+      return
+  }
+
+  if (!adminAuthorized(r)) {
+    log.Printf("Rejected alert %s for host %s from %s\n", action, h, r.RemoteAddr)
+    w.Header().Set("WWW-Authenticate", "Bearer")
+    http.Error(w, "Admin token required", http.StatusUnauthorized)
+    return
+  }
+
+  var req struct {
+    Check string
+    Mount string
+    Comment string
+    For string
+  }
+
+  if (r.Method == "POST") {
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+    if (err == nil) {
+      err = strictUnmarshal(body, &req)
+    }
+    if (err != nil) {
+      http.Error(w, "Bad request: " + err.Error(), http.StatusBadRequest)
+      return
+    }
+  }
+
+  switch {
+    case (action == "ack") && (r.Method == "POST"):
+      a, err := ackAlert(h, req.Check, req.Mount, r.RemoteAddr, req.Comment)
+      if (err != nil) {
+        http.Error(w, "Can't acknowledge " + req.Check + " on " + h + ": " + err.Error(), http.StatusConflict)
+        return
+      }
+      log.Printf("Alert %s on %s acknowledged from %s\n", req.Check, h, r.RemoteAddr)
+      writeAlertJSON(w, a)
+    case (action == "silence") && (r.Method == "POST"):
+      d, err := time.ParseDuration(req.For)
+      if ((err != nil) || (d <= 0)) {
+        http.Error(w, "Bad request: For must be a duration such as 2h", http.StatusBadRequest)
+        return
+      }
+      s := addSilence(Silence{Hostname: h, Check: req.Check, Mount: req.Mount, Until: time.Now().Add(d).Unix(),
+        Comment: req.Comment, By: r.RemoteAddr})
+      log.Printf("Alerts on %s silenced for %v from %s\n", h, d, r.RemoteAddr)
+      writeAlertJSON(w, s)
+    case (action == "silence") && (r.Method == "DELETE"):
+      n := removeSilences(h, r.URL.Query().Get("check"))
+      log.Printf("Lifted %d silences on %s from %s\n", n, h, r.RemoteAddr)
+      w.WriteHeader(http.StatusNoContent)
+    case action == "ack":
+      w.Header().Set("Allow", "POST")
+      http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    default:
+      w.Header().Set("Allow", "GET, POST, DELETE")
+      http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+  }
+}
+
+func writeAlertJSON(w http.ResponseWriter, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+
+  err := json.NewEncoder(w).Encode(v)
+  if (err != nil) {
+    log.Printf("Failed writing alerts: %v\n", err)
+  }
+}
+
+//
+// Alert severity for each check state. A script that couldn't tell is raised
+//  as a warning, so that it's routed and shown like any other
+//
+
+var checkSeverities = []string{"info", "warning", "critical", "warning"}
+
+//
+// Alerts for the check scripts that are failing in a host's latest report
+//
+
+func checkAlerts(m Message) []Alert {
+  var active []Alert
+
+  for _, k := range m.Checks {
+    if (k.Status != checkOK) {
+      active = append(active, Alert{Hostname: m.Hostname, Check: "check:" + k.Name, Severity: checkSeverities[k.Status],
+        State: alertFiring, Message: "Check " + k.Name + " is " + checkStatusNames[k.Status] + ": " + k.Output})
+    }
+  }
+
+  return active
+}
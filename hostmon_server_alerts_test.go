@@ -0,0 +1,80 @@
+//
+// Host monitor data collection server, alert state tests
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestUpdateAlerts(t *testing.T) {
+  oldStore, oldNotifiers, oldAlerts, oldRepeat := store, g_notifiers, alerts, g_alertRepeat
+  defer func() { store, g_notifiers, alerts, g_alertRepeat = oldStore, oldNotifiers, oldAlerts, oldRepeat }()
+
+  rn := &recordingNotifier{}
+
+  store = newMemStore()
+  g_notifiers = []*namedNotifier{{name: "oncall", kind: "webhook", n: rn, backend: rn}}
+  g_alertRepeat = 0
+
+  alertsMu.Lock()
+  alerts = make(map[string]*Alert)
+  alertsMu.Unlock()
+
+  load := func(state string, severity string) []Alert {
+    return []Alert{{Hostname: "db1", Check: "highload", State: state, Severity: severity, Message: "load1 is high"}}
+  }
+
+  steps := []struct {
+    name string
+    observed []Alert
+    ack bool
+    kinds string
+    state string
+    severity string
+  }{
+    {"pending", load(alertPending, "warning"), false, "", alertPending, "warning"},
+    {"firing", load(alertFiring, "warning"), false, "firing", alertFiring, "warning"},
+    {"still firing", load(alertFiring, "warning"), false, "", alertFiring, "warning"},
+    {"raised", load(alertFiring, "critical"), false, "escalated", alertFiring, "critical"},
+    {"lowered", load(alertFiring, "warning"), false, "", alertFiring, "warning"},
+    {"acknowledged", nil, true, "", alertAcknowledged, "warning"},
+    {"acknowledged, firing", load(alertFiring, "warning"), false, "", alertAcknowledged, "warning"},
+    {"acknowledged, lowered", load(alertFiring, "info"), false, "", alertAcknowledged, "info"},
+    {"acknowledged, raised", load(alertFiring, "critical"), false, "escalated", alertAcknowledged, "critical"},
+    {"acknowledged, lowered again", load(alertFiring, "warning"), false, "", alertAcknowledged, "warning"},
+    {"cleared", []Alert{}, false, "recovered", alertResolved, "warning"},
+  }
+
+  for _, st := range steps {
+    before := len(rn.sent())
+
+    if (st.ack) {
+      _, err := ackAlert("db1", "highload", "", "oncall", "looking")
+      if (err != nil) {
+        t.Fatalf("%s: %v", st.name, err)
+      }
+    } else {
+      updateAlerts("db1", st.observed, nil)
+    }
+
+    var kinds []string
+    for _, n := range rn.sent()[before:] {
+      kinds = append(kinds, n.Kind)
+    }
+    if (strings.Join(kinds, ",") != st.kinds) {
+      t.Errorf("%s: notified %v, want %q", st.name, kinds, st.kinds)
+    }
+
+    as := listAlerts("db1", true)
+    if (len(as) != 1) {
+      t.Fatalf("%s: %d alerts, want 1", st.name, len(as))
+    }
+    if ((as[0].State != st.state) || (as[0].Severity != st.severity)) {
+      t.Errorf("%s: alert %s %s, want %s %s", st.name, as[0].State, as[0].Severity, st.state, st.severity)
+    }
+  }
+}
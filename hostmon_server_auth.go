@@ -0,0 +1,316 @@
+//
+// Host monitor data collection server, agent authentication
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "crypto/tls"
+  "crypto/x509"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+//
+// Each host is issued a shared secret token by the server. The agent signs
+//  every report with it: the Hostmon-Signature header carries the hex
+//  HMAC-SHA256, keyed with the token, of
+//
+//    method "\n" path "\n" timestamp "\n" body
+//
+//  where timestamp is the unix time the report was sent, also given in the
+//  Hostmon-Timestamp header. The token for the host named in the path is the
+//  one checked, so a valid signature both proves who sent the report and
+//  that it is for that host. A signed report is refused if it was sent more
+//  than signatureMaxSkew from the server's clock, or if its own Timestamp
+//  isn't after that of the host's last report, so that one captured on the
+//  way can't be sent again.
+//
+// Agents with a client certificate signed by tlsClientCA are identified by
+//  it instead: the certificate's CN, less any domain, is the only host they
+//  may report for.
+//
+
+const signatureHeader = "Hostmon-Signature"
+const signatureTimeHeader = "Hostmon-Timestamp"
+
+const signatureMaxSkew = 5*time.Minute
+
+// Returned by HostToken when no token has been issued for a host
+var errNoToken = errors.New("no token issued for host")
+
+//
+// Make sure a report for host h came from h. A verified client certificate
+//  settles it. Otherwise the report must be signed with h's token if h has
+//  been issued one; other hosts may send unsigned reports unless
+//  requireAuth is set.
+//
+
+func authenticateReport(r *http.Request, h string, body []byte) error {
+  if ((r.TLS != nil) && (len(r.TLS.VerifiedChains) > 0)) {
+    cn := certHostname(r.TLS.PeerCertificates[0])
+    if (cn != h) {
+      return errors.New("client certificate is for host " + cn + ", not " + h)
+    }
+    return nil
+  }
+
+  if (g_tlsRequireClientCert) {
+    return errors.New("client certificate required")
+  }
+
+  token, err := store.HostToken(h)
+
+  switch {
+    case err == errNoToken:
+      if (!g_requireAuth) {
+        return nil
+      }
+      return errors.New("no token issued for host " + h)
+    case err != nil:
+      return err
+  }
+
+  sig := r.Header.Get(signatureHeader)
+  if (sig == "") {
+    return errors.New("report is not signed")
+  }
+
+  got, err := hex.DecodeString(sig)
+  if (err != nil) {
+    return errors.New("malformed signature")
+  }
+
+  ts := r.Header.Get(signatureTimeHeader)
+  sent, err := strconv.ParseInt(ts, 10, 64)
+  if (err != nil) {
+    return errors.New("signed report has no " + signatureTimeHeader)
+  }
+
+  if (!hmac.Equal(got, reportSignature(token, r.Method, r.URL.Path, ts, body))) {
+    return errors.New("bad signature for host " + h)
+  }
+
+  skew := time.Since(time.Unix(sent, 0))
+  if ((skew > signatureMaxSkew) || (skew < -signatureMaxSkew)) {
+    return fmt.Errorf("report was signed %v from the server's time, more than %v", skew.Round(time.Second), signatureMaxSkew)
+  }
+
+  return nil
+}
+
+//
+// The Timestamp of the last signed report accepted from each host, once it
+//  has been looked up or one has come in since the server started
+//
+
+var reportOrderMu sync.Mutex
+var lastSignedReport = make(map[string]int64)
+
+// Returned by claimReportTimestamp for a report that isn't new
+var errReportReplayed = errors.New("report is not newer than the host's last report")
+
+//
+// Make sure a signed report is newer than the last one from its host, and
+//  take its Timestamp as the last. Returns the previous last, to put back
+//  with releaseReportTimestamp should the report not be stored after all.
+//  Unsigned reports are let through as they are.
+//
+
+func claimReportTimestamp(r *http.Request, m Message) (int64, error) {
+  if (r.Header.Get(signatureHeader) == "") {
+    return 0, nil
+  }
+
+  reportOrderMu.Lock()
+  defer reportOrderMu.Unlock()
+
+  last, ok := lastSignedReport[m.Hostname]
+  if (!ok) {
+    prev, err := store.LatestReport(m.Hostname)
+    switch {
+      case err == nil:
+        last = prev.Timestamp
+      case err != errNoReports:
+        return 0, err
+    }
+  }
+
+  if (m.Timestamp <= last) {
+    return 0, errReportReplayed
+  }
+
+  lastSignedReport[m.Hostname] = m.Timestamp
+
+  return last, nil
+}
+
+func releaseReportTimestamp(r *http.Request, m Message, prev int64) {
+  if (r.Header.Get(signatureHeader) == "") {
+    return
+  }
+
+  reportOrderMu.Lock()
+  defer reportOrderMu.Unlock()
+
+  if (lastSignedReport[m.Hostname] == m.Timestamp) {
+    lastSignedReport[m.Hostname] = prev
+  }
+}
+
+//
+// The host a client certificate was issued to, with the domain stripped the
+//  same way the agent strips its own host name
+//
+
+func certHostname(cert *x509.Certificate) string {
+  cn := cert.Subject.CommonName
+
+  if (strings.Index(cn, ".") != -1) {
+    cn = cn[0:strings.Index(cn, ".")]
+  }
+
+  return cn
+}
+
+//
+// TLS settings for the listener. With a client CA, agents may present a
+//  certificate signed by it; browsers and other clients without one are
+//  still let in to read.
+//
+
+func serverTLSConfig() (*tls.Config, error) {
+  tc := &tls.Config{MinVersion: tls.VersionTLS12}
+
+  if (g_tlsClientCA != "") {
+    pem, err := os.ReadFile(g_tlsClientCA)
+    if (err != nil) {
+      return nil, err
+    }
+
+    tc.ClientCAs = x509.NewCertPool()
+    if (!tc.ClientCAs.AppendCertsFromPEM(pem)) {
+      return nil, errors.New("no certificates found in " + g_tlsClientCA)
+    }
+
+    tc.ClientAuth = tls.VerifyClientCertIfGiven
+  }
+
+  return tc, nil
+}
+
+func reportSignature(token string, method string, path string, timestamp string, body []byte) []byte {
+  mac := hmac.New(sha256.New, []byte(token))
+  mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n"))
+  mac.Write(body)
+
+  return mac.Sum(nil)
+}
+
+//
+// Log and refuse a report that failed authentication
+//
+
+func rejectUnauthenticated(w http.ResponseWriter, r *http.Request, h string, err error) {
+  log.Printf("Rejected unauthenticated report for host %s from %s: %v\n", h, r.RemoteAddr, err)
+  http.Error(w, "Authentication failed: " + err.Error(), http.StatusUnauthorized)
+}
+
+//
+// Handle a connection to /token/, authenticated with the admin token
+//
+//  /token/name    POST -> issue (or reissue) a token for a host
+//  /token/name    DELETE -> revoke a host's token
+//
+
+func task_handle_token(w http.ResponseWriter, r *http.Request) {
+  h := r.URL.Path[len("/token/"):]
+
+  if (!adminAuthorized(r)) {
+    log.Printf("Rejected token request for host %s from %s\n", h, r.RemoteAddr)
+    w.Header().Set("WWW-Authenticate", "Bearer")
+    http.Error(w, "Admin token required", http.StatusUnauthorized)
+    return
+  }
+
+  if (!validHostname(h)) {
+    http.Error(w, "Invalid host name " + h, http.StatusBadRequest)
+    return
+  }
+
+  switch r.Method {
+    case "POST":
+      token, err := newToken()
+      if (err == nil) {
+        err = store.SetHostToken(h, token)
+      }
+      if (err != nil) {
+        log.Printf("Failed issuing token for host %s: %v\n", h, err)
+        http.Error(w, "Failed issuing token for host " + h, http.StatusInternalServerError)
+        return
+      }
+
+      log.Printf("Issued token for host %s to %s\n", h, r.RemoteAddr)
+
+      w.Header().Set("Content-Type", "application/json")
+      json.NewEncoder(w).Encode(struct{ Hostname, Token string }{h, token})
+    case "DELETE":
+      err := store.SetHostToken(h, "")
+      if (err != nil) {
+        log.Printf("Failed revoking token for host %s: %v\n", h, err)
+        http.Error(w, "Failed revoking token for host " + h, http.StatusInternalServerError)
+        return
+      }
+
+      log.Printf("Revoked token for host %s from %s\n", h, r.RemoteAddr)
+
+      w.WriteHeader(http.StatusNoContent)
+    default:
+      w.Header().Set("Allow", "POST, DELETE")
+      http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+  }
+}
+
+//
+// Admin requests carry "Authorization: Bearer <adminToken>". With no admin
+//  token configured nobody is an admin.
+//
+
+func adminAuthorized(r *http.Request) bool {
+  if (g_adminToken == "") {
+    return false
+  }
+
+  t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+  return ok && (subtle.ConstantTimeCompare([]byte(t), []byte(g_adminToken)) == 1)
+}
+
+//
+// 32 random bytes, hex encoded
+//
+
+func newToken() (string, error) {
+  b := make([]byte, 32)
+
+  _, err := rand.Read(b)
+  if (err != nil) {
+    return "", err
+  }
+
+  return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,148 @@
+//
+// Host monitor data collection server, agent authentication tests
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "encoding/hex"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+)
+
+const testToken = "0123456789abcdef"
+
+func signedRequest(path string, body string, token string, sent time.Time) *http.Request {
+  r := httptest.NewRequest("POST", path, strings.NewReader(body))
+
+  if (token != "") {
+    ts := strconv.FormatInt(sent.Unix(), 10)
+    r.Header.Set(signatureTimeHeader, ts)
+    r.Header.Set(signatureHeader, hex.EncodeToString(reportSignature(token, "POST", path, ts, []byte(body))))
+  }
+
+  return r
+}
+
+func TestAuthenticateReport(t *testing.T) {
+  oldStore, oldRequire := store, g_requireAuth
+  defer func() { store, g_requireAuth = oldStore, oldRequire }()
+
+  store = newMemStore()
+  store.SetHostToken("db1", testToken)
+
+  now := time.Now()
+  body := `{"SchemaVersion": 1}`
+
+  tests := []struct {
+    name string
+    host string
+    r func() *http.Request
+    requireAuth bool
+    ok bool
+  }{
+    {"signed", "db1", func() *http.Request { return signedRequest("/report/db1", body, testToken, now) }, false, true},
+    {"unsigned with a token", "db1", func() *http.Request { return signedRequest("/report/db1", body, "", now) }, false, false},
+    {"wrong token", "db1", func() *http.Request { return signedRequest("/report/db1", body, "fedcba9876543210", now) }, false, false},
+    {"body changed", "db1", func() *http.Request {
+      r := signedRequest("/report/db1", body, testToken, now)
+      r.Body = http.NoBody
+      return r
+    }, false, false},
+    {"signed for another path", "db1", func() *http.Request {
+      r := signedRequest("/report/db2", body, testToken, now)
+      r.URL.Path = "/report/db1"
+      return r
+    }, false, false},
+    {"timestamp changed", "db1", func() *http.Request {
+      r := signedRequest("/report/db1", body, testToken, now)
+      r.Header.Set(signatureTimeHeader, strconv.FormatInt(now.Unix() + 1, 10))
+      return r
+    }, false, false},
+    {"no timestamp", "db1", func() *http.Request {
+      r := signedRequest("/report/db1", body, testToken, now)
+      r.Header.Del(signatureTimeHeader)
+      return r
+    }, false, false},
+    {"malformed signature", "db1", func() *http.Request {
+      r := signedRequest("/report/db1", body, testToken, now)
+      r.Header.Set(signatureHeader, "not hex")
+      return r
+    }, false, false},
+    {"signed too long ago", "db1", func() *http.Request { return signedRequest("/report/db1", body, testToken, now.Add(-10*time.Minute)) }, false, false},
+    {"signed in the future", "db1", func() *http.Request { return signedRequest("/report/db1", body, testToken, now.Add(10*time.Minute)) }, false, false},
+    {"within skew", "db1", func() *http.Request { return signedRequest("/report/db1", body, testToken, now.Add(-4*time.Minute)) }, false, true},
+    {"host without a token", "db2", func() *http.Request { return signedRequest("/report/db2", body, "", now) }, false, true},
+    {"host without a token, required", "db2", func() *http.Request { return signedRequest("/report/db2", body, "", now) }, true, false},
+  }
+
+  for _, tt := range tests {
+    g_requireAuth = tt.requireAuth
+
+    r := tt.r()
+    b, _ := io.ReadAll(r.Body)
+
+    err := authenticateReport(r, tt.host, b)
+    if ((err == nil) != tt.ok) {
+      t.Errorf("%s: got error %v, want ok %v", tt.name, err, tt.ok)
+    }
+  }
+}
+
+func TestClaimReportTimestamp(t *testing.T) {
+  oldStore := store
+  defer func() { store = oldStore }()
+
+  store = newMemStore()
+  store.StoreReport(Message{Hostname: "db1", Timestamp: 1000})
+
+  reportOrderMu.Lock()
+  lastSignedReport = make(map[string]int64)
+  reportOrderMu.Unlock()
+
+  signed := signedRequest("/report/db1", "", testToken, time.Now())
+  unsigned := signedRequest("/report/db1", "", "", time.Now())
+
+  tests := []struct {
+    name string
+    r *http.Request
+    host string
+    ts int64
+    err error
+  }{
+    {"older than stored", signed, "db1", 999, errReportReplayed},
+    {"same as stored", signed, "db1", 1000, errReportReplayed},
+    {"newer", signed, "db1", 1060, nil},
+    {"replayed", signed, "db1", 1060, errReportReplayed},
+    {"unsigned is not checked", unsigned, "db1", 5, nil},
+    {"first from a host", signed, "db2", 10, nil},
+  }
+
+  for _, tt := range tests {
+    _, err := claimReportTimestamp(tt.r, Message{Hostname: tt.host, Timestamp: tt.ts})
+    if (err != tt.err) {
+      t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+    }
+  }
+
+  // A report that couldn't be stored may be sent again
+  m := Message{Hostname: "db1", Timestamp: 1120}
+
+  prev, err := claimReportTimestamp(signed, m)
+  if (err != nil) {
+    t.Fatal(err)
+  }
+
+  releaseReportTimestamp(signed, m, prev)
+
+  _, err = claimReportTimestamp(signed, m)
+  if (err != nil) {
+    t.Errorf("report released after a failed store was refused: %v", err)
+  }
+}
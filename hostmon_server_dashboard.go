@@ -0,0 +1,496 @@
+//
+// Host monitor data collection server, web dashboard
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "fmt"
+  "html/template"
+  "log"
+  "math"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+//
+// Ranges offered for the charts on a host's page, and how many buckets each
+//  chart line is downsampled to
+//
+
+var dashboardRanges = []string{"1h", "6h", "24h", "7d", "30d"}
+
+const dashboardChartBuckets = 200
+
+// Chart size in SVG user units
+const chartWidth = 600
+const chartHeight = 150
+
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"}
+
+//
+// One row of the overview
+//
+
+type dashHost struct {
+  Report Message
+  Age time.Duration
+  Stale bool
+  Alerts int
+  Maintenance bool
+}
+
+type dashOverview struct {
+  Now time.Time
+  Hosts []dashHost
+  Alerts []Alert
+  Maintenance []Maintenance
+  TotalCores int64
+  TotalMem int64
+}
+
+type dashHostPage struct {
+  Now time.Time
+  Host dashHost
+  Alerts []Alert
+  Maintenance []Maintenance
+  Range string
+  Ranges []string
+  Charts []svgChart
+}
+
+//
+// A line chart drawn as inline SVG. Points are already scaled to the chart.
+//
+
+type svgChart struct {
+  Title string
+  YMax string
+  From time.Time
+  To time.Time
+  Lines []svgLine
+}
+
+type svgLine struct {
+  Name string
+  Color string
+  Points string
+}
+
+//
+// Handle a connection to /dashboard/
+//
+//  /dashboard/        GET -> every host's latest report and the active alerts
+//  /dashboard/name    GET -> one host, with history charts
+//
+
+func task_handle_dashboard(w http.ResponseWriter, r *http.Request) {
+  h := r.URL.Path[len("/dashboard/"):]
+
+  if (r.Method != "GET") {
+    w.Header().Set("Allow", "GET")
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  if (h == "") {
+    dashboardOverview(w, r)
+    return
+  }
+
+  if (!validHostname(h)) {
+    http.Error(w, "Invalid host name " + h, http.StatusBadRequest)
+    return
+  }
+
+  dashboardHost(w, r, h)
+}
+
+func dashboardOverview(w http.ResponseWriter, r *http.Request) {
+  now := time.Now()
+  page := dashOverview{Now: now, Alerts: activeAlerts(""), Maintenance: listMaintenance("", now)}
+
+  hosts, err := store.ListHosts()
+  if (err != nil) {
+    log.Printf("Failed listing hosts for dashboard: %v\n", err)
+    http.Error(w, "Fatal attempting to list hosts", http.StatusInternalServerError)
+    return
+  }
+
+  alertCount := make(map[string]int)
+  for _, a := range page.Alerts {
+    alertCount[a.Hostname]++
+  }
+
+  for _, hh := range hosts {
+    m, err := store.LatestReport(hh)
+    if (err == errNoReports) {
+      continue
+    }
+    if (err != nil) {
+      log.Printf("Failed reading latest report for host %s: %v\n", hh, err)
+      http.Error(w, "Fatal attempting to read report for host " + hh, http.StatusInternalServerError)
+      return
+    }
+
+    page.Hosts = append(page.Hosts, newDashHost(m, now, alertCount[hh]))
+    page.TotalCores += m.NumCPUs
+    page.TotalMem += m.Memtotal
+  }
+
+  renderDashboard(w, "overview", page)
+}
+
+func dashboardHost(w http.ResponseWriter, r *http.Request, h string) {
+  now := time.Now()
+
+  m, err := store.LatestReport(h)
+  switch {
+    case err == errNoReports:
+      http.Error(w, "No such host " + h, http.StatusNotFound)
+      return
+    case err != nil:
+      log.Printf("Failed reading latest report for host %s: %v\n", h, err)
+      http.Error(w, "Fatal attempting to read report for host " + h, http.StatusInternalServerError)
+      return
+  }
+
+  page := dashHostPage{Now: now, Alerts: activeAlerts(h), Maintenance: listMaintenance(h, now), Range: "24h", Ranges: dashboardRanges}
+  page.Host = newDashHost(m, now, len(page.Alerts))
+
+  if rg := r.URL.Query().Get("range"); rg != "" {
+    page.Range = rg
+  }
+
+  span, ok := parseDashboardRange(page.Range)
+  if (!ok) {
+    http.Error(w, "Bad range " + page.Range, http.StatusBadRequest)
+    return
+  }
+
+  to := now.Unix()
+  from := to - int64(span/time.Second)
+
+  ms, err := store.ReportsBetween(h, from, to)
+  if (err != nil) {
+    log.Printf("Failed reading history for host %s: %v\n", h, err)
+    http.Error(w, "Fatal attempting to read history for host " + h, http.StatusInternalServerError)
+    return
+  }
+
+  page.Charts = historyCharts(ms, from, to)
+
+  renderDashboard(w, "host", page)
+}
+
+func newDashHost(m Message, now time.Time, alerts int) dashHost {
+  age := now.Sub(time.Unix(m.Timestamp, 0))
+
+  return dashHost{Report: m, Age: age, Stale: isStale(m, now), Alerts: alerts, Maintenance: maintenanceFor(m.Hostname, now) != nil}
+}
+
+//
+// Chart ranges are Go durations, plus days as "7d"
+//
+
+func parseDashboardRange(s string) (time.Duration, bool) {
+  if d, ok := strings.CutSuffix(s, "d"); ok {
+    n, err := strconv.Atoi(d)
+    if ((err != nil) || (n < 1) || (n > 366)) {
+      return 0, false
+    }
+    return time.Duration(n)*24*time.Hour, true
+  }
+
+  d, err := time.ParseDuration(s)
+  if ((err != nil) || (d < time.Minute)) {
+    return 0, false
+  }
+
+  return d, true
+}
+
+//
+// Load, memory, swap and disk charts for a run of reports, each line averaged into
+//  buckets so a long range doesn't make for an enormous page
+//
+
+func historyCharts(ms []Message, from int64, to int64) []svgChart {
+  step := (to - from)/dashboardChartBuckets
+  if (step < 1) {
+    step = 1
+  }
+
+  aggs := map[string]bool{"avg": true}
+
+  chart := func(title string, fixedMax float64, q historyQuery) svgChart {
+    var series []historySeries
+
+    ymax := fixedMax
+
+    for _, sr := range historySeriesFor(ms, q) {
+      sr.Points = downsample(sr.Points, from, step, aggs)
+      for _, p := range sr.Points {
+        ymax = math.Max(ymax, *p.Avg)
+      }
+      series = append(series, sr)
+    }
+
+    c := svgChart{Title: title, YMax: strconv.FormatFloat(ymax, 'g', 4, 64), From: time.Unix(from, 0), To: time.Unix(to, 0)}
+
+    for i, sr := range series {
+      var pts []string
+
+      for _, p := range sr.Points {
+        x := float64(p.T - from)/float64(to - from)*chartWidth
+        y := chartHeight - (*p.Avg/ymax)*chartHeight
+        pts = append(pts, fmt.Sprintf("%.1f,%.1f", x, y))
+      }
+
+      c.Lines = append(c.Lines, svgLine{Name: sr.Metric, Color: chartColors[i % len(chartColors)], Points: strings.Join(pts, " ")})
+    }
+
+    return c
+  }
+
+  return []svgChart{
+    chart("Load", 1, historyQuery{metrics: map[string]bool{"load1": true, "load5": true, "load15": true}}),
+    chart("Memory used (%)", 100, historyQuery{metrics: map[string]bool{"memory": true}}),
+    chart("Swap used (%)", 100, historyQuery{metrics: map[string]bool{"swap": true}}),
+    chart("Disk used (%)", 100, historyQuery{metrics: map[string]bool{}, allDisks: true}),
+  }
+}
+
+func renderDashboard(w http.ResponseWriter, name string, data interface{}) {
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+  err := dashboardTemplates.ExecuteTemplate(w, name, data)
+  if (err != nil) {
+    log.Printf("Failed rendering dashboard page %s: %v\n", name, err)
+  }
+}
+
+//
+// Helpers for the templates
+//
+
+var dashboardFuncs = template.FuncMap{
+  // Uptime in seconds as days, hours and minutes
+  "uptime": func(s string) string {
+    f, err := strconv.ParseFloat(s, 64)
+    if (err != nil) {
+      return s
+    }
+    d := time.Duration(f)*time.Second
+    return fmt.Sprintf("%dd %dh %dm", int(d.Hours())/24, int(d.Hours()) % 24, int(d.Minutes()) % 60)
+  },
+  "age": func(d time.Duration) string {
+    return d.Round(time.Second).String()
+  },
+  "unix": func(t int64) string {
+    return time.Unix(t, 0).Format("2006-01-02 15:04:05")
+  },
+  "when": func(t time.Time) string {
+    return t.Format("Mon Jan 2 15:04:05 MST 2006")
+  },
+  // A figure some reports don't have, once it's known they do
+  "deref": func(v *float64) float64 {
+    return *v
+  },
+  // Load is bad once it is over the core count and worth a look over half of it
+  "loadClass": func(load float64, cpus int64) string {
+    switch {
+      case load > float64(cpus):
+        return "bad"
+      case load > float64(cpus)/2.0:
+        return "warn"
+    }
+    return ""
+  },
+  "swapClass": func(pct float64) string {
+    switch {
+      case pct > 66.0:
+        return "bad"
+      case pct > 10.0:
+        return "warn"
+    }
+    return ""
+  },
+  "diskClass": func(pct float64) string {
+    switch {
+      case pct >= 95.0:
+        return "bad"
+      case pct >= 90.0:
+        return "warn"
+    }
+    return ""
+  },
+  "checkName": func(status int) string {
+    return checkStatusNames[status]
+  },
+  "chartWidth": func() int { return chartWidth },
+  "chartHeight": func() int { return chartHeight },
+  "gib": func(b int64) string {
+    return fmt.Sprintf("%.1f", float64(b)/(1024*1024*1024))
+  },
+  "join": strings.Join,
+}
+
+var dashboardTemplates = template.Must(template.New("dashboard").Funcs(dashboardFuncs).Parse(dashboardHTML))
+
+const dashboardHTML = `
+{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>{{.}}</title>
+<style>
+body { font-family: Arial, Helvetica, sans-serif; margin: 1em 5%; }
+h1 { font-size: 1.5em; }
+h2 { font-size: 1.2em; margin-top: 1.5em; }
+table { border-collapse: collapse; width: 100%; }
+th { text-align: left; border-bottom: 2px solid #999; padding: 3px 6px; }
+td { font-family: Courier, monospace; padding: 3px 6px; border-bottom: 1px solid #ddd; }
+tr.stale td { color: #999; font-style: italic; }
+td.bad, span.bad { background: #ffb3b3; }
+tr.maint td { background: #d9e8ff; }
+td.warn, span.warn { background: #ffffb3; }
+td.critical { background: #ffb3b3; }
+td.warning, td.unknown { background: #ffffb3; }
+p.summary { font-size: small; font-weight: bold; }
+svg { border: 1px solid #ccc; background: #fafafa; }
+.legend span { margin-right: 1em; font-size: small; }
+</style>
+</head>
+<body>
+{{end}}
+
+{{define "alerts"}}
+{{if .}}
+<table>
+<tr><th>Host</th><th>Severity</th><th>Check</th><th>State</th><th>Since</th><th>Message</th></tr>
+{{range .}}
+<tr><td><a href="/dashboard/{{.Hostname}}">{{.Hostname}}</a></td><td class="{{.Severity}}">{{.Severity}}</td><td>{{.Check}}{{if .Mount}} {{.Mount}}{{end}}</td>
+<td>{{.State}}{{if .AckedBy}} by {{.AckedBy}}{{end}}{{if .SilencedUntil}}, silenced until {{unix .SilencedUntil}}{{end}}{{if .Maintenance}}, in maintenance{{end}}</td><td>{{unix .Since}}</td><td>{{.Message}}{{if .AckComment}} ({{.AckComment}}){{end}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No active alerts.</p>
+{{end}}
+{{end}}
+
+{{define "maintenance"}}
+{{if .}}
+<h2>Maintenance</h2>
+<table>
+<tr><th>Hosts</th><th>When</th><th>Schedule</th><th>Comment</th></tr>
+{{range .}}
+<tr{{if .Active}} class="maint"{{end}}><td>{{join .Hosts ", "}}</td>
+<td>{{if .Active}}now, until {{unix .NextEnd}}{{else if .NextStart}}{{unix .NextStart}} to {{unix .NextEnd}}{{end}}</td>
+<td>{{if .Cron}}{{.Cron}} for {{.Duration}}{{else}}once{{end}}</td><td>{{.Comment}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+
+{{define "overview"}}{{template "head" "Host Mon"}}
+<h1>Host Mon: {{when .Now}}</h1>
+
+<h2>Active alerts</h2>
+{{template "alerts" .Alerts}}
+{{template "maintenance" .Maintenance}}
+
+<h2>Hosts</h2>
+<table>
+<tr><th>Host name</th><th>Last report</th><th>Kernel</th><th>Release</th><th>Uptime</th><th>Cores</th><th>Physmem (kB)</th>
+<th>Load 1</th><th>Load 5</th><th>Load 15</th><th>Swap used (%)</th><th>Disk report (%util)</th><th>Alerts</th></tr>
+{{range .Hosts}}{{$cpus := .Report.NumCPUs}}
+<tr{{if .Stale}} class="stale"{{end}}>
+<td><a href="/dashboard/{{.Report.Hostname}}">{{.Report.Hostname}}</a></td>
+<td>{{age .Age}} ago{{if .Stale}} (stale){{end}}{{if .Maintenance}} (maintenance){{end}}</td>
+<td>{{.Report.KernelVer}}</td>
+<td>{{.Report.Release}}</td>
+<td>{{uptime .Report.Uptime}}</td>
+<td>{{.Report.NumCPUs}}</td>
+<td>{{.Report.Memtotal}}</td>
+<td class="{{loadClass .Report.LoadOne $cpus}}">{{.Report.LoadOne}}</td>
+<td class="{{loadClass .Report.LoadFive $cpus}}">{{.Report.LoadFive}}</td>
+<td class="{{loadClass .Report.LoadFifteen $cpus}}">{{.Report.LoadFifteen}}</td>
+<td class="{{swapClass .Report.SwapUsed}}">{{printf "%.1f" .Report.SwapUsed}}</td>
+<td>{{range .Report.Disks}}<span class="{{diskClass .UsedPct}}">{{.MountPoint}}:{{printf "%.0f" .UsedPct}}</span> {{end}}</td>
+<td>{{if .Alerts}}<span class="bad">{{.Alerts}}</span>{{end}}</td>
+</tr>
+{{end}}
+</table>
+
+<p class="summary">{{len .Hosts}} total hosts, {{.TotalCores}} total cores, {{.TotalMem}} kB total physical memory</p>
+</body>
+</html>
+{{end}}
+
+{{define "host"}}{{template "head" .Host.Report.Hostname}}{{$r := .Host.Report}}
+<p><a href="/dashboard/">All hosts</a></p>
+<h1>{{$r.Hostname}}</h1>
+
+<table>
+<tr><th>Last report</th><td>{{unix $r.Timestamp}}, {{age .Host.Age}} ago{{if .Host.Stale}} <span class="bad">(stale)</span>{{end}}</td></tr>
+<tr><th>Kernel</th><td>{{$r.KernelVer}}</td></tr>
+<tr><th>Release</th><td>{{$r.Release}}</td></tr>
+<tr><th>Uptime</th><td>{{uptime $r.Uptime}}</td></tr>
+<tr><th>Cores</th><td>{{$r.NumCPUs}}</td></tr>
+<tr><th>Physmem (kB)</th><td>{{$r.Memtotal}}</td></tr>
+<tr><th>Load</th><td><span class="{{loadClass $r.LoadOne $r.NumCPUs}}">{{$r.LoadOne}}</span> {{$r.LoadFive}} {{$r.LoadFifteen}}</td></tr>
+<tr><th>Memory used (%)</th><td>{{with $r.MemUsed}}{{printf "%.1f" (deref .)}}{{else}}-{{end}}</td></tr>
+<tr><th>Swap used (%)</th><td class="{{swapClass $r.SwapUsed}}">{{printf "%.1f" $r.SwapUsed}}</td></tr>
+</table>
+
+<h2>Active alerts</h2>
+{{template "alerts" .Alerts}}
+{{template "maintenance" .Maintenance}}
+
+<h2>History</h2>
+<p>{{$cur := .Range}}{{range .Ranges}}{{if eq . $cur}}<b>{{.}}</b>{{else}}<a href="?range={{.}}">{{.}}</a>{{end}} {{end}}</p>
+{{range .Charts}}
+<h3>{{.Title}}</h3>
+<svg width="{{chartWidth}}" height="{{chartHeight}}" viewBox="0 0 {{chartWidth}} {{chartHeight}}" preserveAspectRatio="none">
+{{range .Lines}}<polyline fill="none" stroke="{{.Color}}" stroke-width="1.5" points="{{.Points}}"/>
+{{end}}</svg>
+<div class="legend">0 to {{.YMax}}, {{when .From}} to {{when .To}}<br>{{range .Lines}}<span style="color: {{.Color}}">&#9632; {{.Name}}</span>{{else}}<span>no data</span>{{end}}</div>
+{{end}}
+
+<h2>Disks</h2>
+<table>
+<tr><th>Mount point</th><th>Device</th><th>Type</th><th>Size (GiB)</th><th>Used (GiB)</th><th>Available (GiB)</th><th>Used (%)</th><th>Inodes used (%)</th></tr>
+{{range $r.Disks}}
+<tr><td>{{.MountPoint}}</td><td>{{.Device}}</td><td>{{.FSType}}</td><td>{{gib .TotalBytes}}</td><td>{{gib .UsedBytes}}</td><td>{{gib .AvailBytes}}</td>
+<td class="{{diskClass .UsedPct}}">{{printf "%.0f" .UsedPct}}</td><td>{{printf "%.0f" .InodesUsedPct}}</td></tr>
+{{end}}
+</table>
+
+{{if $r.Checks}}
+<h2>Checks</h2>
+<table>
+<tr><th>Check</th><th>Status</th><th>Output</th></tr>
+{{range $r.Checks}}{{$s := checkName .Status}}
+<tr><td>{{.Name}}</td><td class="{{if eq .Status 2}}bad{{else if ne .Status 0}}warn{{end}}">{{$s}}</td><td>{{.Output}}</td></tr>
+{{end}}
+</table>
+{{end}}
+
+{{if $r.CollectorErrors}}
+<h2>Collector errors</h2>
+<table>
+<tr><th>Collector</th><th>Error</th></tr>
+{{range $n, $e := $r.CollectorErrors}}
+<tr><td>{{$n}}</td><td>{{$e}}</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+{{end}}
+`
@@ -0,0 +1,213 @@
+//
+// Host monitor data collection server, notification digests
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "fmt"
+  "log"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+//
+// A notifier declared with digest=interval holds on to its notifications
+//  and sends whatever has built up as one digest once the interval has
+//  passed since the first, or sooner if digestmax= (default 50) of them are
+//  waiting. A digest of one is sent as it is. Notifications are batched
+//  separately for each set of recipients the routes give them.
+//
+// The digest sits behind the outbox, so each notification has been written
+//  there before it's held. When the digest goes out every one of them is
+//  marked with how it went; one that couldn't be sent, or was still held when
+//  the server stopped, is left to the retry task to send by itself.
+//
+
+const defaultDigestMax = 50
+
+type digestNotifier struct {
+  name string
+  inner Notifier
+  interval time.Duration
+  max int
+
+  mu sync.Mutex
+  batches map[string]*digestBatch
+}
+
+//
+// The notifications waiting for one set of recipients with their outbox
+//  entries, and the timer that sends them when the interval is up
+//
+
+type digestBatch struct {
+  notes []*Notification
+  entries []OutboxEntry
+  timer *time.Timer
+}
+
+//
+// The notifications in a digest about one check, ordered by host and mount
+//  point
+//
+
+type DigestGroup struct {
+  Check string
+  Notifications []*Notification
+}
+
+//
+// A digest for a notifier if its options ask for one, or nil
+//
+
+func newDigestNotifier(name string, inner Notifier, opts map[string]string) (*digestNotifier, error) {
+  var err error
+
+  dn := &digestNotifier{name: name, inner: inner, max: defaultDigestMax, batches: make(map[string]*digestBatch)}
+
+  d := takeOpt(opts, "digest", "")
+  m := takeOpt(opts, "digestmax", "")
+
+  if (d == "") {
+    if (m != "") {
+      return nil, fmt.Errorf("digestmax needs digest")
+    }
+    return nil, nil
+  }
+
+  dn.interval, err = time.ParseDuration(d)
+  if ((err != nil) || (dn.interval <= 0)) {
+    return nil, fmt.Errorf("bad digest interval %s", d)
+  }
+
+  if (m != "") {
+    dn.max, err = strconv.Atoi(m)
+    if ((err != nil) || (dn.max < 1)) {
+      return nil, fmt.Errorf("bad digestmax %s", m)
+    }
+  }
+
+  return dn, nil
+}
+
+//
+// Hold a notification already written to the outbox as e
+//
+
+func (dn *digestNotifier) add(e OutboxEntry, n *Notification) {
+  k := strings.Join(n.To, ",") + ";" + strings.Join(n.Cc, ",")
+
+  dn.mu.Lock()
+
+  b, ok := dn.batches[k]
+  if (!ok) {
+    b = &digestBatch{}
+    b.timer = time.AfterFunc(dn.interval, func() { dn.flush(k, b) })
+    dn.batches[k] = b
+  }
+
+  b.notes = append(b.notes, n)
+  b.entries = append(b.entries, e)
+  waiting := len(b.notes)
+
+  dn.mu.Unlock()
+
+  if (waiting >= dn.max) {
+    dn.flush(k, b)
+  }
+}
+
+//
+// Send one batch, if it hasn't been sent already. A timer that fires after
+//  its batch went out at digestmax finds a newer batch, or none, under the
+//  key and leaves it alone.
+//
+
+func (dn *digestNotifier) flush(k string, b *digestBatch) {
+  dn.mu.Lock()
+  if (dn.batches[k] != b) {
+    dn.mu.Unlock()
+    return
+  }
+  delete(dn.batches, k)
+  dn.mu.Unlock()
+
+  b.timer.Stop()
+
+  batch := b.notes
+
+  n := batch[0]
+
+  var err error
+
+  if (len(batch) > 1) {
+    n = digestOf(batch)
+
+    err = renderNotification(n)
+    if (err != nil) {
+      log.Printf("Failed rendering digest of %d notifications for %s: %v\n", len(batch), dn.name, err)
+    }
+  }
+
+  if (err == nil) {
+    err = dn.inner.Notify(n)
+    if (err != nil) {
+      log.Printf("Failed sending digest of %d notifications to %s: %v\n", len(batch), dn.name, err)
+    }
+  }
+
+  for _, e := range b.entries {
+    recordDelivery(e, err)
+  }
+}
+
+var severityRank = map[string]int{"info": 1, "warning": 2, "critical": 3}
+
+//
+// One notification covering a batch, grouped by check and then by host. Its
+//  Alert has just the worst severity in the batch, for notifiers that go by
+//  that, and the hostname when the whole batch is about one host.
+//
+
+func digestOf(batch []*Notification) *Notification {
+  d := &Notification{Kind: "digest", Count: len(batch), To: batch[0].To, Cc: batch[0].Cc}
+  d.Alert.Hostname = batch[0].Alert.Hostname
+
+  byCheck := make(map[string]*DigestGroup)
+
+  for _, n := range batch {
+    if (severityRank[n.Alert.Severity] > severityRank[d.Alert.Severity]) {
+      d.Alert.Severity = n.Alert.Severity
+    }
+    if (n.Alert.Hostname != d.Alert.Hostname) {
+      d.Alert.Hostname = ""
+    }
+
+    g, ok := byCheck[n.Alert.Check]
+    if (!ok) {
+      g = &DigestGroup{Check: n.Alert.Check}
+      byCheck[n.Alert.Check] = g
+    }
+    g.Notifications = append(g.Notifications, n)
+  }
+
+  for _, g := range byCheck {
+    sort.SliceStable(g.Notifications, func(i int, j int) bool {
+      a, b := &g.Notifications[i].Alert, &g.Notifications[j].Alert
+      if (a.Hostname != b.Hostname) {
+        return a.Hostname < b.Hostname
+      }
+      return a.Mount < b.Mount
+    })
+    d.Digest = append(d.Digest, *g)
+  }
+
+  sort.Slice(d.Digest, func(i int, j int) bool { return d.Digest[i].Check < d.Digest[j].Check })
+
+  return d
+}
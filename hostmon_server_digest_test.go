@@ -0,0 +1,212 @@
+//
+// Host monitor data collection server, notification digest tests
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "errors"
+  "sync"
+  "testing"
+  "time"
+)
+
+//
+// A notifier that keeps what it's given, or fails with err
+//
+
+type recordingNotifier struct {
+  mu sync.Mutex
+  got []*Notification
+  err error
+}
+
+func (rn *recordingNotifier) Notify(n *Notification) error {
+  rn.mu.Lock()
+  defer rn.mu.Unlock()
+
+  if (rn.err != nil) {
+    return rn.err
+  }
+
+  rn.got = append(rn.got, n)
+  return nil
+}
+
+func (rn *recordingNotifier) sent() []*Notification {
+  rn.mu.Lock()
+  defer rn.mu.Unlock()
+  return append([]*Notification(nil), rn.got...)
+}
+
+//
+// A notifier with a digest behind an outbox in memory, for the length of a
+//  test
+//
+
+func testDigest(t *testing.T, opts map[string]string) (*outboxNotifier, *recordingNotifier) {
+  oldStore := store
+  t.Cleanup(func() { store = oldStore })
+
+  store = newMemStore()
+
+  rn := &recordingNotifier{}
+  on := &outboxNotifier{name: "oncall", inner: rn}
+
+  var err error
+
+  on.digest, err = newDigestNotifier("oncall", rn, opts)
+  if ((err != nil) || (on.digest == nil)) {
+    t.Fatalf("no digest: %v", err)
+  }
+
+  return on, rn
+}
+
+func outboxStatuses(t *testing.T) []string {
+  es, err := store.RecentNotifications("", "", 100)
+  if (err != nil) {
+    t.Fatal(err)
+  }
+
+  var st []string
+  for i := len(es)-1; i >= 0; i-- {
+    st = append(st, es[i].Status)
+  }
+
+  return st
+}
+
+func diskNote(host string, severity string) *Notification {
+  return &Notification{Kind: "alert", Alert: Alert{Hostname: host, Check: "varfull", Mount: "/var", Severity: severity}}
+}
+
+func TestDigestMax(t *testing.T) {
+  on, rn := testDigest(t, map[string]string{"digest": "1h", "digestmax": "2"})
+
+  on.Notify(diskNote("db1", "warning"))
+  on.Notify(diskNote("db2", "critical"))
+
+  got := rn.sent()
+  if ((len(got) != 1) || (got[0].Kind != "digest") || (got[0].Count != 2)) {
+    t.Fatalf("got %+v, want one digest of 2", got)
+  }
+  if (got[0].Alert.Severity != "critical") {
+    t.Errorf("digest severity %q, want critical", got[0].Alert.Severity)
+  }
+  if (got[0].Alert.Hostname != "") {
+    t.Errorf("digest of two hosts has hostname %q", got[0].Alert.Hostname)
+  }
+
+  st := outboxStatuses(t)
+  if ((len(st) != 2) || (st[0] != outboxSent) || (st[1] != outboxSent)) {
+    t.Errorf("outbox statuses %v, want both sent", st)
+  }
+}
+
+func TestDigestHeldInOutbox(t *testing.T) {
+  on, rn := testDigest(t, map[string]string{"digest": "1h"})
+
+  on.Notify(diskNote("db1", "warning"))
+
+  n := diskNote("db1", "info")
+  n.Alert.Maintenance = "kernel upgrade"
+  on.Notify(n)
+
+  if (len(rn.sent()) != 0) {
+    t.Fatalf("sent %d notifications before the digest was due", len(rn.sent()))
+  }
+
+  st := outboxStatuses(t)
+  if ((len(st) != 2) || (st[0] != outboxPending) || (st[1] != outboxSuppressed)) {
+    t.Fatalf("outbox statuses %v, want pending and suppressed", st)
+  }
+
+  // Held, so not the retry task's yet, but it is once the digest is overdue
+  now := time.Now()
+
+  due, _ := store.DueNotifications(now.Add(outboxLease).Unix())
+  if (len(due) != 0) {
+    t.Errorf("held notification due for retry before its digest")
+  }
+
+  due, _ = store.DueNotifications(now.Add(time.Hour + outboxLease).Add(time.Minute).Unix())
+  if (len(due) != 1) {
+    t.Errorf("%d held notifications due for retry after the digest, want 1", len(due))
+  }
+}
+
+func TestDigestFailed(t *testing.T) {
+  on, rn := testDigest(t, map[string]string{"digest": "1h", "digestmax": "2"})
+  rn.err = errors.New("connection refused")
+
+  on.Notify(diskNote("db1", "warning"))
+  on.Notify(diskNote("db2", "warning"))
+
+  es, _ := store.RecentNotifications("", "", 100)
+  for _, e := range es {
+    if ((e.Status != outboxPending) || (e.Attempts != 1) || (e.LastError != "connection refused")) {
+      t.Errorf("notification after a failed digest %+v, want pending with one attempt", e)
+    }
+  }
+}
+
+func TestDigestOneHost(t *testing.T) {
+  d := digestOf([]*Notification{diskNote("db1", "warning"), diskNote("db1", "info")})
+
+  if (d.Alert.Hostname != "db1") {
+    t.Errorf("digest hostname %q, want db1", d.Alert.Hostname)
+  }
+}
+
+func TestDigestStaleTimer(t *testing.T) {
+  on, rn := testDigest(t, map[string]string{"digest": "1h", "digestmax": "2"})
+  dn := on.digest
+
+  on.Notify(diskNote("db1", "warning"))
+
+  dn.mu.Lock()
+  first := dn.batches[";"]
+  dn.mu.Unlock()
+
+  on.Notify(diskNote("db2", "warning"))
+  on.Notify(diskNote("db3", "warning"))
+
+  // The first batch's timer going off now must not send the second batch
+  dn.flush(";", first)
+
+  if (len(rn.sent()) != 1) {
+    t.Fatalf("got %d notifications after a stale timer, want 1", len(rn.sent()))
+  }
+
+  dn.mu.Lock()
+  waiting := len(dn.batches[";"].notes)
+  dn.mu.Unlock()
+
+  if (waiting != 1) {
+    t.Errorf("%d notifications waiting, want 1", waiting)
+  }
+}
+
+func TestDigestInterval(t *testing.T) {
+  on, rn := testDigest(t, map[string]string{"digest": "20ms"})
+
+  on.Notify(diskNote("db1", "warning"))
+
+  // Sent once the outbox says so
+  deadline := time.Now().Add(5*time.Second)
+  for (outboxStatuses(t)[0] != outboxSent) && time.Now().Before(deadline) {
+    time.Sleep(10*time.Millisecond)
+  }
+
+  got := rn.sent()
+  if ((len(got) != 1) || (got[0].Kind != "alert")) {
+    t.Errorf("got %+v, want the one notification as it is", got)
+  }
+
+  st := outboxStatuses(t)
+  if ((len(st) != 1) || (st[0] != outboxSent)) {
+    t.Errorf("outbox statuses %v, want sent", st)
+  }
+}
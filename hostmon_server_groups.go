@@ -0,0 +1,260 @@
+//
+// Host monitor data collection server, hostgroups and threshold overrides
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "fmt"
+  "path"
+  "strconv"
+  "strings"
+)
+
+//
+// A hostgroup is declared in the configuration file as
+//
+//  hostgroup name member ...
+//
+//  where each member is a host name or a shell glob pattern of host names.
+//  The directive may be repeated to add more members. Rules and overrides
+//  refer to a group as @name.
+//
+
+type hostgroup struct {
+  name string
+  members []string
+}
+
+// In the order they were first declared
+var g_hostgroups []*hostgroup
+
+//
+// Threshold overrides, by group and by host, then by rule name. A host's own
+//  override wins over its groups', and among groups the one declared first
+//  wins.
+//
+//  threshold @group rule value
+//  threshold host rule value
+//
+
+var g_groupThresholds = make(map[string]map[string]ruleThreshold)
+var g_hostThresholds = make(map[string]map[string]ruleThreshold)
+
+//
+// A threshold is a number, or for load rules may be a number per CPU,
+//  written 2/cpu, which is multiplied by the NumCPUs the host reports
+//
+
+type ruleThreshold struct {
+  value float64
+  perCPU bool
+}
+
+func parseThreshold(s string) (ruleThreshold, error) {
+  var t ruleThreshold
+  var err error
+
+  v, perCPU := strings.CutSuffix(s, "/cpu")
+
+  t.value, err = strconv.ParseFloat(v, 64)
+  if (err != nil) {
+    return t, fmt.Errorf("bad threshold %s", s)
+  }
+
+  t.perCPU = perCPU
+
+  return t, nil
+}
+
+func (t ruleThreshold) String() string {
+  if (t.perCPU) {
+    return strconv.FormatFloat(t.value, 'g', -1, 64) + "/cpu"
+  }
+
+  return strconv.FormatFloat(t.value, 'g', -1, 64)
+}
+
+//
+// The threshold for a host that reports cpus processors
+//
+
+func (t ruleThreshold) resolve(cpus int64) float64 {
+  if (t.perCPU) {
+    return t.value*float64(cpus)
+  }
+
+  return t.value
+}
+
+//
+// Add members to a group, creating it the first time
+//
+
+func addHostgroup(name string, members []string) error {
+  if (!validCheckName(name)) {
+    return fmt.Errorf("bad hostgroup name %s", name)
+  }
+
+  for _, p := range members {
+    _, err := path.Match(p, "")
+    if (err != nil) {
+      return fmt.Errorf("hostgroup %s: bad pattern %s", name, p)
+    }
+  }
+
+  for _, g := range g_hostgroups {
+    if (g.name == name) {
+      g.members = append(g.members, members...)
+      return nil
+    }
+  }
+
+  g_hostgroups = append(g_hostgroups, &hostgroup{name: name, members: members})
+
+  return nil
+}
+
+func findHostgroup(name string) *hostgroup {
+  for _, g := range g_hostgroups {
+    if (g.name == name) {
+      return g
+    }
+  }
+
+  return nil
+}
+
+func (g *hostgroup) contains(host string) bool {
+  for _, p := range g.members {
+    if ok, _ := path.Match(p, host); ok {
+      return true
+    }
+  }
+
+  return false
+}
+
+//
+// The groups a host belongs to, in declaration order
+//
+
+func hostGroups(host string) []string {
+  var names []string
+
+  for _, g := range g_hostgroups {
+    if (g.contains(host)) {
+      names = append(names, g.name)
+    }
+  }
+
+  return names
+}
+
+//
+// Parse the fields of a threshold line, less the leading "threshold". The
+//  rule it names is checked once the whole file has been read.
+//
+
+func addThresholdOverride(fields []string) error {
+  if (len(fields) != 3) {
+    return fmt.Errorf("threshold needs a host or @group, a rule and a value")
+  }
+
+  who, rule := fields[0], fields[1]
+
+  t, err := parseThreshold(fields[2])
+  if (err != nil) {
+    return err
+  }
+
+  overrides := g_hostThresholds
+
+  if g, ok := strings.CutPrefix(who, "@"); ok {
+    if (!validCheckName(g)) {
+      return fmt.Errorf("bad hostgroup name %s", g)
+    }
+    who, overrides = g, g_groupThresholds
+  } else if (!validHostname(who)) {
+    return fmt.Errorf("bad host name %s", who)
+  }
+
+  if (overrides[who] == nil) {
+    overrides[who] = make(map[string]ruleThreshold)
+  }
+  overrides[who][rule] = t
+
+  return nil
+}
+
+//
+// Once the configuration file has been read, make sure every override and
+//  rule refers to a rule and groups that exist, and that per CPU thresholds
+//  are only used on load
+//
+
+func checkGroupReferences() error {
+  rules := make(map[string]*alertRule)
+  for _, ru := range g_rules {
+    rules[ru.name] = ru
+  }
+
+  check := func(what string, byRule map[string]ruleThreshold) error {
+    for rn, t := range byRule {
+      ru, ok := rules[rn]
+      if (!ok) {
+        return fmt.Errorf("threshold for %s: no rule named %s", what, rn)
+      }
+      if (t.perCPU && (!ru.loadMetric())) {
+        return fmt.Errorf("threshold for %s: per CPU thresholds are only for load rules, not %s", what, rn)
+      }
+    }
+    return nil
+  }
+
+  for h, byRule := range g_hostThresholds {
+    err := check(h, byRule)
+    if (err != nil) {
+      return err
+    }
+  }
+
+  for g, byRule := range g_groupThresholds {
+    if (findHostgroup(g) == nil) {
+      return fmt.Errorf("threshold for @%s: no such hostgroup", g)
+    }
+    err := check("@" + g, byRule)
+    if (err != nil) {
+      return err
+    }
+  }
+
+  for _, ru := range g_rules {
+    for _, p := range ru.hosts {
+      if g, ok := strings.CutPrefix(p, "@"); ok && (findHostgroup(g) == nil) {
+        return fmt.Errorf("rule %s: no such hostgroup %s", ru.name, g)
+      }
+    }
+  }
+
+  return nil
+}
+
+//
+// The threshold a rule uses for a host, after overrides
+//
+
+func (ru *alertRule) thresholdFor(host string) ruleThreshold {
+  if t, ok := g_hostThresholds[host][ru.name]; ok {
+    return t
+  }
+
+  for _, g := range hostGroups(host) {
+    if t, ok := g_groupThresholds[g][ru.name]; ok {
+      return t
+    }
+  }
+
+  return ru.threshold
+}
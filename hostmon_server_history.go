@@ -0,0 +1,362 @@
+//
+// Host monitor data collection server, time series of past reports
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "encoding/json"
+  "log"
+  "math"
+  "net/http"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+//
+// Range returned when the client doesn't give one, and the most raw points
+//  we will send back for one series before insisting on downsampling
+//
+
+const defaultHistoryRange = 24*time.Hour
+const maxHistoryPoints = 10000
+
+//
+// Metrics that can be asked for with metric=, each nil for a report that
+//  doesn't have it. Disk usage is one series per mount point, named
+//  disk:<mountpoint>; metric=disk:/var picks just one.
+//
+
+var historyMetrics = map[string]func(m *Message) *float64{
+  "load1": func(m *Message) *float64 { return &m.LoadOne },
+  "load5": func(m *Message) *float64 { return &m.LoadFive },
+  "load15": func(m *Message) *float64 { return &m.LoadFifteen },
+  "swap": func(m *Message) *float64 { return &m.SwapUsed },
+  "memory": func(m *Message) *float64 { return m.MemUsed },
+}
+
+// Shorthand metric names
+var historyMetricGroups = map[string][]string{
+  "load": {"load1", "load5", "load15"},
+}
+
+var historyAggregates = []string{"min", "max", "avg"}
+
+//
+// One point in a series. Raw points carry V; downsampled points carry the
+//  aggregates that were asked for over the bucket starting at T, and N, the
+//  number of samples in it.
+//
+
+type historyPoint struct {
+  T int64
+  V *float64 `json:",omitempty"`
+  Min *float64 `json:",omitempty"`
+  Max *float64 `json:",omitempty"`
+  Avg *float64 `json:",omitempty"`
+  N int `json:",omitempty"`
+}
+
+type historySeries struct {
+  Metric string
+  Points []historyPoint
+}
+
+type historyResponse struct {
+  Hostname string
+  From int64
+  To int64
+  Step int64 `json:",omitempty"`
+  Series []historySeries
+}
+
+//
+// The query for GET /host/<name>/history
+//
+//  from=, to=  the time range, as Unix seconds or RFC 3339; the last day by
+//              default
+//  metric=     load1, load5, load15, load (all three), swap, memory, disk
+//              (every mount) or disk:<mountpoint>; may be repeated or comma
+//              separated, everything by default
+//  step=       downsample into buckets this long, e.g. 5m
+//  agg=        min, max and/or avg for each bucket, avg by default
+//
+
+type historyQuery struct {
+  from int64
+  to int64
+  metrics map[string]bool
+  allDisks bool
+  step int64
+  aggs map[string]bool
+}
+
+func parseHistoryQuery(q url.Values) (historyQuery, []string) {
+  var problems []string
+
+  hq := historyQuery{metrics: make(map[string]bool), aggs: make(map[string]bool)}
+
+  hq.to = time.Now().Unix()
+  if s := q.Get("to"); s != "" {
+    t, ok := parseHistoryTime(s)
+    if (!ok) {
+      problems = append(problems, "bad to time " + s)
+    }
+    hq.to = t
+  }
+
+  hq.from = hq.to - int64(defaultHistoryRange/time.Second)
+  if s := q.Get("from"); s != "" {
+    t, ok := parseHistoryTime(s)
+    if (!ok) {
+      problems = append(problems, "bad from time " + s)
+    }
+    hq.from = t
+  }
+
+  if (hq.from > hq.to) {
+    problems = append(problems, "from is after to")
+  }
+
+  for _, s := range splitQuery(q["metric"]) {
+    _, single := historyMetrics[s]
+    group, isGroup := historyMetricGroups[s]
+
+    switch {
+      case single:
+        hq.metrics[s] = true
+      case isGroup:
+        for _, g := range group {
+          hq.metrics[g] = true
+        }
+      case s == "disk":
+        hq.allDisks = true
+      case strings.HasPrefix(s, "disk:") && (len(s) > len("disk:")):
+        hq.metrics[s] = true
+      default:
+        problems = append(problems, "unknown metric " + s)
+    }
+  }
+
+  if ((len(hq.metrics) == 0) && (!hq.allDisks)) {
+    for n := range historyMetrics {
+      hq.metrics[n] = true
+    }
+    hq.allDisks = true
+  }
+
+  if s := q.Get("step"); s != "" {
+    d, err := time.ParseDuration(s)
+    if ((err != nil) || (d < time.Second)) {
+      problems = append(problems, "step must be a duration of at least 1s")
+    }
+    hq.step = int64(d/time.Second)
+  }
+
+  for _, s := range splitQuery(q["agg"]) {
+    switch s {
+      case "min", "max", "avg":
+        hq.aggs[s] = true
+      default:
+        problems = append(problems, "unknown aggregate " + s)
+    }
+  }
+
+  if (len(hq.aggs) == 0) {
+    hq.aggs["avg"] = true
+  } else if (hq.step == 0) {
+    problems = append(problems, "agg needs a step")
+  }
+
+  return hq, problems
+}
+
+//
+// Times are Unix seconds or RFC 3339
+//
+
+func parseHistoryTime(s string) (int64, bool) {
+  n, err := strconv.ParseInt(s, 10, 64)
+  if (err == nil) {
+    return n, true
+  }
+
+  t, err := time.Parse(time.RFC3339, s)
+  if (err != nil) {
+    return 0, false
+  }
+
+  return t.Unix(), true
+}
+
+//
+// Query values may be repeated, comma separated, or both
+//
+
+func splitQuery(vals []string) []string {
+  var out []string
+
+  for _, v := range vals {
+    for _, s := range strings.Split(v, ",") {
+      s = strings.TrimSpace(s)
+      if (s != "") {
+        out = append(out, s)
+      }
+    }
+  }
+
+  return out
+}
+
+//
+// GET /host/<name>/history
+//
+
+func task_host_history(w http.ResponseWriter, r *http.Request, h string) {
+  if (r.Method != "GET") {
+    w.Header().Set("Allow", "GET")
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  if (!validHostname(h)) {
+    http.Error(w, "Invalid host name " + h, http.StatusBadRequest)
+    return
+  }
+
+  hq, problems := parseHistoryQuery(r.URL.Query())
+  if (len(problems) != 0) {
+    http.Error(w, "Bad query: " + strings.Join(problems, "; "), http.StatusBadRequest)
+    return
+  }
+
+  ms, err := store.ReportsBetween(h, hq.from, hq.to)
+  if (err != nil) {
+    log.Printf("Failed reading history for host %s: %v\n", h, err)
+    http.Error(w, "Fatal attempting to read history for host " + h, http.StatusInternalServerError)
+    return
+  }
+
+  if ((hq.step == 0) && (len(ms) > maxHistoryPoints)) {
+    http.Error(w, "Too many points (" + strconv.Itoa(len(ms)) + "), narrow the range or give a step", http.StatusBadRequest)
+    return
+  }
+
+  resp := historyResponse{Hostname: h, From: hq.from, To: hq.to, Step: hq.step, Series: []historySeries{}}
+
+  for _, sr := range historySeriesFor(ms, hq) {
+    if (hq.step != 0) {
+      sr.Points = downsample(sr.Points, hq.from, hq.step, hq.aggs)
+    }
+    resp.Series = append(resp.Series, sr)
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+
+  err = json.NewEncoder(w).Encode(resp)
+  if (err != nil) {
+    log.Printf("Failed writing history for host %s: %v\n", h, err)
+  }
+}
+
+//
+// Pull the raw series the query asks for out of a run of reports, in metric
+//  name order
+//
+
+func historySeriesFor(ms []Message, hq historyQuery) []historySeries {
+  series := make(map[string][]historyPoint)
+
+  add := func(name string, t int64, v float64) {
+    series[name] = append(series[name], historyPoint{T: t, V: &v})
+  }
+
+  for i := range ms {
+    m := &ms[i]
+
+    for n, get := range historyMetrics {
+      if v := get(m); (hq.metrics[n] && (v != nil)) {
+        add(n, m.Timestamp, *v)
+      }
+    }
+
+    for _, d := range m.Disks {
+      n := "disk:" + d.MountPoint
+      if (hq.allDisks || hq.metrics[n]) {
+        add(n, m.Timestamp, d.UsedPct)
+      }
+    }
+  }
+
+  var names []string
+  for n := range series {
+    names = append(names, n)
+  }
+  sort.Strings(names)
+
+  out := make([]historySeries, 0, len(names))
+  for _, n := range names {
+    out = append(out, historySeries{Metric: n, Points: series[n]})
+  }
+
+  return out
+}
+
+//
+// Fold raw points into buckets of step seconds counted from start. Empty
+//  buckets are left out rather than sent as gaps.
+//
+
+func downsample(raw []historyPoint, start int64, step int64, aggs map[string]bool) []historyPoint {
+  var out []historyPoint
+  var cur *historyPoint
+  var min, max, sum float64
+
+  flush := func() {
+    if (cur == nil) {
+      return
+    }
+
+    avg := sum/float64(cur.N)
+    mn, mx := min, max
+
+    if (aggs["min"]) {
+      cur.Min = &mn
+    }
+    if (aggs["max"]) {
+      cur.Max = &mx
+    }
+    if (aggs["avg"]) {
+      cur.Avg = &avg
+    }
+
+    out = append(out, *cur)
+    cur = nil
+  }
+
+  for _, p := range raw {
+    b := start + ((p.T - start)/step)*step
+
+    if ((cur != nil) && (cur.T != b)) {
+      flush()
+    }
+
+    if (cur == nil) {
+      cur = &historyPoint{T: b}
+      min, max, sum = math.Inf(1), math.Inf(-1), 0
+    }
+
+    cur.N++
+    min = math.Min(min, *p.V)
+    max = math.Max(max, *p.V)
+    sum += *p.V
+  }
+
+  flush()
+
+  return out
+}
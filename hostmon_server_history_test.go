@@ -0,0 +1,78 @@
+//
+// Host monitor data collection server, report history tests
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "net/http"
+  "net/url"
+  "strings"
+  "testing"
+)
+
+func TestHistoryMemoryKnownOnly(t *testing.T) {
+  used := 40.0
+
+  ms := []Message{
+    {Timestamp: 1000, SwapUsed: 1},
+    {Timestamp: 1060, SwapUsed: 2, MemUsed: &used},
+    {Timestamp: 1120, SwapUsed: 3},
+  }
+
+  series := historySeriesFor(ms, historyQuery{metrics: map[string]bool{"memory": true, "swap": true}})
+  if (len(series) != 2) {
+    t.Fatalf("got %d series, want 2", len(series))
+  }
+
+  for _, sr := range series {
+    want := 3
+    if (sr.Metric == "memory") {
+      want = 1
+    }
+    if (len(sr.Points) != want) {
+      t.Errorf("%s: got %d points, want %d", sr.Metric, len(sr.Points), want)
+    }
+  }
+
+  mem := series[0].Points
+  if ((series[0].Metric != "memory") || (mem[0].T != 1060) || (*mem[0].V != used)) {
+    t.Errorf("memory series %+v, want the one report that had it", series[0])
+  }
+
+  avg := downsample(mem, 1000, 300, map[string]bool{"avg": true, "min": true})
+  if ((len(avg) != 1) || (*avg[0].Avg != used) || (*avg[0].Min != used)) {
+    t.Errorf("downsampled memory %+v, want 40 from the one report", avg)
+  }
+}
+
+func TestFormMemUsed(t *testing.T) {
+  form := url.Values{"Timestamp": {"1700000000"}, "NumCPUs": {"4"}, "Memtotal": {"1024"}, "LoadOne": {"0.5"},
+    "LoadFive": {"0.4"}, "LoadFifteen": {"0.3"}, "SwapUsed": {"2.5"}}
+
+  for _, mem := range []string{"", "37.5"} {
+    f := url.Values{}
+    for k, v := range form {
+      f[k] = v
+    }
+    if (mem != "") {
+      f.Set("MemUsed", mem)
+    }
+
+    r, _ := http.NewRequest("POST", "/host/db1", strings.NewReader(f.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+    m, ve := parseFormMessage(r)
+    if (len(ve) != 0) {
+      t.Fatalf("MemUsed %q: %v", mem, ve)
+    }
+
+    switch {
+      case (mem == "") && (m.MemUsed != nil):
+        t.Errorf("no MemUsed posted, got %v", *m.MemUsed)
+      case (mem != "") && ((m.MemUsed == nil) || (*m.MemUsed != 37.5)):
+        t.Errorf("MemUsed %q posted, got %v", mem, m.MemUsed)
+    }
+  }
+}
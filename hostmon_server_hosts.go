@@ -0,0 +1,249 @@
+//
+// Host monitor data collection server, host list
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "encoding/json"
+  "log"
+  "net/http"
+  "net/url"
+  "path"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+//
+// Page size for GET /host/ when the client doesn't ask for one, and the
+//  largest it may ask for
+//
+
+const defaultHostPageSize = 100
+const maxHostPageSize = 1000
+
+//
+// Orderings for GET /host/?sort=, each comparing two reports
+//
+
+var hostSortKeys = map[string]func(a *Message, b *Message) bool{
+  "hostname": func(a *Message, b *Message) bool { return a.Hostname < b.Hostname },
+  "timestamp": func(a *Message, b *Message) bool { return a.Timestamp < b.Timestamp },
+  "load": func(a *Message, b *Message) bool { return a.LoadOne < b.LoadOne },
+  "swap": func(a *Message, b *Message) bool { return a.SwapUsed < b.SwapUsed },
+  "release": func(a *Message, b *Message) bool { return a.Release < b.Release },
+  "kernel": func(a *Message, b *Message) bool { return a.KernelVer < b.KernelVer },
+}
+
+//
+// The query for GET /host/
+//
+//  prefix=   only hosts whose name starts with this
+//  release=  only hosts whose release matches this shell glob pattern
+//  kernel=   only hosts whose kernel version matches this shell glob pattern
+//  stale=    true or false, only hosts that have or haven't stopped reporting
+//  sort=     hostname (the default), timestamp, load, swap, release or
+//            kernel, with a leading - for descending order
+//  limit=    at most this many hosts (default 100, at most 1000)
+//  offset=   skip this many hosts first
+//
+
+type hostQuery struct {
+  prefix string
+  release string
+  kernel string
+  stale string
+  sortKey string
+  descending bool
+  limit int
+  offset int
+}
+
+func parseHostQuery(q url.Values) (hostQuery, []string) {
+  var problems []string
+  var err error
+
+  hq := hostQuery{
+    prefix: q.Get("prefix"),
+    release: q.Get("release"),
+    kernel: q.Get("kernel"),
+    stale: q.Get("stale"),
+    sortKey: "hostname",
+    limit: defaultHostPageSize,
+  }
+
+  for _, p := range []string{hq.release, hq.kernel} {
+    _, err = path.Match(p, "")
+    if (err != nil) {
+      problems = append(problems, "bad pattern " + p)
+    }
+  }
+
+  if ((hq.stale != "") && (hq.stale != "true") && (hq.stale != "false")) {
+    problems = append(problems, "stale must be true or false")
+  }
+
+  if s := q.Get("sort"); s != "" {
+    hq.sortKey, hq.descending = strings.TrimPrefix(s, "-"), strings.HasPrefix(s, "-")
+    if _, ok := hostSortKeys[hq.sortKey]; !ok {
+      problems = append(problems, "unknown sort key " + hq.sortKey)
+    }
+  }
+
+  if s := q.Get("limit"); s != "" {
+    hq.limit, err = strconv.Atoi(s)
+    if ((err != nil) || (hq.limit < 1) || (hq.limit > maxHostPageSize)) {
+      problems = append(problems, "limit must be between 1 and " + strconv.Itoa(maxHostPageSize))
+    }
+  }
+
+  if s := q.Get("offset"); s != "" {
+    hq.offset, err = strconv.Atoi(s)
+    if ((err != nil) || (hq.offset < 0)) {
+      problems = append(problems, "offset must be a number 0 or greater")
+    }
+  }
+
+  return hq, problems
+}
+
+func (hq hostQuery) matches(hs *hostStatus) bool {
+  m := &hs.Message
+
+  if (!strings.HasPrefix(m.Hostname, hq.prefix)) {
+    return false
+  }
+
+  if ((hq.stale != "") && (strconv.FormatBool(hs.Stale) != hq.stale)) {
+    return false
+  }
+
+  if (hq.release != "") {
+    if ok, _ := path.Match(hq.release, m.Release); !ok {
+      return false
+    }
+  }
+
+  if (hq.kernel != "") {
+    if ok, _ := path.Match(hq.kernel, m.KernelVer); !ok {
+      return false
+    }
+  }
+
+  return true
+}
+
+//
+// GET /host/: the latest report from every host the query selects, with its
+//  stale flag, as a JSON array, or as one JSON object per line if the client
+//  accepts application/x-ndjson. The Hostmon-Total-Count header says how many
+//  hosts matched before paging, and a Link header points at the next page.
+//
+
+func task_list_hosts(w http.ResponseWriter, r *http.Request) {
+  hq, problems := parseHostQuery(r.URL.Query())
+  if (len(problems) != 0) {
+    http.Error(w, "Bad query: " + strings.Join(problems, "; "), http.StatusBadRequest)
+    return
+  }
+
+  hosts, err := store.ListHosts()
+  if (err != nil) {
+    log.Printf("Failed listing hosts: %v\n", err)
+    http.Error(w, "Fatal attempting to list hosts", http.StatusInternalServerError)
+    return
+  }
+
+  // Gather everything before writing so a failure part way is a clean error
+  reports := make([]hostStatus, 0, len(hosts))
+  now := time.Now()
+
+  for _, hh := range hosts {
+    if (!strings.HasPrefix(hh, hq.prefix)) {
+      continue
+    }
+
+    m, err := store.LatestReport(hh)
+    if (err == errNoReports) {
+      continue
+    }
+    if (err != nil) {
+      log.Printf("Failed reading latest report for host %s: %v\n", hh, err)
+      http.Error(w, "Fatal attempting to read report for host " + hh, http.StatusInternalServerError)
+      return
+    }
+
+    hs := newHostStatus(m, now)
+    if (hq.matches(&hs)) {
+      reports = append(reports, hs)
+    }
+  }
+
+  less := hostSortKeys[hq.sortKey]
+
+  sort.SliceStable(reports, func(i int, j int) bool {
+    if (hq.descending) {
+      return less(&reports[j].Message, &reports[i].Message)
+    }
+    return less(&reports[i].Message, &reports[j].Message)
+  })
+
+  total := len(reports)
+
+  if (hq.offset < total) {
+    reports = reports[hq.offset:]
+  } else {
+    reports = reports[:0]
+  }
+
+  if (len(reports) > hq.limit) {
+    reports = reports[0:hq.limit]
+
+    next := r.URL.Query()
+    next.Set("offset", strconv.Itoa(hq.offset + hq.limit))
+    next.Set("limit", strconv.Itoa(hq.limit))
+    w.Header().Set("Link", "<" + r.URL.Path + "?" + next.Encode() + ">; rel=\"next\"")
+  }
+
+  w.Header().Set("Hostmon-Total-Count", strconv.Itoa(total))
+  w.Header().Add("Vary", "Accept")
+
+  if (acceptsNDJSON(r)) {
+    w.Header().Set("Content-Type", "application/x-ndjson")
+
+    enc := json.NewEncoder(w)
+    for _, m := range reports {
+      err = enc.Encode(m)
+      if (err != nil) {
+        log.Printf("Failed writing host list: %v\n", err)
+        return
+      }
+    }
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+
+  err = json.NewEncoder(w).Encode(reports)
+  if (err != nil) {
+    log.Printf("Failed writing host list: %v\n", err)
+  }
+}
+
+//
+// Whether the client would rather have newline delimited JSON
+//
+
+func acceptsNDJSON(r *http.Request) bool {
+  for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+    mt := strings.TrimSpace(strings.Split(a, ";")[0])
+    if ((mt == "application/x-ndjson") || (mt == "application/ndjson") || (mt == "application/jsonl")) {
+      return true
+    }
+  }
+
+  return false
+}
@@ -0,0 +1,283 @@
+//
+// Host monitor data collection server, JSON report ingestion
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+//
+// Report schema versions we accept on /report/, oldest first. Every response
+//  from /report/ lists them in the Hostmon-Schema-Versions header, and
+//  GET /report/ returns them in the body, so an agent can find out what to
+//  send.
+//
+
+var schemaVersions = []int{1}
+
+// Largest report body we will read
+const maxReportBytes = 1024*1024
+
+//
+// Version 1 of the JSON report. Pointer fields are required and nil means
+//  the agent left them out; the rest are optional.
+//
+
+type reportV1 struct {
+  SchemaVersion int
+  Timestamp *int64
+  Hostname *string
+  NumCPUs *int64
+  Memtotal *int64
+  LoadOne *float64
+  LoadFive *float64
+  LoadFifteen *float64
+  SwapUsed *float64
+  MemUsed *float64
+  KernelVer *string
+  Release *string
+  Uptime *string
+  DiskReport string
+  Disks []DiskInfo
+  Collectors []string
+  CollectorErrors map[string]string
+  Checks []CheckResult
+}
+
+//
+// Body of every error response from /report/
+//
+
+type reportError struct {
+  Error string
+  Problems []string `json:",omitempty"`
+  SchemaVersions []int
+}
+
+//
+// Handle a connection to /report/
+//
+//  /report/        GET -> supported schema versions
+//  /report/name    POST -> store a JSON report for one host
+//
+
+func task_handle_report(w http.ResponseWriter, r *http.Request) {
+  h := r.URL.Path[len("/report/"):]
+
+  w.Header().Set("Hostmon-Schema-Versions", schemaVersionList())
+  w.Header().Set("Content-Type", "application/json")
+
+  switch r.Method {
+    case "GET":
+      json.NewEncoder(w).Encode(struct{ SchemaVersions []int }{schemaVersions})
+      return
+    case "POST":
+    default:
+      w.Header().Set("Allow", "GET, POST")
+      writeReportError(w, http.StatusMethodNotAllowed, "method " + r.Method + " not allowed", nil)
+      return
+  }
+
+  if (len(h) == 0) {
+    writeReportError(w, http.StatusBadRequest, "must specify a host for a POST request", nil)
+    return
+  }
+
+  ct := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+  if (ct != "application/json") {
+    writeReportError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json", nil)
+    return
+  }
+
+  body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxReportBytes))
+  if (err != nil) {
+    writeReportError(w, http.StatusRequestEntityTooLarge, "failed reading report: " + err.Error(), nil)
+    return
+  }
+
+  err = authenticateReport(r, h, body)
+  if (err != nil) {
+    log.Printf("Rejected unauthenticated report for host %s from %s: %v\n", h, r.RemoteAddr, err)
+    writeReportError(w, http.StatusUnauthorized, "authentication failed: " + err.Error(), nil)
+    return
+  }
+
+  m, ve := decodeReport(body)
+  if (len(ve) == 0) {
+    ve = validateMessage(m, h)
+  }
+
+  if (len(ve) != 0) {
+    log.Printf("Rejected JSON report for host %s from %s: %s\n", h, r.RemoteAddr, ve.Error())
+    writeReportError(w, http.StatusBadRequest, "rejected report", ve)
+    return
+  }
+
+  prev, err := claimReportTimestamp(r, m)
+  switch {
+    case err == errReportReplayed:
+      log.Printf("Rejected JSON report for host %s from %s: %v\n", h, r.RemoteAddr, err)
+      writeReportError(w, http.StatusConflict, err.Error(), nil)
+      return
+    case err != nil:
+      log.Printf("Failed checking report order for host %s: %v\n", h, err)
+      writeReportError(w, http.StatusInternalServerError, "failed checking report for host " + h, nil)
+      return
+  }
+
+  err = store.StoreReport(m)
+  if (err != nil) {
+    releaseReportTimestamp(r, m, prev)
+    log.Printf("Failed storing report for host %s: %v\n", m.Hostname, err)
+    writeReportError(w, http.StatusInternalServerError, "failed storing report for host " + m.Hostname, nil)
+    return
+  }
+
+  log.Printf("JSON report from: %s %s %s\n", m.Hostname, m.KernelVer, m.Release)
+
+  json.NewEncoder(w).Encode(struct{ SchemaVersion int }{schemaVersions[len(schemaVersions)-1]})
+}
+
+func writeReportError(w http.ResponseWriter, code int, msg string, problems validationErrors) {
+  w.WriteHeader(code)
+  json.NewEncoder(w).Encode(reportError{Error: msg, Problems: problems, SchemaVersions: schemaVersions})
+}
+
+func schemaVersionList() string {
+  var vl []string
+
+  for _, v := range schemaVersions {
+    vl = append(vl, strconv.Itoa(v))
+  }
+
+  return strings.Join(vl, ", ")
+}
+
+//
+// Decode a JSON report of any version we support into a Message. Unknown
+//  fields, trailing data and missing required fields are all errors.
+//
+
+func decodeReport(body []byte) (Message, validationErrors) {
+  var ve validationErrors
+  var v struct {
+    SchemaVersion *int
+  }
+
+  err := json.Unmarshal(body, &v)
+  if (err != nil) {
+    ve.add("body", "malformed JSON: %v", err)
+    return Message{}, ve
+  }
+
+  if (v.SchemaVersion == nil) {
+    ve.add("SchemaVersion", "missing, supported versions are %s", schemaVersionList())
+    return Message{}, ve
+  }
+
+  switch *v.SchemaVersion {
+    case 1:
+      return decodeReportV1(body)
+  }
+
+  ve.add("SchemaVersion", "unsupported version %d, supported versions are %s", *v.SchemaVersion, schemaVersionList())
+
+  return Message{}, ve
+}
+
+func decodeReportV1(body []byte) (Message, validationErrors) {
+  var m Message
+  var ve validationErrors
+  var rp reportV1
+
+  err := strictUnmarshal(body, &rp)
+  if (err != nil) {
+    ve.add("body", "%v", err)
+    return m, ve
+  }
+
+  missing := func(field string, isNil bool) {
+    if (isNil) {
+      ve.add(field, "required field missing")
+    }
+  }
+
+  missing("Timestamp", rp.Timestamp == nil)
+  missing("Hostname", rp.Hostname == nil)
+  missing("NumCPUs", rp.NumCPUs == nil)
+  missing("Memtotal", rp.Memtotal == nil)
+  missing("LoadOne", rp.LoadOne == nil)
+  missing("LoadFive", rp.LoadFive == nil)
+  missing("LoadFifteen", rp.LoadFifteen == nil)
+  missing("SwapUsed", rp.SwapUsed == nil)
+  missing("KernelVer", rp.KernelVer == nil)
+  missing("Release", rp.Release == nil)
+  missing("Uptime", rp.Uptime == nil)
+
+  if (len(ve) != 0) {
+    return m, ve
+  }
+
+  m.Timestamp = *rp.Timestamp
+  m.Hostname = *rp.Hostname
+  m.NumCPUs = *rp.NumCPUs
+  m.Memtotal = *rp.Memtotal
+  m.LoadOne = *rp.LoadOne
+  m.LoadFive = *rp.LoadFive
+  m.LoadFifteen = *rp.LoadFifteen
+  m.SwapUsed = *rp.SwapUsed
+  m.MemUsed = rp.MemUsed
+  m.KernelVer = *rp.KernelVer
+  m.Release = *rp.Release
+  m.Uptime = *rp.Uptime
+  m.Disks = rp.Disks
+  m.Collectors = rp.Collectors
+  m.CollectorErrors = rp.CollectorErrors
+  m.Checks = rp.Checks
+
+  // Agents may send just the old style disk report
+  if ((m.Disks == nil) && (rp.DiskReport != "")) {
+    m.Disks = disksFromReport(rp.DiskReport, &ve)
+  }
+
+  m.DiskReport = diskReportFromDisks(m.Disks)
+
+  return m, ve
+}
+
+//
+// Unmarshal that refuses unknown fields and anything after the first value,
+//  and says which field was the wrong type
+//
+
+func strictUnmarshal(body []byte, v interface{}) error {
+  dec := json.NewDecoder(bytes.NewReader(body))
+  dec.DisallowUnknownFields()
+
+  err := dec.Decode(v)
+  if (err != nil) {
+    var te *json.UnmarshalTypeError
+    if (errors.As(err, &te)) {
+      return fmt.Errorf("field %s: expected %s, got JSON %s", te.Field, te.Type, te.Value)
+    }
+    return err
+  }
+
+  _, err = dec.Token()
+  if (err != io.EOF) {
+    return errors.New("unexpected data after report")
+  }
+
+  return nil
+}
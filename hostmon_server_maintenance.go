@@ -0,0 +1,743 @@
+//
+// Host monitor data collection server, maintenance windows
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "path"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+//
+// During a maintenance window the alerts of the hosts it covers still go
+//  through their states as usual, but their notifications are recorded in
+//  the outbox as suppressed rather than sent. An alert still firing when the
+//  window ends is notified then. Windows are declared in the configuration
+//  file as
+//
+//  maintenance hosts from time to time
+//  maintenance hosts cron minute hour day month weekday for duration
+//
+//  where hosts is a comma separated list of shell glob patterns of hosts and
+//  @groups, and times are unix times or RFC 3339, or added through
+//  /maintenance/, when they are kept in the store. A recurring window starts
+//  whenever its cron expression matches, in the server's time zone, and may
+//  also have a start and end outside which it doesn't recur.
+//
+
+type Maintenance struct {
+  ID string
+  Hosts []string
+  Start int64 `json:",omitempty"`
+  End int64 `json:",omitempty"`
+  Cron string `json:",omitempty"`
+  Duration string `json:",omitempty"`
+  Comment string `json:",omitempty"`
+  By string `json:",omitempty"`
+
+  // Filled in when listed
+  Active bool
+  NextStart int64 `json:",omitempty"`
+  NextEnd int64 `json:",omitempty"`
+
+  dur time.Duration
+  sched *cronSchedule
+}
+
+// Longest a recurring window may last
+const maxMaintenanceDuration = 7*24*time.Hour
+
+var maintMu sync.Mutex
+var maintenances []*Maintenance
+
+var errNoMaintenance = errors.New("no such maintenance window")
+
+//
+// A cron expression, as a bit for each minute, hour, day of the month, month
+//  and day of the week it matches
+//
+
+type cronSchedule struct {
+  minute uint64
+  hour uint64
+  dom uint64
+  month uint64
+  dow uint64
+
+  // Whether day of month and day of week were both restricted, in which
+  //  case a day matching either will do
+  domAndDow bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+  var err error
+
+  f := strings.Fields(expr)
+  if (len(f) != 5) {
+    return nil, fmt.Errorf("cron expression %q needs five fields", expr)
+  }
+
+  cs := &cronSchedule{}
+
+  ranges := []struct {
+    bits *uint64
+    min int
+    max int
+  }{{&cs.minute, 0, 59}, {&cs.hour, 0, 23}, {&cs.dom, 1, 31}, {&cs.month, 1, 12}, {&cs.dow, 0, 7}}
+
+  for i, r := range ranges {
+    *r.bits, err = parseCronField(f[i], r.min, r.max)
+    if (err != nil) {
+      return nil, fmt.Errorf("cron expression %q: %v", expr, err)
+    }
+  }
+
+  // Sunday is 0 or 7
+  if (cs.dow & (1 << 7) != 0) {
+    cs.dow |= 1
+  }
+
+  cs.domAndDow = (f[2] != "*") && (f[4] != "*")
+
+  // A day of the month that none of its months have, as in 0 0 30 2 *, never
+  //  comes
+  if (!cs.domAndDow) {
+    possible := false
+    for m := 1; (m <= 12) && (!possible); m++ {
+      days := uint64(1) << uint(cronMonthDays[m] + 1) - 2
+      possible = (cs.month & (1 << uint(m)) != 0) && (cs.dom & days != 0)
+    }
+    if (!possible) {
+      return nil, fmt.Errorf("cron expression %q never matches", expr)
+    }
+  }
+
+  return cs, nil
+}
+
+// The most days each month can have
+var cronMonthDays = []int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+//
+// One field of a cron expression: *, a number, a range a-b, any of those
+//  with /step, or a comma separated list of them
+//
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+  var bits uint64
+
+  for _, part := range strings.Split(field, ",") {
+    var err error
+
+    rng, step := part, 1
+
+    if r, s, ok := strings.Cut(part, "/"); ok {
+      rng = r
+      step, err = strconv.Atoi(s)
+      if ((err != nil) || (step < 1)) {
+        return 0, fmt.Errorf("bad step in %s", part)
+      }
+    }
+
+    lo, hi := min, max
+
+    if (rng != "*") {
+      a, b, isRange := strings.Cut(rng, "-")
+
+      lo, err = strconv.Atoi(a)
+      if (err != nil) {
+        return 0, fmt.Errorf("bad value in %s", part)
+      }
+
+      hi = lo
+      if (isRange) {
+        hi, err = strconv.Atoi(b)
+        if (err != nil) {
+          return 0, fmt.Errorf("bad value in %s", part)
+        }
+      } else if (step != 1) {
+        hi = max
+      }
+    }
+
+    if ((lo < min) || (hi > max) || (lo > hi)) {
+      return 0, fmt.Errorf("%s is out of range %d-%d", part, min, max)
+    }
+
+    for v := lo; v <= hi; v += step {
+      bits |= 1 << uint(v)
+    }
+  }
+
+  return bits, nil
+}
+
+func (cs *cronSchedule) matches(t time.Time) bool {
+  if ((cs.minute & (1 << uint(t.Minute())) == 0) || (cs.hour & (1 << uint(t.Hour())) == 0) ||
+    (cs.month & (1 << uint(t.Month())) == 0)) {
+    return false
+  }
+
+  return cs.dayMatches(t)
+}
+
+func (cs *cronSchedule) dayMatches(t time.Time) bool {
+  dom := cs.dom & (1 << uint(t.Day())) != 0
+  dow := cs.dow & (1 << uint(t.Weekday())) != 0
+
+  if (cs.domAndDow) {
+    return dom || dow
+  }
+
+  return dom && dow
+}
+
+//
+// The first minute at or after t, and before limit, that a schedule
+//  matches. Rather than trying every minute, a field that doesn't match
+//  moves t on to the start of the next month, day, hour or minute that might.
+//
+
+func (cs *cronSchedule) nextMatch(t time.Time, limit time.Time) (time.Time, bool) {
+  for t.Before(limit) {
+    var n time.Time
+
+    y, mo, d := t.Date()
+    h, loc := t.Hour(), t.Location()
+
+    switch {
+      case cs.month & (1 << uint(mo)) == 0:
+        n = time.Date(y, mo + 1, 1, 0, 0, 0, 0, loc)
+      case !cs.dayMatches(t):
+        n = time.Date(y, mo, d + 1, 0, 0, 0, 0, loc)
+      case cs.hour & (1 << uint(h)) == 0:
+        n = time.Date(y, mo, d + 1, 0, 0, 0, 0, loc)
+        if nh := nextCronBit(cs.hour, h, 23); (nh >= 0) {
+          n = time.Date(y, mo, d, nh, 0, 0, 0, loc)
+        }
+      case cs.minute & (1 << uint(t.Minute())) == 0:
+        n = time.Date(y, mo, d, h + 1, 0, 0, 0, loc)
+        if nm := nextCronBit(cs.minute, t.Minute(), 59); (nm >= 0) {
+          n = time.Date(y, mo, d, h, nm, 0, 0, loc)
+        }
+      default:
+        return t, true
+    }
+
+    // Wall clock times repeat when the clocks go back
+    if (!n.After(t)) {
+      n = t.Add(time.Minute)
+    }
+    t = n
+  }
+
+  return t, false
+}
+
+//
+// The last minute at or before t, and after earliest, that a schedule
+//  matches, moving back a field at a time as nextMatch moves forward
+//
+
+func (cs *cronSchedule) prevMatch(t time.Time, earliest time.Time) (time.Time, bool) {
+  for t.After(earliest) {
+    var n time.Time
+
+    y, mo, d := t.Date()
+    h, loc := t.Hour(), t.Location()
+
+    switch {
+      case cs.month & (1 << uint(mo)) == 0:
+        n = time.Date(y, mo, 1, 0, 0, 0, 0, loc).Add(-time.Minute)
+      case !cs.dayMatches(t):
+        n = time.Date(y, mo, d, 0, 0, 0, 0, loc).Add(-time.Minute)
+      case cs.hour & (1 << uint(h)) == 0:
+        n = time.Date(y, mo, d, 0, 0, 0, 0, loc).Add(-time.Minute)
+        if ph := prevCronBit(cs.hour, h); (ph >= 0) {
+          n = time.Date(y, mo, d, ph, 59, 0, 0, loc)
+        }
+      case cs.minute & (1 << uint(t.Minute())) == 0:
+        n = time.Date(y, mo, d, h, 0, 0, 0, loc).Add(-time.Minute)
+        if pm := prevCronBit(cs.minute, t.Minute()); (pm >= 0) {
+          n = time.Date(y, mo, d, h, pm, 0, 0, loc)
+        }
+      default:
+        return t, true
+    }
+
+    if (!n.Before(t)) {
+      n = t.Add(-time.Minute)
+    }
+    t = n
+  }
+
+  return t, false
+}
+
+//
+// The first bit set in bits above v and no higher than max, or -1
+//
+
+func nextCronBit(bits uint64, v int, max int) int {
+  for v++; v <= max; v++ {
+    if (bits & (1 << uint(v)) != 0) {
+      return v
+    }
+  }
+
+  return -1
+}
+
+//
+// The last bit set in bits below v, or -1
+//
+
+func prevCronBit(bits uint64, v int) int {
+  for v--; v >= 0; v-- {
+    if (bits & (1 << uint(v)) != 0) {
+      return v
+    }
+  }
+
+  return -1
+}
+
+//
+// Check a window's fields and fill in its schedule
+//
+
+func (mw *Maintenance) prepare() error {
+  var err error
+
+  if (len(mw.Hosts) == 0) {
+    return fmt.Errorf("maintenance needs hosts")
+  }
+
+  for _, p := range mw.Hosts {
+    g, isGroup := strings.CutPrefix(p, "@")
+    switch {
+      case isGroup && (findHostgroup(g) == nil):
+        return fmt.Errorf("no such hostgroup %s", g)
+      case !isGroup:
+        _, err = path.Match(p, "")
+        if (err != nil) {
+          return fmt.Errorf("bad pattern %s", p)
+        }
+    }
+  }
+
+  if (mw.Cron == "") {
+    if ((mw.Start == 0) || (mw.End <= mw.Start)) {
+      return fmt.Errorf("maintenance needs a start and a later end, or a cron expression and duration")
+    }
+    if (mw.Duration != "") {
+      return fmt.Errorf("a duration is only for recurring maintenance")
+    }
+    return nil
+  }
+
+  mw.sched, err = parseCron(mw.Cron)
+  if (err != nil) {
+    return err
+  }
+
+  mw.dur, err = time.ParseDuration(mw.Duration)
+  if ((err != nil) || (mw.dur < time.Minute) || (mw.dur > maxMaintenanceDuration)) {
+    return fmt.Errorf("recurring maintenance needs a duration between 1m and %v", maxMaintenanceDuration)
+  }
+
+  if ((mw.End != 0) && (mw.End <= mw.Start)) {
+    return fmt.Errorf("maintenance end must be after its start")
+  }
+
+  return nil
+}
+
+func (mw *Maintenance) String() string {
+  s := strings.Join(mw.Hosts, ",")
+
+  if (mw.Cron == "") {
+    return s + " from " + time.Unix(mw.Start, 0).Format(time.RFC3339) + " to " + time.Unix(mw.End, 0).Format(time.RFC3339)
+  }
+
+  return s + " cron " + mw.Cron + " for " + mw.Duration
+}
+
+//
+// The occurrence of a window in effect at now, if there is one
+//
+
+func (mw *Maintenance) current(now time.Time) (int64, int64, bool) {
+  if (mw.sched == nil) {
+    return mw.Start, mw.End, (now.Unix() >= mw.Start) && (now.Unix() < mw.End)
+  }
+
+  // The latest start no longer ago than the duration, and before the end
+  t := now.Truncate(time.Minute)
+  if ((mw.End != 0) && (t.Unix() >= mw.End)) {
+    t = time.Unix(mw.End - 1, 0).In(now.Location()).Truncate(time.Minute)
+  }
+
+  t, ok := mw.sched.prevMatch(t, now.Add(-mw.dur))
+  if ((!ok) || (!mw.within(t))) {
+    return 0, 0, false
+  }
+
+  return t.Unix(), t.Add(mw.dur).Unix(), true
+}
+
+//
+// The next occurrence of a window to start after now, looking a year ahead
+//
+
+func (mw *Maintenance) next(now time.Time) (int64, int64, bool) {
+  if (mw.sched == nil) {
+    return mw.Start, mw.End, now.Unix() < mw.Start
+  }
+
+  // From the first minute after now, and not before the start
+  t := now.Truncate(time.Minute).Add(time.Minute)
+  if (t.Unix() < mw.Start) {
+    t = time.Unix(mw.Start + 59, 0).In(now.Location()).Truncate(time.Minute)
+  }
+
+  last := now.AddDate(1, 0, 0)
+  if ((mw.End != 0) && (mw.End < last.Unix())) {
+    last = time.Unix(mw.End, 0)
+  }
+
+  t, ok := mw.sched.nextMatch(t, last)
+  if (!ok) {
+    return 0, 0, false
+  }
+
+  return t.Unix(), t.Add(mw.dur).Unix(), true
+}
+
+//
+// Whether a recurring window may start at t
+//
+
+func (mw *Maintenance) within(t time.Time) bool {
+  return ((mw.Start == 0) || (t.Unix() >= mw.Start)) && ((mw.End == 0) || (t.Unix() < mw.End))
+}
+
+//
+// Whether a window is over for good
+//
+
+func (mw *Maintenance) over(now time.Time) bool {
+  if (mw.sched == nil) {
+    return now.Unix() >= mw.End
+  }
+
+  return (mw.End != 0) && (now.Unix() >= mw.End + int64(mw.dur/time.Second))
+}
+
+//
+// The window a host is in at now, or nil
+//
+
+func maintenanceFor(host string, now time.Time) *Maintenance {
+  maintMu.Lock()
+  defer maintMu.Unlock()
+
+  for _, mw := range maintenances {
+    if (!matchHost(host, mw.Hosts)) {
+      continue
+    }
+    if _, _, ok := mw.current(now); ok {
+      return mw
+    }
+  }
+
+  return nil
+}
+
+//
+// Parse the fields of a maintenance line, less the leading "maintenance"
+//
+
+func addConfigMaintenance(fields []string) error {
+  var ok bool
+
+  if (len(fields) < 5) {
+    return fmt.Errorf("maintenance needs hosts, and from and to times or a cron expression and duration")
+  }
+
+  mw := &Maintenance{ID: "config-" + strconv.Itoa(len(maintenances) + 1), Hosts: strings.Split(fields[0], ","), By: "configuration"}
+
+  switch {
+    case (fields[1] == "from") && (len(fields) == 5) && (fields[3] == "to"):
+      mw.Start, ok = parseHistoryTime(fields[2])
+      if (ok) {
+        mw.End, ok = parseHistoryTime(fields[4])
+      }
+      if (!ok) {
+        return fmt.Errorf("maintenance: bad time %s or %s", fields[2], fields[4])
+      }
+    case (fields[1] == "cron") && (len(fields) == 9) && (fields[7] == "for"):
+      mw.Cron, mw.Duration = strings.Join(fields[2:7], " "), fields[8]
+    default:
+      return fmt.Errorf("maintenance: expected hosts from time to time, or hosts cron m h dom mon dow for duration")
+  }
+
+  // Hostgroups are checked once the whole file has been read
+  maintenances = append(maintenances, mw)
+
+  return nil
+}
+
+//
+// Once the configuration file has been read, check the configured windows
+//
+
+func checkMaintenance() error {
+  for _, mw := range maintenances {
+    err := mw.prepare()
+    if (err != nil) {
+      return fmt.Errorf("maintenance %s: %v", strings.Join(mw.Hosts, ","), err)
+    }
+  }
+
+  return nil
+}
+
+//
+// Add the windows kept in the store to those from the configuration file
+//
+
+func loadMaintenance() error {
+  ws, err := store.ListMaintenance()
+  if (err != nil) {
+    return err
+  }
+
+  maintMu.Lock()
+  defer maintMu.Unlock()
+
+  for i := range ws {
+    mw := ws[i]
+
+    err = mw.prepare()
+    if (err != nil) {
+      log.Printf("Ignoring maintenance window %s: %v\n", mw.ID, err)
+      continue
+    }
+
+    maintenances = append(maintenances, &mw)
+  }
+
+  return nil
+}
+
+//
+// Windows that aren't over, for hosts matching host if it isn't empty, with
+//  whether each is in effect and when it next starts
+//
+
+func listMaintenance(host string, now time.Time) []Maintenance {
+  maintMu.Lock()
+  defer maintMu.Unlock()
+
+  out := make([]Maintenance, 0)
+
+  for _, mw := range maintenances {
+    if (mw.over(now) || ((host != "") && (!matchHost(host, mw.Hosts)))) {
+      continue
+    }
+
+    m := *mw
+
+    if s, e, ok := mw.current(now); ok {
+      m.Active, m.NextStart, m.NextEnd = true, s, e
+    } else if s, e, ok := mw.next(now); ok {
+      m.NextStart, m.NextEnd = s, e
+    }
+
+    out = append(out, m)
+  }
+
+  sort.SliceStable(out, func(i int, j int) bool {
+    if (out[i].Active != out[j].Active) {
+      return out[i].Active
+    }
+    return out[i].NextStart < out[j].NextStart
+  })
+
+  return out
+}
+
+//
+// Handle a connection to /maintenance/. Adding and removing windows takes
+//  the admin token, like /token/.
+//
+//  /maintenance/       GET -> windows that aren't over, ?host= for one host's
+//                      POST -> add {"Hosts", "Start", "End", "Cron",
+//                              "Duration", "Comment"}
+//  /maintenance/id     DELETE -> remove a window added through the API
+//
+
+func task_handle_maintenance(w http.ResponseWriter, r *http.Request) {
+  id := r.URL.Path[len("/maintenance/"):]
+
+  switch {
+    case (id == "") && (r.Method == "GET"):
+      host := r.URL.Query().Get("host")
+      if ((host != "") && (!validHostname(host))) {
+        http.Error(w, "Invalid host name " + host, http.StatusBadRequest)
+        return
+      }
+      writeAlertJSON(w, listMaintenance(host, time.Now()))
+      return
+    case (id == "") && (r.Method != "POST"):
+      w.Header().Set("Allow", "GET, POST")
+      http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+      return
+    case (id != "") && (r.Method != "DELETE"):
+      w.Header().Set("Allow", "DELETE")
+      http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+      return
+  }
+
+  if (!adminAuthorized(r)) {
+    log.Printf("Rejected maintenance change from %s\n", r.RemoteAddr)
+    w.Header().Set("WWW-Authenticate", "Bearer")
+    http.Error(w, "Admin token required", http.StatusUnauthorized)
+    return
+  }
+
+  if (r.Method == "DELETE") {
+    err := removeMaintenance(id)
+    switch {
+      case err == errNoMaintenance:
+        http.Error(w, "No maintenance window " + id + " added through the API", http.StatusNotFound)
+      case err != nil:
+        log.Printf("Failed removing maintenance window %s: %v\n", id, err)
+        http.Error(w, "Fatal attempting to remove maintenance window " + id, http.StatusInternalServerError)
+      default:
+        log.Printf("Maintenance window %s removed from %s\n", id, r.RemoteAddr)
+        w.WriteHeader(http.StatusNoContent)
+    }
+    return
+  }
+
+  var req struct {
+    Hosts []string
+    Start string
+    End string
+    Cron string
+    Duration string
+    Comment string
+  }
+
+  body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+  if (err == nil) {
+    err = strictUnmarshal(body, &req)
+  }
+  if (err != nil) {
+    http.Error(w, "Bad request: " + err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  mw := Maintenance{Hosts: req.Hosts, Cron: req.Cron, Duration: req.Duration, Comment: req.Comment, By: r.RemoteAddr}
+
+  for _, t := range []struct {
+    s string
+    v *int64
+  }{{req.Start, &mw.Start}, {req.End, &mw.End}} {
+    if (t.s == "") {
+      continue
+    }
+
+    var ok bool
+
+    *t.v, ok = parseHistoryTime(t.s)
+    if (!ok) {
+      http.Error(w, "Bad request: bad time " + t.s, http.StatusBadRequest)
+      return
+    }
+  }
+
+  err = mw.prepare()
+  if (err != nil) {
+    http.Error(w, "Bad request: " + err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  mw, err = addMaintenance(mw)
+  if (err != nil) {
+    log.Printf("Failed adding maintenance window: %v\n", err)
+    http.Error(w, "Fatal attempting to add maintenance window", http.StatusInternalServerError)
+    return
+  }
+
+  log.Printf("Maintenance window %s for %s added from %s\n", mw.ID, strings.Join(mw.Hosts, ","), r.RemoteAddr)
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+
+  err = json.NewEncoder(w).Encode(mw)
+  if (err != nil) {
+    log.Printf("Failed writing maintenance window: %v\n", err)
+  }
+}
+
+func addMaintenance(mw Maintenance) (Maintenance, error) {
+  id, err := store.AddMaintenance(mw)
+  if (err != nil) {
+    return mw, err
+  }
+
+  mw.ID = strconv.FormatInt(id, 10)
+
+  maintMu.Lock()
+  maintenances = append(maintenances, &mw)
+  maintMu.Unlock()
+
+  return mw, nil
+}
+
+//
+// Remove a window added through the API; those in the configuration file
+//  stay until it is changed
+//
+
+func removeMaintenance(id string) error {
+  n, err := strconv.ParseInt(id, 10, 64)
+  if (err != nil) {
+    return errNoMaintenance
+  }
+
+  maintMu.Lock()
+  defer maintMu.Unlock()
+
+  for i, mw := range maintenances {
+    if (mw.ID != id) {
+      continue
+    }
+
+    err = store.DeleteMaintenance(n)
+    if (err != nil) {
+      return err
+    }
+
+    maintenances = append(maintenances[:i], maintenances[i+1:]...)
+
+    return nil
+  }
+
+  return errNoMaintenance
+}
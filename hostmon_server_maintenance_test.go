@@ -0,0 +1,182 @@
+//
+// Host monitor data collection server, maintenance window tests
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestParseCron(t *testing.T) {
+  tests := []struct {
+    expr string
+    err string
+  }{
+    {"0 2 * * 0", ""},
+    {"*/15 8-17 * * 1-5", ""},
+    {"0 0 1,15 * *", ""},
+    {"0 0 29 2 *", ""},
+    {"0 0 31 2 1", ""},
+    {"0 0 31 1-12 *", ""},
+    {"0 0 * * 7", ""},
+    {"0 0 * *", "five fields"},
+    {"60 * * * *", "out of range"},
+    {"* 24 * * *", "out of range"},
+    {"* * 0 * *", "out of range"},
+    {"* * * 13 *", "out of range"},
+    {"* * * * 8", "out of range"},
+    {"5-1 * * * *", "out of range"},
+    {"*/0 * * * *", "bad step"},
+    {"x * * * *", "bad value"},
+    {"0 0 30 2 *", "never matches"},
+    {"0 0 31 2 *", "never matches"},
+    {"0 0 31 4,6,9,11 *", "never matches"},
+    {"0 0 30,31 2 *", "never matches"},
+  }
+
+  for _, tt := range tests {
+    _, err := parseCron(tt.expr)
+
+    switch {
+      case (tt.err == "") && (err != nil):
+        t.Errorf("%q: unexpected error %v", tt.expr, err)
+      case (tt.err != "") && ((err == nil) || (!strings.Contains(err.Error(), tt.err))):
+        t.Errorf("%q: got error %v, want one containing %q", tt.expr, err, tt.err)
+    }
+  }
+}
+
+func TestCronMatches(t *testing.T) {
+  // Monday 2 November 2026
+  mon := time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC)
+  first := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+  sun := time.Date(2026, 11, 8, 0, 0, 0, 0, time.UTC)
+
+  tests := []struct {
+    expr string
+    t time.Time
+    want bool
+  }{
+    {"0 0 1 * *", first, true},
+    {"0 0 1 * *", mon, false},
+    {"0 0 * * 1", mon, true},
+    {"0 0 * * 1", first, false},
+    // With both days given, either will do
+    {"0 0 1 * 1", mon, true},
+    {"0 0 1 * 1", first, true},
+    {"0 0 1 * 1", sun, false},
+    // And a day of the month restricted by a step is still restricted
+    {"0 0 */2 * 1", mon, true},
+    {"0 0 * * 0", sun, true},
+    {"0 0 * * 7", sun, true},
+    {"0 0 * * 7", mon, false},
+    {"0 0 * * 1-5", sun, false},
+    {"30 0 * * *", mon, false},
+    {"0 1 * * *", mon, false},
+    {"0 0 * 10 *", mon, false},
+  }
+
+  for _, tt := range tests {
+    cs, err := parseCron(tt.expr)
+    if (err != nil) {
+      t.Fatalf("%q: %v", tt.expr, err)
+    }
+
+    if (cs.matches(tt.t) != tt.want) {
+      t.Errorf("%q at %v: got %v, want %v", tt.expr, tt.t, !tt.want, tt.want)
+    }
+  }
+}
+
+//
+// The occurrences of a window found by trying every minute, to check
+//  current and next against
+//
+
+func minuteByMinute(mw *Maintenance, now time.Time) (int64, int64, bool, int64, int64, bool) {
+  var cs, ce, ns, ne int64
+  var cok, nok bool
+
+  t := now.Truncate(time.Minute)
+  for earliest := now.Add(-mw.dur); t.After(earliest); t = t.Add(-time.Minute) {
+    if (mw.sched.matches(t) && mw.within(t)) {
+      cs, ce, cok = t.Unix(), t.Add(mw.dur).Unix(), true
+      break
+    }
+  }
+
+  t = now.Truncate(time.Minute).Add(time.Minute)
+  for last := now.AddDate(1, 0, 0); t.Before(last); t = t.Add(time.Minute) {
+    if ((mw.End != 0) && (t.Unix() >= mw.End)) {
+      break
+    }
+    if (mw.sched.matches(t) && mw.within(t)) {
+      ns, ne, nok = t.Unix(), t.Add(mw.dur).Unix(), true
+      break
+    }
+  }
+
+  return cs, ce, cok, ns, ne, nok
+}
+
+func TestMaintenanceOccurrences(t *testing.T) {
+  loc, err := time.LoadLocation("America/Detroit")
+  if (err != nil) {
+    loc = time.UTC
+  }
+
+  windows := []struct {
+    cron string
+    dur string
+    start int64
+    end int64
+  }{
+    {"0 2 * * 0", "4h", 0, 0},
+    {"*/15 8-17 * * 1-5", "10m", 0, 0},
+    {"30 23 31 * *", "2h", 0, 0},
+    {"0 0 1 * 1", "168h", 0, 0},
+    {"0 0 29 2 *", "24h", 0, 0},
+    {"0 2 * * *", "168h", 0, 0},
+    {"59 23 * 12 6", "1m", 0, 0},
+    {"0 3 * * *", "1h", time.Date(2026, 11, 10, 0, 0, 0, 0, loc).Unix(), time.Date(2026, 11, 20, 0, 0, 0, 0, loc).Unix()},
+    {"0 3 * * *", "6h", time.Date(2026, 10, 1, 12, 0, 30, 0, loc).Unix(), time.Date(2026, 10, 25, 5, 0, 0, 0, loc).Unix()},
+  }
+
+  // Either side of the end of daylight saving time, month and year ends
+  nows := []time.Time{
+    time.Date(2026, 10, 18, 12, 34, 56, 0, loc),
+    time.Date(2026, 11, 1, 1, 30, 0, 0, loc),
+    time.Date(2026, 11, 1, 3, 0, 0, 0, loc),
+    time.Date(2026, 11, 15, 4, 0, 0, 0, loc),
+    time.Date(2026, 12, 31, 23, 59, 30, 0, loc),
+    time.Date(2027, 3, 14, 2, 30, 0, 0, loc),
+    time.Date(2028, 2, 29, 12, 0, 0, 0, loc),
+  }
+
+  for _, w := range windows {
+    mw := &Maintenance{Hosts: []string{"db*"}, Cron: w.cron, Duration: w.dur, Start: w.start, End: w.end}
+
+    err := mw.prepare()
+    if (err != nil) {
+      t.Fatalf("%s: %v", w.cron, err)
+    }
+
+    for _, now := range nows {
+      cs, ce, cok, ns, ne, nok := minuteByMinute(mw, now)
+
+      s, e, ok := mw.current(now)
+      if ((s != cs) || (e != ce) || (ok != cok)) {
+        t.Errorf("%s at %v: current %v %v %v, want %v %v %v", mw, now, s, e, ok, cs, ce, cok)
+      }
+
+      s, e, ok = mw.next(now)
+      if ((s != ns) || (e != ne) || (ok != nok)) {
+        t.Errorf("%s at %v: next %v %v %v, want %v %v %v", mw, now, s, e, ok, ns, ne, nok)
+      }
+    }
+  }
+}
@@ -0,0 +1,786 @@
+//
+// Host monitor data collection server, notification channels
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "bytes"
+  "crypto/tls"
+  "encoding/json"
+  "fmt"
+  "io"
+  "log"
+  "log/syslog"
+  "mime"
+  "mime/multipart"
+  "mime/quotedprintable"
+  "net"
+  "net/http"
+  "net/mail"
+  "net/smtp"
+  "net/textproto"
+  "os"
+  "strconv"
+  "strings"
+  "text/template"
+  "time"
+)
+
+//
+// A notification about one alert. Kind is firing, repeat, escalated or
+//  recovered, or digest for a batch of them, which are then in Digest.
+//  Subject, Body and HTML come from the templates; To and Cc are the
+//  recipients the routes add, if any.
+//
+
+type Notification struct {
+  Kind string
+  Subject string
+  Body string
+  HTML string `json:"-"`
+  Alert Alert
+  Host *Message `json:",omitempty"`
+  Groups []string `json:",omitempty"`
+  Count int `json:",omitempty"`
+  Digest []DigestGroup `json:",omitempty"`
+  To []string `json:"-"`
+  Cc []string `json:"-"`
+}
+
+//
+// Something that can deliver notifications
+//
+
+type Notifier interface {
+  Notify(n *Notification) error
+}
+
+//
+// Notification channels are declared in the configuration file as
+//
+//  notifier name type [option=value ...]
+//
+//  smtp     relay= (default localhost), port= (default 25), starttls=true to
+//           require STARTTLS, user= and pass= to authenticate, from=, and to=
+//           and cc= (comma separated); from and to default to eMailFrom and
+//           eMailTo
+//  webhook  url=, and template= a file holding a text/template for the JSON
+//           body (default the notification itself as JSON)
+//  slack    url= of a Slack or Mattermost incoming webhook, and optionally
+//           channel= and username=
+//  syslog   facility= (default daemon), tag= (default hostmon), and
+//           server= as udp:host:port or tcp:host:port to log remotely
+//  any      digest= and digestmax= to batch notifications into digests
+//
+// and alerts are sent to them by
+//
+//  route name [severity=info,warning,critical] [hosts=pattern,@group,...]
+//    [to=address,...] [cc=address,...]
+//
+// Each notifier gets an alert if any of its routes match it. For smtp
+//  notifiers, the to= and cc= of the matching routes replace the notifier's
+//  own recipients. A notifier with no routes gets every alert, and with no
+//  notifiers declared at all alerts go by e-mail to eMailTo through the local
+//  mail server, as they always have.
+//
+
+//
+// n is what alerts are handed to: the outbox, in front of a digest if the
+//  notifier has one, and then the backend itself
+//
+
+type namedNotifier struct {
+  name string
+  kind string
+  n Notifier
+  backend Notifier
+  routes []*notifyRoute
+}
+
+type notifyRoute struct {
+  severities map[string]bool
+  hosts []string
+  to []string
+  cc []string
+}
+
+// In the order they were declared
+var g_notifiers []*namedNotifier
+
+// Routes by notifier name, until the notifiers have all been read
+var pendingRoutes = make(map[string][]*notifyRoute)
+
+// How long webhooks get to answer
+const webhookTimeout = 10*time.Second
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+//
+// Parse the fields of a notifier line, less the leading "notifier"
+//
+
+func parseNotifier(fields []string) (*namedNotifier, error) {
+  if (len(fields) < 2) {
+    return nil, fmt.Errorf("notifier needs a name and a type")
+  }
+
+  nn := &namedNotifier{name: fields[0], kind: fields[1]}
+
+  if (!validCheckName(nn.name)) {
+    return nil, fmt.Errorf("bad notifier name %s", nn.name)
+  }
+
+  for _, o := range g_notifiers {
+    if (o.name == nn.name) {
+      return nil, fmt.Errorf("more than one notifier named %s", nn.name)
+    }
+  }
+
+  opts := make(map[string]string)
+  for _, opt := range fields[2:] {
+    k, v, ok := strings.Cut(opt, "=")
+    if ((!ok) || (v == "")) {
+      return nil, fmt.Errorf("notifier %s: option %s needs a value", nn.name, opt)
+    }
+    opts[k] = v
+  }
+
+  var err error
+
+  switch nn.kind {
+    case "smtp":
+      nn.n, err = newSMTPNotifier(opts)
+    case "webhook":
+      nn.n, err = newWebhookNotifier(opts)
+    case "slack", "mattermost":
+      nn.n, err = newSlackNotifier(opts)
+    case "syslog":
+      nn.n, err = newSyslogNotifier(opts)
+    default:
+      err = fmt.Errorf("unknown type")
+  }
+
+  if (err == nil) {
+    on := &outboxNotifier{name: nn.name, inner: nn.n}
+    on.digest, err = newDigestNotifier(nn.name, nn.n, opts)
+    nn.n, nn.backend = on, on.inner
+  }
+
+  if (err != nil) {
+    return nil, fmt.Errorf("notifier %s %s: %v", nn.name, nn.kind, err)
+  }
+
+  // Anything left over wasn't understood
+  for k := range opts {
+    return nil, fmt.Errorf("notifier %s %s: unknown option %s", nn.name, nn.kind, k)
+  }
+
+  return nn, nil
+}
+
+//
+// Take an option out of a notifier's options, so that whatever is left at
+//  the end wasn't understood
+//
+
+func takeOpt(opts map[string]string, k string, def string) string {
+  v, ok := opts[k]
+  if (!ok) {
+    return def
+  }
+
+  delete(opts, k)
+
+  return v
+}
+
+//
+// Parse the fields of a route line, less the leading "route"
+//
+
+func addRoute(fields []string) error {
+  if (len(fields) < 1) {
+    return fmt.Errorf("route needs a notifier name")
+  }
+
+  rt := &notifyRoute{}
+
+  for _, opt := range fields[1:] {
+    k, v, ok := strings.Cut(opt, "=")
+    if ((!ok) || (v == "")) {
+      return fmt.Errorf("route %s: option %s needs a value", fields[0], opt)
+    }
+
+    switch k {
+      case "severity":
+        rt.severities = make(map[string]bool)
+        for _, s := range strings.Split(v, ",") {
+          if (!ruleSeverities[s]) {
+            return fmt.Errorf("route %s: bad severity %s", fields[0], s)
+          }
+          rt.severities[s] = true
+        }
+      case "hosts":
+        rt.hosts = strings.Split(v, ",")
+      case "to", "cc":
+        addrs, err := parseAddresses(v)
+        if (err != nil) {
+          return fmt.Errorf("route %s: %v", fields[0], err)
+        }
+        if (k == "to") {
+          rt.to = addrs
+        } else {
+          rt.cc = addrs
+        }
+      default:
+        return fmt.Errorf("route %s: unknown option %s", fields[0], k)
+    }
+  }
+
+  pendingRoutes[fields[0]] = append(pendingRoutes[fields[0]], rt)
+
+  return nil
+}
+
+//
+// Check a comma separated list of e-mail addresses
+//
+
+func parseAddresses(s string) ([]string, error) {
+  var addrs []string
+
+  for _, a := range strings.Split(s, ",") {
+    ma, err := mail.ParseAddress(a)
+    if (err != nil) {
+      return nil, fmt.Errorf("bad address %s", a)
+    }
+    addrs = append(addrs, ma.Address)
+  }
+
+  return addrs, nil
+}
+
+//
+// Once the configuration file has been read, attach routes to their
+//  notifiers, and fall back on e-mail to eMailTo if there are none
+//
+
+func setupNotifiers(have map[string]bool) error {
+  if (len(g_notifiers) == 0) {
+    if ((!have["eMailTo"]) || (!have["eMailFrom"])) {
+      return fmt.Errorf("missing configuration directive eMailTo or eMailFrom, needed when no notifier is declared")
+    }
+
+    n, _ := newSMTPNotifier(map[string]string{})
+    g_notifiers = append(g_notifiers, &namedNotifier{name: "email", kind: "smtp", n: &outboxNotifier{name: "email", inner: n}, backend: n})
+  }
+
+  for name, routes := range pendingRoutes {
+    nn := findNotifier(name)
+    if (nn == nil) {
+      return fmt.Errorf("route: no notifier named %s", name)
+    }
+
+    for _, rt := range routes {
+      for _, p := range rt.hosts {
+        if g, ok := strings.CutPrefix(p, "@"); ok && (findHostgroup(g) == nil) {
+          return fmt.Errorf("route %s: no such hostgroup %s", name, g)
+        }
+      }
+    }
+
+    nn.routes = routes
+  }
+
+  for _, nn := range g_notifiers {
+    sn, ok := nn.backend.(*smtpNotifier)
+    if (!ok) {
+      continue
+    }
+
+    if (sn.from == "") {
+      sn.from = g_eMailFrom
+    }
+    if ((len(sn.to) == 0) && (g_eMailTo != "")) {
+      to, err := parseAddresses(g_eMailTo)
+      if (err != nil) {
+        return fmt.Errorf("eMailTo: %v", err)
+      }
+      sn.to = to
+    }
+
+    if ((sn.from == "") || (len(sn.to) == 0)) {
+      return fmt.Errorf("notifier %s: needs from= and to=, or eMailFrom and eMailTo", nn.name)
+    }
+  }
+
+  return nil
+}
+
+func findNotifier(name string) *namedNotifier {
+  for _, nn := range g_notifiers {
+    if (nn.name == name) {
+      return nn
+    }
+  }
+
+  return nil
+}
+
+//
+// Whether a notifier should get an alert, and the recipients the matching
+//  routes add
+//
+
+func (nn *namedNotifier) wants(a *Alert) (bool, []string, []string) {
+  var to, cc []string
+
+  if (len(nn.routes) == 0) {
+    return true, nil, nil
+  }
+
+  matched := false
+
+  for _, rt := range nn.routes {
+    if ((rt.severities != nil) && (!rt.severities[a.Severity])) {
+      continue
+    }
+    if ((len(rt.hosts) != 0) && (!matchHost(a.Hostname, rt.hosts))) {
+      continue
+    }
+    matched = true
+    to = appendNew(to, rt.to)
+    cc = appendNew(cc, rt.cc)
+  }
+
+  return matched, to, cc
+}
+
+func appendNew(list []string, more []string) []string {
+  for _, m := range more {
+    seen := false
+    for _, l := range list {
+      seen = seen || (l == m)
+    }
+    if (!seen) {
+      list = append(list, m)
+    }
+  }
+
+  return list
+}
+
+func (nn *namedNotifier) String() string {
+  s := nn.name + " (" + nn.kind + ")"
+
+  if on, ok := nn.n.(*outboxNotifier); (ok && (on.digest != nil)) {
+    s += fmt.Sprintf(" digest %v max %d", on.digest.interval, on.digest.max)
+  }
+
+  if (len(nn.routes) == 0) {
+    return s + ": every alert"
+  }
+
+  return fmt.Sprintf("%s: %d routes", s, len(nn.routes))
+}
+
+//
+// Send a notification to every notifier routed to get it
+//
+
+func dispatchNotification(n *Notification) {
+  for _, nn := range g_notifiers {
+    ok, to, cc := nn.wants(&n.Alert)
+    if (!ok) {
+      continue
+    }
+
+    nc := *n
+    nc.To, nc.Cc = to, cc
+
+    err := nn.n.Notify(&nc)
+    if (err != nil) {
+      log.Printf("Failed sending notification for %s on %s to %s: %v\n", n.Alert.Check, n.Alert.Hostname, nn.name, err)
+    }
+  }
+}
+
+//
+// SMTP
+//
+
+type smtpNotifier struct {
+  relay string
+  port string
+  starttls bool
+  user string
+  pass string
+  from string
+  to []string
+  cc []string
+}
+
+func newSMTPNotifier(opts map[string]string) (*smtpNotifier, error) {
+  var err error
+
+  sn := &smtpNotifier{
+    relay: takeOpt(opts, "relay", "localhost"),
+    port: takeOpt(opts, "port", "25"),
+    user: takeOpt(opts, "user", ""),
+    pass: takeOpt(opts, "pass", ""),
+    from: takeOpt(opts, "from", ""),
+  }
+
+  if p, err := strconv.Atoi(sn.port); (err != nil) || (p < 1) || (p > 65535) {
+    return nil, fmt.Errorf("bad port %s", sn.port)
+  }
+
+  sn.starttls, err = strconv.ParseBool(takeOpt(opts, "starttls", "false"))
+  if (err != nil) {
+    return nil, fmt.Errorf("starttls must be true or false")
+  }
+
+  if ((sn.user != "") && (sn.pass == "")) {
+    return nil, fmt.Errorf("user needs pass")
+  }
+
+  if (sn.from != "") {
+    _, err = mail.ParseAddress(sn.from)
+    if (err != nil) {
+      return nil, fmt.Errorf("bad address %s", sn.from)
+    }
+  }
+
+  if t := takeOpt(opts, "to", ""); t != "" {
+    sn.to, err = parseAddresses(t)
+    if (err != nil) {
+      return nil, err
+    }
+  }
+
+  if c := takeOpt(opts, "cc", ""); c != "" {
+    sn.cc, err = parseAddresses(c)
+    if (err != nil) {
+      return nil, err
+    }
+  }
+
+  return sn, nil
+}
+
+func (sn *smtpNotifier) Notify(n *Notification) error {
+  to, cc := sn.to, sn.cc
+  if ((len(n.To) != 0) || (len(n.Cc) != 0)) {
+    to, cc = n.To, n.Cc
+  }
+
+  msg, err := mimeMessage(sn.from, to, cc, n)
+  if (err != nil) {
+    return err
+  }
+
+  // The notifier's own lists are shared between goroutines, so copy first
+  rcpt := append(append([]string(nil), to...), cc...)
+
+  return sn.send(rcpt, msg)
+}
+
+//
+// An RFC 5322 message with the plain text and HTML bodies as
+//  multipart/alternative parts
+//
+
+func mimeMessage(from string, to []string, cc []string, n *Notification) ([]byte, error) {
+  var buf bytes.Buffer
+
+  id, err := newToken()
+  if (err != nil) {
+    return nil, err
+  }
+
+  domain := "localhost"
+  if _, d, ok := strings.Cut(from, "@"); ok {
+    domain = d
+  }
+
+  addrList := func(addrs []string) string {
+    var l []string
+    for _, a := range addrs {
+      l = append(l, (&mail.Address{Address: a}).String())
+    }
+    return strings.Join(l, ", ")
+  }
+
+  body := &bytes.Buffer{}
+  mw := multipart.NewWriter(body)
+
+  fmt.Fprintf(&buf, "From: %s\r\n", (&mail.Address{Address: from}).String())
+  fmt.Fprintf(&buf, "To: %s\r\n", addrList(to))
+  if (len(cc) != 0) {
+    fmt.Fprintf(&buf, "Cc: %s\r\n", addrList(cc))
+  }
+  fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", n.Subject))
+  fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+  fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", id[:32], domain)
+  fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+  fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+  parts := []struct{ ctype string; text string }{{"text/plain", n.Body}, {"text/html", n.HTML}}
+
+  for _, p := range parts {
+    h := make(textproto.MIMEHeader)
+    h.Set("Content-Type", p.ctype + "; charset=utf-8")
+    h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+    pw, err := mw.CreatePart(h)
+    if (err != nil) {
+      return nil, err
+    }
+
+    qw := quotedprintable.NewWriter(pw)
+    _, err = qw.Write([]byte(strings.ReplaceAll(p.text, "\n", "\r\n")))
+    if (err == nil) {
+      err = qw.Close()
+    }
+    if (err != nil) {
+      return nil, err
+    }
+  }
+
+  err = mw.Close()
+  if (err != nil) {
+    return nil, err
+  }
+
+  buf.Write(body.Bytes())
+
+  return buf.Bytes(), nil
+}
+
+//
+// Hand a message to the relay, with STARTTLS and authentication if asked
+//  for
+//
+
+func (sn *smtpNotifier) send(rcpts []string, msg []byte) error {
+  c, err := smtp.Dial(net.JoinHostPort(sn.relay, sn.port))
+  if (err != nil) {
+    return fmt.Errorf("connecting to %s: %v", sn.relay, err)
+  }
+  defer c.Close()
+
+  if (sn.starttls) {
+    err = c.StartTLS(&tls.Config{ServerName: sn.relay})
+    if (err != nil) {
+      return fmt.Errorf("STARTTLS: %v", err)
+    }
+  }
+
+  if (sn.user != "") {
+    err = c.Auth(smtp.PlainAuth("", sn.user, sn.pass, sn.relay))
+    if (err != nil) {
+      return fmt.Errorf("authenticating: %v", err)
+    }
+  }
+
+  err = c.Mail(sn.from)
+  if (err != nil) {
+    return fmt.Errorf("MAIL FROM: %v", err)
+  }
+
+  for _, t := range rcpts {
+    err = c.Rcpt(t)
+    if (err != nil) {
+      return fmt.Errorf("RCPT TO %s: %v", t, err)
+    }
+  }
+
+  wc, err := c.Data()
+  if (err != nil) {
+    return fmt.Errorf("DATA: %v", err)
+  }
+
+  _, err = wc.Write(msg)
+  if (err != nil) {
+    return fmt.Errorf("writing message: %v", err)
+  }
+
+  err = wc.Close()
+  if (err != nil) {
+    return fmt.Errorf("sending message: %v", err)
+  }
+
+  return c.Quit()
+}
+
+//
+// Generic webhook, POSTing JSON
+//
+
+type webhookNotifier struct {
+  url string
+  tmpl *template.Template
+}
+
+func newWebhookNotifier(opts map[string]string) (*webhookNotifier, error) {
+  wn := &webhookNotifier{url: takeOpt(opts, "url", "")}
+
+  if (!strings.HasPrefix(wn.url, "http://") && !strings.HasPrefix(wn.url, "https://")) {
+    return nil, fmt.Errorf("needs an http or https url=")
+  }
+
+  if f := takeOpt(opts, "template", ""); f != "" {
+    text, err := os.ReadFile(f)
+    if (err != nil) {
+      return nil, err
+    }
+
+    wn.tmpl, err = template.New(f).Funcs(notifyFuncs).Parse(string(text))
+    if (err != nil) {
+      return nil, err
+    }
+  }
+
+  return wn, nil
+}
+
+func (wn *webhookNotifier) Notify(n *Notification) error {
+  var body bytes.Buffer
+  var err error
+
+  if (wn.tmpl == nil) {
+    err = json.NewEncoder(&body).Encode(n)
+  } else {
+    err = wn.tmpl.Execute(&body, n)
+    if ((err == nil) && (!json.Valid(body.Bytes()))) {
+      err = fmt.Errorf("template did not produce valid JSON")
+    }
+  }
+
+  if (err != nil) {
+    return err
+  }
+
+  return postJSON(wn.url, body.Bytes())
+}
+
+func postJSON(url string, body []byte) error {
+  resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+  if (err != nil) {
+    return err
+  }
+  defer resp.Body.Close()
+
+  io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+  if ((resp.StatusCode < 200) || (resp.StatusCode > 299)) {
+    return fmt.Errorf("%s answered %s", url, resp.Status)
+  }
+
+  return nil
+}
+
+//
+// Slack and Mattermost incoming webhooks, which take the same payload
+//
+
+type slackNotifier struct {
+  url string
+  channel string
+  username string
+}
+
+var slackColors = map[string]string{"info": "#439fe0", "warning": "warning", "critical": "danger"}
+
+func newSlackNotifier(opts map[string]string) (*slackNotifier, error) {
+  sn := &slackNotifier{url: takeOpt(opts, "url", ""), channel: takeOpt(opts, "channel", ""), username: takeOpt(opts, "username", "hostmon")}
+
+  if (!strings.HasPrefix(sn.url, "https://") && !strings.HasPrefix(sn.url, "http://")) {
+    return nil, fmt.Errorf("needs an http or https url=")
+  }
+
+  return sn, nil
+}
+
+func (sn *slackNotifier) Notify(n *Notification) error {
+  type attachment struct {
+    Fallback string `json:"fallback"`
+    Color string `json:"color"`
+    Title string `json:"title"`
+    Text string `json:"text"`
+  }
+
+  color := slackColors[n.Alert.Severity]
+  if (n.Kind == "recovered") {
+    color = "good"
+  }
+
+  payload := struct {
+    Channel string `json:"channel,omitempty"`
+    Username string `json:"username,omitempty"`
+    Attachments []attachment `json:"attachments"`
+  }{sn.channel, sn.username, []attachment{{n.Subject, color, n.Subject, n.Body}}}
+
+  body, err := json.Marshal(payload)
+  if (err != nil) {
+    return err
+  }
+
+  return postJSON(sn.url, body)
+}
+
+//
+// Syslog, local or remote
+//
+
+type syslogNotifier struct {
+  w *syslog.Writer
+}
+
+var syslogFacilities = map[string]syslog.Priority{
+  "kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL, "daemon": syslog.LOG_DAEMON,
+  "auth": syslog.LOG_AUTH, "local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+  "local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5, "local6": syslog.LOG_LOCAL6,
+  "local7": syslog.LOG_LOCAL7,
+}
+
+func newSyslogNotifier(opts map[string]string) (*syslogNotifier, error) {
+  var network, addr string
+
+  f := takeOpt(opts, "facility", "daemon")
+  facility, ok := syslogFacilities[f]
+  if (!ok) {
+    return nil, fmt.Errorf("unknown facility %s", f)
+  }
+
+  if s := takeOpt(opts, "server", ""); s != "" {
+    network, addr, ok = strings.Cut(s, ":")
+    if ((!ok) || ((network != "udp") && (network != "tcp"))) {
+      return nil, fmt.Errorf("server must be udp:host:port or tcp:host:port")
+    }
+  }
+
+  w, err := syslog.Dial(network, addr, facility|syslog.LOG_NOTICE, takeOpt(opts, "tag", "hostmon"))
+  if (err != nil) {
+    return nil, err
+  }
+
+  return &syslogNotifier{w: w}, nil
+}
+
+func (sn *syslogNotifier) Notify(n *Notification) error {
+  msg := n.Subject + ": " + strings.ReplaceAll(n.Body, "\n", " ")
+
+  switch {
+    case n.Kind == "recovered":
+      return sn.w.Notice(msg)
+    case n.Alert.Severity == "critical":
+      return sn.w.Crit(msg)
+    case n.Alert.Severity == "warning":
+      return sn.w.Warning(msg)
+  }
+
+  return sn.w.Info(msg)
+}
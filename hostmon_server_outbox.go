@@ -0,0 +1,304 @@
+//
+// Host monitor data collection server, notification outbox
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "log"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+//
+// Every message a notifier sends is written to the outbox first, then
+//  delivered. Those about hosts in maintenance are written as suppressed and
+//  not delivered. One that can't be delivered stays pending and is retried,
+//  with the wait doubling from outboxBackoff up to outboxMaxBackoff, until
+//  it has been tried outboxAttempts times, when it is marked failed.
+//  Pending messages left over from before a restart are picked up by the
+//  retry task. A notifier with a digest holds on to its messages after they
+//  have been written, and they are marked when the digest goes out.
+//
+
+const outboxAttempts = 8
+const outboxBackoff = 30*time.Second
+const outboxMaxBackoff = time.Hour
+
+// How often the retry task looks for messages that are due
+const outboxRetryInterval = 15*time.Second
+
+// How long a message's first delivery has before the retry task may take it
+//  over, should the server go down part way
+const outboxLease = 5*time.Minute
+
+const (
+  outboxPending = "pending"
+  outboxSent = "sent"
+  outboxFailed = "failed"
+  outboxSuppressed = "suppressed"
+)
+
+//
+// One message in the outbox, as returned by GET /notification/
+//
+
+type OutboxEntry struct {
+  ID int64
+  Created int64
+  Notifier string
+  Kind string
+  Hostname string
+  Check string
+  Mount string `json:",omitempty"`
+  Severity string
+  Subject string
+  Status string
+  Attempts int
+  NextAttempt int64 `json:",omitempty"`
+  LastError string `json:",omitempty"`
+  Sent int64 `json:",omitempty"`
+
+  // The notification, to send it again
+  payload []byte
+}
+
+//
+// The notification as kept in the outbox, with the parts the webhook JSON
+//  leaves out
+//
+
+type outboxPayload struct {
+  Notification *Notification
+  HTML string
+  To []string
+  Cc []string
+}
+
+//
+// Sits in front of a notifier and its digest, if it has one
+//
+
+type outboxNotifier struct {
+  name string
+  inner Notifier
+  digest *digestNotifier
+}
+
+func (on *outboxNotifier) Notify(n *Notification) error {
+  now := time.Now().Unix()
+
+  payload, err := json.Marshal(outboxPayload{Notification: n, HTML: n.HTML, To: n.To, Cc: n.Cc})
+  if (err != nil) {
+    return err
+  }
+
+  e := OutboxEntry{Created: now, Notifier: on.name, Kind: n.Kind, Hostname: n.Alert.Hostname, Check: n.Alert.Check, Mount: n.Alert.Mount,
+    Severity: n.Alert.Severity, Subject: truncate(n.Subject, 255), Status: outboxPending, NextAttempt: now + int64(outboxLease/time.Second), payload: payload}
+
+  switch {
+    case n.Alert.Maintenance != "":
+      e.Status, e.NextAttempt = outboxSuppressed, 0
+    case on.digest != nil:
+      // Not the retry task's until the digest has had its chance
+      e.NextAttempt += int64(on.digest.interval/time.Second)
+  }
+
+  e.ID, err = store.AddNotification(e)
+  if (e.Status == outboxSuppressed) {
+    return err
+  }
+  if (err != nil) {
+    // Better sent without a record than not sent at all
+    log.Printf("Failed writing notification to the outbox: %v\n", err)
+    return on.inner.Notify(n)
+  }
+
+  if (on.digest != nil) {
+    on.digest.add(e, n)
+    return nil
+  }
+
+  return deliverOutboxEntry(on.inner, e, n)
+}
+
+//
+// Try to send a message and record how it went
+//
+
+func deliverOutboxEntry(nf Notifier, e OutboxEntry, n *Notification) error {
+  err := nf.Notify(n)
+
+  recordDelivery(e, err)
+
+  return err
+}
+
+//
+// Record an attempt at sending a message, by itself or in a digest
+//
+
+func recordDelivery(e OutboxEntry, err error) {
+  now := time.Now()
+
+  e.Attempts++
+
+  switch {
+    case err == nil:
+      e.Status, e.Sent, e.NextAttempt, e.LastError = outboxSent, now.Unix(), 0, ""
+    case e.Attempts >= outboxAttempts:
+      e.Status, e.NextAttempt, e.LastError = outboxFailed, 0, truncate(err.Error(), 255)
+      log.Printf("Giving up on notification %d to %s after %d attempts\n", e.ID, e.Notifier, e.Attempts)
+    default:
+      e.NextAttempt, e.LastError = now.Add(outboxDelay(e.Attempts)).Unix(), truncate(err.Error(), 255)
+  }
+
+  uerr := store.UpdateNotification(e)
+  if (uerr != nil) {
+    log.Printf("Failed updating notification %d in the outbox: %v\n", e.ID, uerr)
+  }
+}
+
+//
+// How long to wait after a message's attempts'th failure
+//
+
+func outboxDelay(attempts int) time.Duration {
+  d := outboxBackoff
+
+  for i := 1; (i < attempts) && (d < outboxMaxBackoff); i++ {
+    d *= 2
+  }
+
+  if (d > outboxMaxBackoff) {
+    d = outboxMaxBackoff
+  }
+
+  return d
+}
+
+func truncate(s string, n int) string {
+  if (len(s) <= n) {
+    return s
+  }
+
+  return s[:n]
+}
+
+//
+// Retry outbox messages that are due
+//
+
+func task_retry_notifications() {
+  t := time.NewTicker(outboxRetryInterval)
+
+  for range t.C {
+    due, err := store.DueNotifications(time.Now().Unix())
+    if (err != nil) {
+      log.Printf("Failed reading the notification outbox: %v\n", err)
+      continue
+    }
+
+    for _, e := range due {
+      var p outboxPayload
+
+      nn := findNotifier(e.Notifier)
+
+      err = json.Unmarshal(e.payload, &p)
+      if ((err == nil) && (p.Notification == nil)) {
+        err = errors.New("empty message")
+      }
+
+      if ((nn == nil) || (err != nil)) {
+        e.Status, e.NextAttempt, e.LastError = outboxFailed, 0, "no notifier named " + e.Notifier
+        if (nn != nil) {
+          e.LastError = "unreadable message: " + err.Error()
+        }
+
+        err = store.UpdateNotification(e)
+        if (err != nil) {
+          log.Printf("Failed updating notification %d in the outbox: %v\n", e.ID, err)
+        }
+        continue
+      }
+
+      n := p.Notification
+      n.HTML, n.To, n.Cc = p.HTML, p.To, p.Cc
+
+      err = deliverOutboxEntry(nn.backend, e, n)
+      if (err != nil) {
+        log.Printf("Failed retrying notification %d to %s: %v\n", e.ID, e.Notifier, err)
+      } else {
+        log.Printf("Sent notification %d to %s on attempt %d\n", e.ID, e.Notifier, e.Attempts + 1)
+      }
+    }
+  }
+}
+
+//
+// Handle a connection to /notification/
+//
+//  /notification/    GET -> recent notifications, most recent first
+//                    ?host= for one host's, ?status=pending, sent, failed or
+//                    suppressed,
+//                    ?limit= how many (default 100, at most 1000)
+//
+
+func task_handle_notification(w http.ResponseWriter, r *http.Request) {
+  if (r.URL.Path != "/notification/") {
+    http.NotFound(w, r)
+    return
+  }
+
+  if (r.Method != "GET") {
+    w.Header().Set("Allow", "GET")
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  q := r.URL.Query()
+  host, status := q.Get("host"), q.Get("status")
+
+  if ((host != "") && (!validHostname(host))) {
+    http.Error(w, "Invalid host name " + host, http.StatusBadRequest)
+    return
+  }
+
+  if ((status != "") && (status != outboxPending) && (status != outboxSent) && (status != outboxFailed) && (status != outboxSuppressed)) {
+    http.Error(w, "Bad query: status must be pending, sent, failed or suppressed", http.StatusBadRequest)
+    return
+  }
+
+  limit := defaultHostPageSize
+  if s := q.Get("limit"); s != "" {
+    var err error
+
+    limit, err = strconv.Atoi(s)
+    if ((err != nil) || (limit < 1) || (limit > maxHostPageSize)) {
+      http.Error(w, "Bad query: limit must be between 1 and " + strconv.Itoa(maxHostPageSize), http.StatusBadRequest)
+      return
+    }
+  }
+
+  es, err := store.RecentNotifications(host, status, limit)
+  if (err != nil) {
+    log.Printf("Failed listing notifications: %v\n", err)
+    http.Error(w, "Fatal attempting to list notifications", http.StatusInternalServerError)
+    return
+  }
+
+  if (es == nil) {
+    es = make([]OutboxEntry, 0)
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+
+  err = json.NewEncoder(w).Encode(es)
+  if (err != nil) {
+    log.Printf("Failed writing notifications: %v\n", err)
+  }
+}
@@ -0,0 +1,437 @@
+//
+// Host monitor data collection server, alert rules
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "fmt"
+  "path"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+//
+// An alert rule, declared in the configuration file as
+//
+//  rule name metric op threshold [option=value ...]
+//
+//  metric     load1, load5, load15, swap, memory, disk or inodes; all but
+//             the loads are percent used, and disk and inodes are checked on
+//             every mount point
+//  op         >, >=, <, <=, == or !=
+//  threshold  a number, or for load rules a number per CPU such as 2/cpu
+//  for=N      the condition must hold for the last N reports (default 1);
+//             until it has, the alert is pending
+//  delta=X    and the value must have moved at least X since the previous
+//             report, up for > and >=, down for < and <=
+//  hosts=     comma separated shell glob patterns of hosts, or @group for a
+//             hostgroup, the rule applies to (default every host)
+//  severity=  info, warning or critical (default warning)
+//  repeat=    notify again after this long while the alert is firing, 0 for
+//             only once (default alertRepeat)
+//
+// Rules are evaluated against each host's stored reports every time the
+//  scanner runs.
+//
+
+type alertRule struct {
+  name string
+  metric string
+  op string
+  threshold ruleThreshold
+  forN int
+  delta float64
+  hosts []string
+  severity string
+  repeat time.Duration
+
+  // The value must also have gone up by more than delta since the previous
+  //  report, as the original loadThreshold and swapThreshold checks had it
+  rising bool
+}
+
+var g_rules []*alertRule
+
+var ruleOps = map[string]func(v float64, t float64) bool{
+  ">": func(v float64, t float64) bool { return v > t },
+  ">=": func(v float64, t float64) bool { return v >= t },
+  "<": func(v float64, t float64) bool { return v < t },
+  "<=": func(v float64, t float64) bool { return v <= t },
+  "==": func(v float64, t float64) bool { return v == t },
+  "!=": func(v float64, t float64) bool { return v != t },
+}
+
+var ruleSeverities = map[string]bool{"info": true, "warning": true, "critical": true}
+
+//
+// Parse the fields of a rule line, less the leading "rule"
+//
+
+func parseRule(fields []string) (*alertRule, error) {
+  if (len(fields) < 4) {
+    return nil, fmt.Errorf("rule needs a name, metric, comparison and threshold")
+  }
+
+  ru := &alertRule{name: fields[0], metric: fields[1], op: fields[2], forN: 1, severity: "warning", repeat: -1}
+
+  // The stale alert has the name to itself
+  if ((!validCheckName(ru.name)) || (ru.name == "stale")) {
+    return nil, fmt.Errorf("bad rule name %s", ru.name)
+  }
+
+  if (!ruleMetricKnown(ru.metric)) {
+    return nil, fmt.Errorf("rule %s: unknown metric %s", ru.name, ru.metric)
+  }
+
+  if _, ok := ruleOps[ru.op]; !ok {
+    return nil, fmt.Errorf("rule %s: unknown comparison %s", ru.name, ru.op)
+  }
+
+  var err error
+
+  ru.threshold, err = parseThreshold(fields[3])
+  if (err != nil) {
+    return nil, fmt.Errorf("rule %s: %v", ru.name, err)
+  }
+
+  if (ru.threshold.perCPU && (!ru.loadMetric())) {
+    return nil, fmt.Errorf("rule %s: per CPU thresholds are only for load", ru.name)
+  }
+
+  for _, opt := range fields[4:] {
+    k, v, ok := strings.Cut(opt, "=")
+    if ((!ok) || (v == "")) {
+      return nil, fmt.Errorf("rule %s: option %s needs a value", ru.name, opt)
+    }
+
+    switch k {
+      case "for":
+        ru.forN, err = strconv.Atoi(v)
+        if ((err == nil) && ((ru.forN < 1) || (ru.forN > maxRuleSamples))) {
+          err = fmt.Errorf("must be between 1 and %d", maxRuleSamples)
+        }
+      case "delta":
+        ru.delta, err = strconv.ParseFloat(v, 64)
+        if ((err == nil) && (ru.delta < 0)) {
+          err = fmt.Errorf("must not be negative")
+        }
+      case "hosts":
+        ru.hosts = strings.Split(v, ",")
+        for _, p := range ru.hosts {
+          _, err = path.Match(strings.TrimPrefix(p, "@"), "")
+          if (err != nil) {
+            break
+          }
+        }
+      case "severity":
+        if (!ruleSeverities[v]) {
+          err = fmt.Errorf("must be info, warning or critical")
+        }
+        ru.severity = v
+      case "repeat":
+        ru.repeat, err = time.ParseDuration(v)
+        if ((err == nil) && (ru.repeat < 0)) {
+          err = fmt.Errorf("must not be negative")
+        }
+      default:
+        err = fmt.Errorf("unknown option")
+    }
+
+    if (err != nil) {
+      return nil, fmt.Errorf("rule %s: bad %s: %v", ru.name, opt, err)
+    }
+  }
+
+  return ru, nil
+}
+
+// Most reports a rule may look back over
+const maxRuleSamples = 100
+
+func ruleMetricKnown(metric string) bool {
+  _, ok := historyMetrics[metric]
+
+  return ok || (metric == "disk") || (metric == "inodes")
+}
+
+func (ru *alertRule) loadMetric() bool {
+  return strings.HasPrefix(ru.metric, "load")
+}
+
+//
+// Rules equivalent to the original threshold directives, for configuration
+//  files that still use them. Load and swap fire, as they always have, only
+//  when above the threshold and up by more than the first differential
+//  threshold since the previous report.
+//
+
+func legacyRules(have map[string]bool) []*alertRule {
+  var rules []*alertRule
+
+  if (have["loadThreshold"]) {
+    rules = append(rules, &alertRule{name: "load", metric: "load1", op: ">", threshold: ruleThreshold{value: g_loadThreshold}, forN: 1,
+      delta: g_loadFirstDThreshold, rising: true, severity: "warning", repeat: -1})
+  }
+
+  if (have["swapThreshold"]) {
+    rules = append(rules, &alertRule{name: "swap", metric: "swap", op: ">", threshold: ruleThreshold{value: g_swapThreshold}, forN: 1,
+      delta: g_swapFirstDThreshold, rising: true, severity: "warning", repeat: -1})
+  }
+
+  if (have["diskThreshold"]) {
+    ru := &alertRule{name: "disk", metric: "disk", op: ">=", threshold: ruleThreshold{value: float64(g_diskThreshold)}, forN: 1,
+      severity: "warning", repeat: -1}
+    if (have["diskReportInterval"]) {
+      ru.repeat = time.Duration(g_diskReportInterval)*time.Second
+    }
+    rules = append(rules, ru)
+  }
+
+  return rules
+}
+
+func (ru *alertRule) String() string {
+  s := fmt.Sprintf("%s: %s %s %v for %d", ru.name, ru.metric, ru.op, ru.threshold, ru.forN)
+
+  if (ru.rising) {
+    s += fmt.Sprintf(" rising by more than %g", ru.delta)
+  } else if (ru.delta != 0) {
+    s += fmt.Sprintf(" delta %g", ru.delta)
+  }
+  if (len(ru.hosts) != 0) {
+    s += " hosts " + strings.Join(ru.hosts, ",")
+  }
+  if (ru.repeat >= 0) {
+    s += " repeat " + ru.repeat.String()
+  }
+
+  return s + " " + ru.severity
+}
+
+func (ru *alertRule) appliesTo(host string) bool {
+  if (len(ru.hosts) == 0) {
+    return true
+  }
+
+  return matchHost(host, ru.hosts)
+}
+
+//
+// Whether a host matches any of a list of host name patterns and @groups
+//
+
+func matchHost(host string, patterns []string) bool {
+  for _, p := range patterns {
+    if g, ok := strings.CutPrefix(p, "@"); ok {
+      if hg := findHostgroup(g); (hg != nil) && hg.contains(host) {
+        return true
+      }
+      continue
+    }
+
+    if ok, _ := path.Match(p, host); ok {
+      return true
+    }
+  }
+
+  return false
+}
+
+//
+// A rule's metric in one report, by mount point for disk and inodes and
+//  under "" for everything else
+//
+
+func ruleValues(metric string, m *Message) map[string]float64 {
+  vals := make(map[string]float64)
+
+  switch metric {
+    case "disk":
+      for _, d := range m.Disks {
+        vals[d.MountPoint] = d.UsedPct
+      }
+    case "inodes":
+      for _, d := range m.Disks {
+        vals[d.MountPoint] = d.InodesUsedPct
+      }
+    default:
+      if v := historyMetrics[metric](m); (v != nil) {
+        vals[""] = *v
+      }
+  }
+
+  return vals
+}
+
+//
+// How many of a host's reports the rules need, most recent first
+//
+
+func ruleSamples() int {
+  n := 2
+
+  for _, ru := range g_rules {
+    if (ru.forN + 1 > n) {
+      n = ru.forN + 1
+    }
+  }
+
+  return n
+}
+
+//
+// Evaluate one rule against a host's reports, most recent first, and return
+//  an alert for each mount point (or just one, for host wide metrics) where
+//  the latest report meets it: firing if it has held for the last forN
+//  reports, pending if not yet
+//
+
+func (ru *alertRule) evaluate(rpts []Message) []Alert {
+  var fired []Alert
+
+  if ((len(rpts) < 1) || (((ru.delta != 0) || ru.rising) && (len(rpts) < 2))) {
+    return nil
+  }
+
+  cmp := ruleOps[ru.op]
+  cur := ruleValues(ru.metric, &rpts[0])
+  thr := ru.thresholdFor(rpts[0].Hostname)
+
+  //
+  // A report from an agent whose cpus collector failed has no CPU count, so
+  //  per CPU thresholds go by the latest one that has. With none at all the
+  //  rule can't be evaluated.
+  //
+
+  var lastCPUs int64
+  for _, m := range rpts {
+    if (m.NumCPUs > 0) {
+      lastCPUs = m.NumCPUs
+      break
+    }
+  }
+
+  if (thr.perCPU && (lastCPUs == 0)) {
+    return nil
+  }
+
+  cpus := func(m *Message) int64 {
+    if (m.NumCPUs > 0) {
+      return m.NumCPUs
+    }
+    return lastCPUs
+  }
+
+  t := thr.resolve(cpus(&rpts[0]))
+
+  var insts []string
+  for inst := range cur {
+    insts = append(insts, inst)
+  }
+  sort.Strings(insts)
+
+  for _, inst := range insts {
+    v := cur[inst]
+
+    if (!cmp(v, t)) {
+      continue
+    }
+
+    var prev float64
+
+    if ((ru.delta != 0) || ru.rising) {
+      var seen, ok bool
+
+      prev, seen = ruleValues(ru.metric, &rpts[1])[inst]
+
+      switch {
+        case ru.rising:
+          ok = seen && (v - prev > ru.delta)
+        case (ru.op == ">") || (ru.op == ">="):
+          ok = seen && (v - prev >= ru.delta)
+        case (ru.op == "<") || (ru.op == "<="):
+          ok = seen && (prev - v >= ru.delta)
+        default:
+          ok = seen && ((v - prev >= ru.delta) || (prev - v >= ru.delta))
+      }
+
+      if (!ok) {
+        continue
+      }
+    }
+
+    // Held for the last forN reports
+    state := alertFiring
+    if (len(rpts) < ru.forN) {
+      state = alertPending
+    }
+    for i := 1; (i < ru.forN) && (i < len(rpts)) && (state == alertFiring); i++ {
+      pv, seen := ruleValues(ru.metric, &rpts[i])[inst]
+      if ((!seen) || (!cmp(pv, thr.resolve(cpus(&rpts[i]))))) {
+        state = alertPending
+      }
+    }
+
+    msg := fmt.Sprintf("%s is %g (%s %g)", ru.metric, v, ru.op, t)
+    if (inst != "") {
+      msg = fmt.Sprintf("%s on %s is %g%% (%s %g)", ru.metric, inst, v, ru.op, t)
+    }
+    if (thr.perCPU) {
+      msg += fmt.Sprintf(" with %d CPUs", cpus(&rpts[0]))
+    }
+    if ((ru.delta != 0) || ru.rising) {
+      msg += fmt.Sprintf(", was %g", prev)
+    }
+    if (ru.forN > 1) {
+      msg += fmt.Sprintf(" for %d reports", ru.forN)
+    }
+
+    al := Alert{Hostname: rpts[0].Hostname, Check: ru.name, Mount: inst, Severity: ru.severity, State: state, Message: msg,
+      Op: ru.op, Value: &v, Threshold: &t}
+    if (len(rpts) > 1) {
+      if pv, seen := ruleValues(ru.metric, &rpts[1])[inst]; seen {
+        al.Previous = &pv
+      }
+    }
+
+    fired = append(fired, al)
+  }
+
+  return fired
+}
+
+//
+// Evaluate every rule that applies to a host
+//
+
+func evaluateRules(host string, rpts []Message) []Alert {
+  var fired []Alert
+
+  for _, ru := range g_rules {
+    if (ru.appliesTo(host)) {
+      fired = append(fired, ru.evaluate(rpts)...)
+    }
+  }
+
+  return fired
+}
+
+//
+// The repeat interval of each rule that has its own
+//
+
+func ruleRepeats() map[string]time.Duration {
+  repeat := make(map[string]time.Duration)
+
+  for _, ru := range g_rules {
+    if (ru.repeat >= 0) {
+      repeat[ru.name] = ru.repeat
+    }
+  }
+
+  return repeat
+}
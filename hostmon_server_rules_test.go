@@ -0,0 +1,192 @@
+//
+// Host monitor data collection server, alert rule tests
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestParseRule(t *testing.T) {
+  tests := []struct {
+    line string
+    err string
+  }{
+    {"highload load1 > 35", ""},
+    {"highload load1 > 2/cpu for=3 delta=1 hosts=db*,@compute severity=critical repeat=1h", ""},
+    {"varfull disk >= 95", ""},
+    {"lowmem memory < 5 severity=info", ""},
+    {"highload load1 >", "needs a name"},
+    {"stale load1 > 35", "bad rule name"},
+    {"high/load load1 > 35", "bad rule name"},
+    {"highload cpu > 35", "unknown metric"},
+    {"highload load1 => 35", "unknown comparison"},
+    {"highload load1 > lots", "bad threshold"},
+    {"varfull disk > 2/cpu", "only for load"},
+    {"highload load1 > 35 for=0", "bad for"},
+    {"highload load1 > 35 for=101", "bad for"},
+    {"highload load1 > 35 delta=-1", "bad delta"},
+    {"highload load1 > 35 hosts=[db", "bad hosts"},
+    {"highload load1 > 35 severity=page", "bad severity"},
+    {"highload load1 > 35 repeat=soon", "bad repeat"},
+    {"highload load1 > 35 repeat=", "needs a value"},
+    {"highload load1 > 35 color=red", "bad color"},
+  }
+
+  for _, tt := range tests {
+    _, err := parseRule(strings.Fields(tt.line))
+
+    switch {
+      case (tt.err == "") && (err != nil):
+        t.Errorf("%q: unexpected error %v", tt.line, err)
+      case (tt.err != "") && ((err == nil) || (!strings.Contains(err.Error(), tt.err))):
+        t.Errorf("%q: got error %v, want one containing %q", tt.line, err, tt.err)
+    }
+  }
+}
+
+//
+// Reports for db1, most recent first, with load and swap as given and the
+//  disks used as given, oldest values last
+//
+
+func ruleReports(load []float64, swap []float64, disks []map[string]float64) []Message {
+  var rpts []Message
+
+  for i := range load {
+    m := Message{Hostname: "db1", Timestamp: int64(1000 - i*60), NumCPUs: 4, LoadOne: load[i]}
+    if (swap != nil) {
+      m.SwapUsed = swap[i]
+    }
+    if (disks != nil) {
+      for mp, p := range disks[i] {
+        m.Disks = append(m.Disks, DiskInfo{MountPoint: mp, UsedPct: p})
+      }
+    }
+    rpts = append(rpts, m)
+  }
+
+  return rpts
+}
+
+//
+// The same reports with the CPU count dropped from the newest n, as when the
+//  cpus collector fails
+//
+
+func withoutCPUs(rpts []Message, n int) []Message {
+  for i := 0; (i < n) && (i < len(rpts)); i++ {
+    rpts[i].NumCPUs = 0
+  }
+
+  return rpts
+}
+
+func TestEvaluateRule(t *testing.T) {
+  tests := []struct {
+    name string
+    rule string
+    rpts []Message
+    want []string
+  }{
+    {"over", "highload load1 > 10", ruleReports([]float64{12}, nil, nil), []string{"firing"}},
+    {"at", "highload load1 > 10", ruleReports([]float64{10}, nil, nil), nil},
+    {"at or over", "highload load1 >= 10", ruleReports([]float64{10}, nil, nil), []string{"firing"}},
+    {"under", "lowload load1 < 1", ruleReports([]float64{0.5}, nil, nil), []string{"firing"}},
+    {"per cpu", "highload load1 > 2/cpu", ruleReports([]float64{9}, nil, nil), []string{"firing"}},
+    {"per cpu under", "highload load1 > 2/cpu", ruleReports([]float64{7}, nil, nil), nil},
+    {"per cpu, no count", "highload load1 > 2/cpu", withoutCPUs(ruleReports([]float64{0.5}, nil, nil), 1), nil},
+    {"per cpu, count from earlier", "highload load1 > 2/cpu", withoutCPUs(ruleReports([]float64{9, 1}, nil, nil), 1), []string{"firing"}},
+    {"per cpu, earlier under", "highload load1 > 2/cpu", withoutCPUs(ruleReports([]float64{7, 1}, nil, nil), 1), nil},
+    {"per cpu held, no count", "highload load1 > 2/cpu for=2", withoutCPUs(ruleReports([]float64{9, 9, 1}, nil, nil), 2), []string{"firing"}},
+    {"fixed, no count", "highload load1 > 2", withoutCPUs(ruleReports([]float64{3}, nil, nil), 1), []string{"firing"}},
+    {"not yet held", "highload load1 > 10 for=3", ruleReports([]float64{12, 12}, nil, nil), []string{"pending"}},
+    {"broke off", "highload load1 > 10 for=3", ruleReports([]float64{12, 9, 12}, nil, nil), []string{"pending"}},
+    {"held", "highload load1 > 10 for=3", ruleReports([]float64{12, 11, 15}, nil, nil), []string{"firing"}},
+    {"delta needs two", "highload load1 > 10 delta=2", ruleReports([]float64{12}, nil, nil), nil},
+    {"delta met", "highload load1 > 10 delta=2", ruleReports([]float64{12, 10}, nil, nil), []string{"firing"}},
+    {"delta not met", "highload load1 > 10 delta=2", ruleReports([]float64{12, 11}, nil, nil), nil},
+    {"delta down", "lowload load1 < 5 delta=2", ruleReports([]float64{1, 4}, nil, nil), []string{"firing"}},
+    {"delta either way", "flap load1 != 0 delta=2", ruleReports([]float64{1, 4}, nil, nil), []string{"firing"}},
+    {"each mount", "varfull disk >= 90", ruleReports([]float64{0}, nil, []map[string]float64{{"/": 95, "/home": 50, "/var": 90}}),
+      []string{"firing /", "firing /var"}},
+    {"new mount", "varfull disk >= 90 for=2", ruleReports([]float64{0, 0}, nil, []map[string]float64{{"/": 95, "/var": 95}, {"/": 95}}),
+      []string{"firing /", "pending /var"}},
+  }
+
+  for _, tt := range tests {
+    ru, err := parseRule(strings.Fields(tt.rule))
+    if (err != nil) {
+      t.Fatalf("%s: %v", tt.name, err)
+    }
+
+    var got []string
+    for _, a := range ru.evaluate(tt.rpts) {
+      got = append(got, strings.TrimSpace(a.State + " " + a.Mount))
+    }
+
+    if (strings.Join(got, ",") != strings.Join(tt.want, ",")) {
+      t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+    }
+  }
+}
+
+//
+// The migrated load and swap rules must fire exactly when the original
+//  checks in task_scan_and_notify did:
+//
+//  if (lo > loh) && (lo > loadThreshold) && (|lo - loh| > loadFirstDThreshold)
+//
+
+func TestLegacyRulesMatchOriginalChecks(t *testing.T) {
+  oldLoad, oldSwap, oldLoadD, oldSwapD := g_loadThreshold, g_swapThreshold, g_loadFirstDThreshold, g_swapFirstDThreshold
+  defer func() {
+    g_loadThreshold, g_swapThreshold, g_loadFirstDThreshold, g_swapFirstDThreshold = oldLoad, oldSwap, oldLoadD, oldSwapD
+  }()
+
+  original := func(v float64, prev float64, threshold float64, delta float64) bool {
+    d := v - prev
+    if (d < 0) {
+      d = -d
+    }
+    return (v > prev) && (v > threshold) && (d > delta)
+  }
+
+  values := []float64{0, 4.5, 5, 9.5, 10, 10.5, 15, 20, 35}
+
+  for _, threshold := range []float64{0, 10} {
+    for _, delta := range []float64{0, 5} {
+      g_loadThreshold, g_loadFirstDThreshold = threshold, delta
+      g_swapThreshold, g_swapFirstDThreshold = threshold, delta
+
+      rules := legacyRules(map[string]bool{"loadThreshold": true, "swapThreshold": true})
+      if (len(rules) != 2) {
+        t.Fatalf("got %d legacy rules, want 2", len(rules))
+      }
+
+      for _, v := range values {
+        for _, prev := range values {
+          rpts := ruleReports([]float64{v, prev}, []float64{v, prev}, nil)
+
+          for _, ru := range rules {
+            got := len(ru.evaluate(rpts)) != 0
+            want := original(v, prev, threshold, delta)
+            if (got != want) {
+              t.Errorf("%s threshold %g delta %g: %g after %g fired %v, originally %v", ru.name, threshold, delta, v, prev, got, want)
+            }
+          }
+        }
+      }
+
+      // Nothing to compare a single report with, as before
+      for _, ru := range rules {
+        if (len(ru.evaluate(ruleReports([]float64{50}, []float64{50}, nil))) != 0) {
+          t.Errorf("%s fired on a single report", ru.name)
+        }
+      }
+    }
+  }
+}
@@ -0,0 +1,148 @@
+//
+// Host monitor data collection server, stale host detection
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "fmt"
+  "sort"
+  "sync"
+  "time"
+)
+
+//
+// A host is stale once it has missed staleIntervals check-ins in a row. How
+//  often a host checks in is set with hostInterval in the configuration file,
+//  or else worked out from the gaps between its recent reports, or else taken
+//  to be the agent's default interval.
+//
+
+const defaultStaleIntervals = 3
+const defaultExpectedInterval = 10*time.Minute
+
+// How often hosts are scanned for alerts and staleness
+const scanInterval = time.Minute
+
+// Reports looked at to work out a host's cadence, and the gaps between them
+//  needed before it is trusted over the default
+const cadenceSamples = 10
+const cadenceMinGaps = 5
+
+// Hosts are scanned once a minute, so a cadence shorter than that, as seen
+//  when an agent is restarted a few times or reports are pushed by hand, is
+//  taken to be a minute
+const minObservedInterval = scanInterval
+
+var g_staleIntervals int64 = defaultStaleIntervals
+var g_hostIntervals = make(map[string]time.Duration)
+
+//
+// Cadence seen from each host
+//
+
+var staleMu sync.Mutex
+var observedIntervals = make(map[string]time.Duration)
+
+//
+// A report as returned by the GET API, with whether the host has stopped
+//  reporting, how often it is expected to report, in seconds, and the
+//  maintenance window it is in, if any
+//
+
+type hostStatus struct {
+  Message
+  Stale bool
+  ExpectedInterval int64
+  Maintenance string `json:",omitempty"`
+}
+
+func newHostStatus(m Message, now time.Time) hostStatus {
+  hs := hostStatus{Message: m, Stale: isStale(m, now), ExpectedInterval: int64(expectedInterval(m.Hostname)/time.Second)}
+
+  if mw := maintenanceFor(m.Hostname, now); mw != nil {
+    hs.Maintenance = mw.ID
+  }
+
+  return hs
+}
+
+//
+// How often we expect to hear from a host
+//
+
+func expectedInterval(host string) time.Duration {
+  if d, ok := g_hostIntervals[host]; ok {
+    return d
+  }
+
+  staleMu.Lock()
+  defer staleMu.Unlock()
+
+  if d, ok := observedIntervals[host]; ok {
+    return d
+  }
+
+  return defaultExpectedInterval
+}
+
+//
+// Whether the host that sent m, its latest report, has missed too many
+//  check-ins
+//
+
+func isStale(m Message, now time.Time) bool {
+  age := now.Sub(time.Unix(m.Timestamp, 0))
+
+  return age > time.Duration(g_staleIntervals)*expectedInterval(m.Hostname)
+}
+
+//
+// Work out a host's cadence from its recent reports, most recent first. The
+//  median gap is used so that one long outage or a burst of SIGHUPs doesn't
+//  throw it off, and only once there are cadenceMinGaps gaps to go on.
+//
+
+func observeCadence(host string, rpts []Message) {
+  var gaps []int64
+
+  for i := 1; i < len(rpts); i++ {
+    if g := rpts[i-1].Timestamp - rpts[i].Timestamp; g > 0 {
+      gaps = append(gaps, g)
+    }
+  }
+
+  if (len(gaps) < cadenceMinGaps) {
+    return
+  }
+
+  sort.Slice(gaps, func(i int, j int) bool { return gaps[i] < gaps[j] })
+
+  d := time.Duration(gaps[len(gaps)/2])*time.Second
+  if (d < minObservedInterval) {
+    d = minObservedInterval
+  }
+
+  staleMu.Lock()
+  defer staleMu.Unlock()
+
+  observedIntervals[host] = d
+}
+
+//
+// Check whether a host has stopped reporting, given its latest report, and
+//  return the stale alert while it lasts. Notifying is left to the alert
+//  state, which sends the recovery notice when the host comes back.
+//
+
+func checkStale(m Message, now time.Time) (Alert, bool) {
+  if (!isStale(m, now)) {
+    return Alert{}, false
+  }
+
+  last := time.Unix(m.Timestamp, 0)
+
+  return Alert{Hostname: m.Hostname, Check: "stale", Severity: "critical", State: alertFiring,
+    Message: fmt.Sprintf("No report since %s, expected every %v", last.Format("2006-01-02 15:04:05"), expectedInterval(m.Hostname))}, true
+}
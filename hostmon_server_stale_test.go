@@ -0,0 +1,46 @@
+//
+// Host monitor data collection server, stale host detection tests
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func TestObserveCadence(t *testing.T) {
+  tests := []struct {
+    name string
+    gaps []int64
+    want time.Duration
+  }{
+    {"too few reports", []int64{300, 300}, defaultExpectedInterval},
+    {"steady", []int64{300, 300, 300, 300, 300}, 5*time.Minute},
+    {"one outage", []int64{300, 7200, 300, 300, 300}, 5*time.Minute},
+    {"a restart", []int64{300, 7, 300, 300, 300}, 5*time.Minute},
+    {"burst of pushes", []int64{7, 7, 7, 7, 7}, minObservedInterval},
+    {"out of order", []int64{300, -10, 300, 300, 300}, defaultExpectedInterval},
+  }
+
+  for _, tt := range tests {
+    ts := int64(1700000000)
+    rpts := []Message{{Hostname: "db1", Timestamp: ts}}
+    for _, g := range tt.gaps {
+      ts -= g
+      rpts = append(rpts, Message{Hostname: "db1", Timestamp: ts})
+    }
+
+    staleMu.Lock()
+    delete(observedIntervals, "db1")
+    staleMu.Unlock()
+
+    observeCadence("db1", rpts)
+
+    got := expectedInterval("db1")
+    if (got != tt.want) {
+      t.Errorf("%s: expected interval %v, want %v", tt.name, got, tt.want)
+    }
+  }
+}
@@ -0,0 +1,1004 @@
+//
+// Host monitor data collection server, storage backends
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "errors"
+  "log"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "database/sql"
+  _ "github.com/go-sql-driver/mysql"
+  _ "github.com/mattn/go-sqlite3"
+)
+
+//
+// A Store holds the reports received from agents and the list of hosts that
+//  have checked in. Reports for a host are returned most recent first, except
+//  by ReportsBetween, which returns them oldest first with only their disks
+//  filled in, for drawing graphs. It also holds the notification outbox;
+//  RecentNotifications returns the most recent first, optionally only for
+//  one host or with one status. Maintenance windows added through the API
+//  are kept here too.
+//
+
+type Store interface {
+  StoreReport(m Message) error
+  LatestReport(host string) (Message, error)
+  LastReports(host string, n int) ([]Message, error)
+  ReportsBetween(host string, from int64, to int64) ([]Message, error)
+  ListHosts() ([]string, error)
+  HostToken(host string) (string, error)
+  SetHostToken(host string, token string) error
+  AddNotification(e OutboxEntry) (int64, error)
+  UpdateNotification(e OutboxEntry) error
+  DueNotifications(now int64) ([]OutboxEntry, error)
+  RecentNotifications(host string, status string, n int) ([]OutboxEntry, error)
+  AddMaintenance(mw Maintenance) (int64, error)
+  DeleteMaintenance(id int64) error
+  ListMaintenance() ([]Maintenance, error)
+  Close() error
+}
+
+// Returned by LatestReport when a host has never reported
+var errNoReports = errors.New("no reports for host")
+
+//
+// Open the storage backend selected in the configuration file.
+//
+
+func openStore(kind string) (Store, error) {
+  switch kind {
+    case "mysql":
+      //
+      // The DSN used to connect to the database should look like this:
+      //   hostmon:xyzzy123@tcp(192.168.1.253:3306)/hostmonitor
+      //
+
+      myDSN := g_dbUser + ":" + g_dbPass + "@tcp(" + g_dbHost + ":3306)/" + g_dbName
+
+      return openSQLStore("mysql", myDSN, nil)
+    case "sqlite":
+      return openSQLStore("sqlite3", g_sqlitePath, sqliteSchema)
+    case "memory":
+      return newMemStore(), nil
+  }
+
+  return nil, errors.New("unknown storage backend " + kind)
+}
+
+//
+// SQL backed store. MySQL and SQLite share the same tables and queries, the
+//  only difference is that we create the SQLite tables ourselves.
+//
+
+type sqlStore struct {
+  db *sql.DB
+
+  // Prepared once when the store is opened, see prepareStatements()
+  hostCount *sql.Stmt
+  hostInsert *sql.Stmt
+  reportInsert *sql.Stmt
+  lastReports *sql.Stmt
+  reportsBetween *sql.Stmt
+  disksBetween *sql.Stmt
+  listHosts *sql.Stmt
+  diskInsert *sql.Stmt
+  reportDisks *sql.Stmt
+  collectorInsert *sql.Stmt
+  reportCollectors *sql.Stmt
+  checkInsert *sql.Stmt
+  checkMetricInsert *sql.Stmt
+  reportChecks *sql.Stmt
+  reportCheckMetrics *sql.Stmt
+  tokenSelect *sql.Stmt
+  tokenDelete *sql.Stmt
+  tokenInsert *sql.Stmt
+  notificationInsert *sql.Stmt
+  notificationUpdate *sql.Stmt
+  notificationsDue *sql.Stmt
+  notificationsRecent *sql.Stmt
+  maintenanceInsert *sql.Stmt
+  maintenanceDelete *sql.Stmt
+  maintenanceList *sql.Stmt
+
+  prepared []*sql.Stmt
+}
+
+var sqliteSchema = []string{
+  "CREATE TABLE IF NOT EXISTS reports (timestamp bigint, hostname varchar(68), kernelver varchar(65), release varchar(65), " +
+    "uptime varchar(16), numcpus varchar(8), physmem varchar(16), loadone varchar(12), " +
+    "loadfive varchar(12), loadfifteen varchar(12), swapused varchar(12), diskreport varchar(68), memused varchar(12))",
+  "CREATE TABLE IF NOT EXISTS hosts (host varchar(258), hostid integer PRIMARY KEY AUTOINCREMENT)",
+  "CREATE INDEX IF NOT EXISTS reports_host_ts ON reports (hostname, timestamp)",
+  "CREATE TABLE IF NOT EXISTS disks (timestamp bigint, hostname varchar(68), mountpoint varchar(255), device varchar(255), " +
+    "fstype varchar(32), totalbytes bigint, usedbytes bigint, availbytes bigint, usedpct double, " +
+    "inodestotal bigint, inodesused bigint, inodesusedpct double)",
+  "CREATE INDEX IF NOT EXISTS disks_host_ts ON disks (hostname, timestamp)",
+  "CREATE TABLE IF NOT EXISTS collectors (timestamp bigint, hostname varchar(68), collector varchar(32), error varchar(255))",
+  "CREATE INDEX IF NOT EXISTS collectors_host_ts ON collectors (hostname, timestamp)",
+  "CREATE TABLE IF NOT EXISTS checks (timestamp bigint, hostname varchar(68), name varchar(64), status integer, output varchar(255))",
+  "CREATE INDEX IF NOT EXISTS checks_host_ts ON checks (hostname, timestamp)",
+  "CREATE TABLE IF NOT EXISTS checkmetrics (timestamp bigint, hostname varchar(68), checkname varchar(64), metric varchar(64), value double)",
+  "CREATE INDEX IF NOT EXISTS checkmetrics_host_ts ON checkmetrics (hostname, timestamp)",
+  "CREATE TABLE IF NOT EXISTS tokens (host varchar(68) PRIMARY KEY, token varchar(64))",
+  "CREATE TABLE IF NOT EXISTS notifications (id integer PRIMARY KEY AUTOINCREMENT, created bigint, notifier varchar(64), " +
+    "kind varchar(16), hostname varchar(68), checkname varchar(64), mount varchar(255), severity varchar(16), " +
+    "subject varchar(255), payload text, status varchar(16), attempts integer, nextattempt bigint, " +
+    "lasterror varchar(255), sent bigint)",
+  "CREATE INDEX IF NOT EXISTS notifications_status ON notifications (status, nextattempt)",
+  "CREATE TABLE IF NOT EXISTS maintenance (id integer PRIMARY KEY AUTOINCREMENT, hosts varchar(1024), starts bigint, ends bigint, " +
+    "cron varchar(128), duration varchar(32), comment varchar(255), createdby varchar(255))",
+}
+
+//
+// Columns added to SQLite tables since they were first created. CREATE TABLE
+//  IF NOT EXISTS leaves a file written by an older server as it was, so these
+//  are added to it if it doesn't have them yet.
+//
+
+var sqliteColumns = []struct {
+  table string
+  column string
+  decl string
+}{
+  {"reports", "memused", "varchar(12)"},
+}
+
+func upgradeSQLiteSchema(db *sql.DB) error {
+  for _, c := range sqliteColumns {
+    rs, err := db.Query("SELECT " + c.column + " FROM " + c.table + " LIMIT 0")
+    if (err == nil) {
+      rs.Close()
+      continue
+    }
+
+    log.Printf("Adding column %s to table %s\n", c.column, c.table)
+
+    _, err = db.Exec("ALTER TABLE " + c.table + " ADD COLUMN " + c.column + " " + c.decl)
+    if (err != nil) {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func openSQLStore(driver string, dsn string, schema []string) (*sqlStore, error) {
+  db, err := sql.Open(driver, dsn)
+  if (err != nil) {
+    return nil, err
+  }
+
+  //
+  // Test the database connection to make sure that we're in business.
+  //
+
+  err = db.Ping()
+  if (err != nil) {
+    db.Close()
+    return nil, err
+  }
+
+  for _, stmt := range schema {
+    _, err = db.Exec(stmt)
+    if (err != nil) {
+      db.Close()
+      return nil, err
+    }
+  }
+
+  if (driver == "sqlite3") {
+    err = upgradeSQLiteSchema(db)
+    if (err != nil) {
+      db.Close()
+      return nil, err
+    }
+  }
+
+  s := &sqlStore{db: db}
+
+  err = s.prepareStatements()
+  if (err != nil) {
+    s.Close()
+    return nil, err
+  }
+
+  return s, nil
+}
+
+//
+// Every query the store runs is prepared here. Values are always passed as
+//  statement parameters, never spliced into the SQL text.
+//
+
+func (s *sqlStore) prepareStatements() error {
+  var err error
+
+  stmts := []struct {
+    stmt **sql.Stmt
+    query string
+  }{
+    {&s.hostCount, "SELECT COUNT(*) FROM hosts WHERE host = ?"},
+    {&s.hostInsert, "INSERT INTO hosts (host) VALUES (?)"},
+    {&s.reportInsert, "INSERT INTO reports VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"},
+    {&s.lastReports, "SELECT * FROM reports WHERE hostname = ? ORDER BY timestamp DESC LIMIT ?"},
+    {&s.reportsBetween, "SELECT * FROM reports WHERE hostname = ? AND timestamp >= ? AND timestamp <= ? ORDER BY timestamp ASC"},
+    {&s.disksBetween, "SELECT timestamp, mountpoint, device, fstype, totalbytes, usedbytes, availbytes, usedpct, inodestotal, inodesused, inodesusedpct " +
+      "FROM disks WHERE hostname = ? AND timestamp >= ? AND timestamp <= ? ORDER BY timestamp ASC, mountpoint ASC"},
+    {&s.listHosts, "SELECT host FROM hosts ORDER BY host ASC"},
+    {&s.diskInsert, "INSERT INTO disks VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"},
+    {&s.reportDisks, "SELECT mountpoint, device, fstype, totalbytes, usedbytes, availbytes, usedpct, inodestotal, inodesused, inodesusedpct " +
+      "FROM disks WHERE hostname = ? AND timestamp = ? ORDER BY mountpoint ASC"},
+    {&s.collectorInsert, "INSERT INTO collectors VALUES (?, ?, ?, ?)"},
+    {&s.reportCollectors, "SELECT collector, error FROM collectors WHERE hostname = ? AND timestamp = ? ORDER BY collector ASC"},
+    {&s.checkInsert, "INSERT INTO checks VALUES (?, ?, ?, ?, ?)"},
+    {&s.checkMetricInsert, "INSERT INTO checkmetrics VALUES (?, ?, ?, ?, ?)"},
+    {&s.reportChecks, "SELECT name, status, output FROM checks WHERE hostname = ? AND timestamp = ? ORDER BY name ASC"},
+    {&s.reportCheckMetrics, "SELECT checkname, metric, value FROM checkmetrics WHERE hostname = ? AND timestamp = ?"},
+    {&s.tokenSelect, "SELECT token FROM tokens WHERE host = ?"},
+    {&s.tokenDelete, "DELETE FROM tokens WHERE host = ?"},
+    {&s.tokenInsert, "INSERT INTO tokens (host, token) VALUES (?, ?)"},
+    {&s.notificationInsert, "INSERT INTO notifications (created, notifier, kind, hostname, checkname, mount, severity, subject, payload, " +
+      "status, attempts, nextattempt, lasterror, sent) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"},
+    {&s.notificationUpdate, "UPDATE notifications SET status = ?, attempts = ?, nextattempt = ?, lasterror = ?, sent = ? WHERE id = ?"},
+    {&s.notificationsDue, "SELECT " + notificationColumns + " FROM notifications WHERE status = 'pending' AND nextattempt <= ? ORDER BY id ASC"},
+    {&s.notificationsRecent, "SELECT " + notificationColumns + " FROM notifications WHERE (? = '' OR hostname = ?) AND (? = '' OR status = ?) " +
+      "ORDER BY id DESC LIMIT ?"},
+    {&s.maintenanceInsert, "INSERT INTO maintenance (hosts, starts, ends, cron, duration, comment, createdby) VALUES (?, ?, ?, ?, ?, ?, ?)"},
+    {&s.maintenanceDelete, "DELETE FROM maintenance WHERE id = ?"},
+    {&s.maintenanceList, "SELECT id, hosts, starts, ends, cron, duration, comment, createdby FROM maintenance ORDER BY id ASC"},
+  }
+
+  for _, st := range stmts {
+    *st.stmt, err = s.db.Prepare(st.query)
+    if (err != nil) {
+      return err
+    }
+
+    s.prepared = append(s.prepared, *st.stmt)
+  }
+
+  return nil
+}
+
+func (s *sqlStore) StoreReport(m Message) error {
+  //
+  // Check to see if the host exists in the host tracking table. If not, add
+  //  it. The database will generate an ID.
+  //
+
+  var n int
+
+  err := s.hostCount.QueryRow(m.Hostname).Scan(&n)
+  if (err != nil) {
+    return err
+  }
+
+  if (n == 0) {
+    _, err = s.hostInsert.Exec(m.Hostname)
+    if (err != nil) {
+      return err
+    }
+  }
+
+  //
+  // The report and its disk list go in together or not at all
+  //
+
+  tx, err := s.db.Begin()
+  if (err != nil) {
+    return err
+  }
+
+  _, err = tx.Stmt(s.reportInsert).Exec(m.Timestamp, m.Hostname, m.KernelVer, m.Release, m.Uptime, m.NumCPUs, m.Memtotal,
+    m.LoadOne, m.LoadFive, m.LoadFifteen, m.SwapUsed, m.DiskReport, m.MemUsed)
+  if (err != nil) {
+    tx.Rollback()
+    return err
+  }
+
+  for _, d := range m.Disks {
+    _, err = tx.Stmt(s.diskInsert).Exec(m.Timestamp, m.Hostname, d.MountPoint, d.Device, d.FSType, d.TotalBytes, d.UsedBytes,
+      d.AvailBytes, d.UsedPct, d.InodesTotal, d.InodesUsed, d.InodesUsedPct)
+    if (err != nil) {
+      tx.Rollback()
+      return err
+    }
+  }
+
+  //
+  // One row per collector; the error column is empty for those that worked
+  //
+
+  for _, c := range m.Collectors {
+    _, err = tx.Stmt(s.collectorInsert).Exec(m.Timestamp, m.Hostname, c, "")
+    if (err != nil) {
+      tx.Rollback()
+      return err
+    }
+  }
+
+  for c, e := range m.CollectorErrors {
+    _, err = tx.Stmt(s.collectorInsert).Exec(m.Timestamp, m.Hostname, c, e)
+    if (err != nil) {
+      tx.Rollback()
+      return err
+    }
+  }
+
+  for _, k := range m.Checks {
+    _, err = tx.Stmt(s.checkInsert).Exec(m.Timestamp, m.Hostname, k.Name, k.Status, k.Output)
+    if (err != nil) {
+      tx.Rollback()
+      return err
+    }
+
+    for mn, mv := range k.Metrics {
+      _, err = tx.Stmt(s.checkMetricInsert).Exec(m.Timestamp, m.Hostname, k.Name, mn, mv)
+      if (err != nil) {
+        tx.Rollback()
+        return err
+      }
+    }
+  }
+
+  return tx.Commit()
+}
+
+func (s *sqlStore) LatestReport(host string) (Message, error) {
+  ms, err := s.LastReports(host, 1)
+  if (err != nil) {
+    return Message{}, err
+  }
+
+  if (len(ms) == 0) {
+    return Message{}, errNoReports
+  }
+
+  return ms[0], nil
+}
+
+func (s *sqlStore) LastReports(host string, n int) ([]Message, error) {
+  var ms []Message
+
+  rs, err := s.lastReports.Query(host, n)
+  if (err != nil) {
+    return nil, err
+  }
+
+  defer rs.Close()
+
+  for rs.Next() {
+    var m Message
+    var memUsed sql.NullFloat64
+
+    //
+    // For each field, specify a parameter to Scan() i.e.
+    //  rs.Scan(&f1, &f2, &f3, &f3) and so on. Reports from before agents sent
+    //  memory use have none.
+    //
+
+    err = rs.Scan(&m.Timestamp, &m.Hostname, &m.KernelVer, &m.Release, &m.Uptime,
+      &m.NumCPUs, &m.Memtotal, &m.LoadOne, &m.LoadFive, &m.LoadFifteen, &m.SwapUsed, &m.DiskReport, &memUsed)
+    if (err != nil) {
+      return nil, err
+    }
+    if (memUsed.Valid) {
+      m.MemUsed = &memUsed.Float64
+    }
+
+    ms = append(ms, m)
+  }
+
+  err = rs.Err()
+  if (err != nil) {
+    return nil, err
+  }
+
+  for i := range ms {
+    ms[i].Disks, err = s.disks(ms[i].Hostname, ms[i].Timestamp)
+    if (err != nil) {
+      return nil, err
+    }
+
+    err = s.collectors(&ms[i])
+    if (err != nil) {
+      return nil, err
+    }
+
+    ms[i].Checks, err = s.checks(ms[i].Hostname, ms[i].Timestamp)
+    if (err != nil) {
+      return nil, err
+    }
+  }
+
+  return ms, nil
+}
+
+//
+// Reports in a time range, oldest first. The disks for the whole range come
+//  back in one query rather than one per report.
+//
+
+func (s *sqlStore) ReportsBetween(host string, from int64, to int64) ([]Message, error) {
+  var ms []Message
+
+  rs, err := s.reportsBetween.Query(host, from, to)
+  if (err != nil) {
+    return nil, err
+  }
+
+  defer rs.Close()
+
+  byTime := make(map[int64]int)
+
+  for rs.Next() {
+    var m Message
+    var memUsed sql.NullFloat64
+
+    err = rs.Scan(&m.Timestamp, &m.Hostname, &m.KernelVer, &m.Release, &m.Uptime,
+      &m.NumCPUs, &m.Memtotal, &m.LoadOne, &m.LoadFive, &m.LoadFifteen, &m.SwapUsed, &m.DiskReport, &memUsed)
+    if (err != nil) {
+      return nil, err
+    }
+    if (memUsed.Valid) {
+      m.MemUsed = &memUsed.Float64
+    }
+
+    byTime[m.Timestamp] = len(ms)
+    ms = append(ms, m)
+  }
+
+  err = rs.Err()
+  if ((err != nil) || (len(ms) == 0)) {
+    return ms, err
+  }
+
+  ds, err := s.disksBetween.Query(host, from, to)
+  if (err != nil) {
+    return nil, err
+  }
+
+  defer ds.Close()
+
+  for ds.Next() {
+    var d DiskInfo
+    var ts int64
+
+    err = ds.Scan(&ts, &d.MountPoint, &d.Device, &d.FSType, &d.TotalBytes, &d.UsedBytes, &d.AvailBytes, &d.UsedPct,
+      &d.InodesTotal, &d.InodesUsed, &d.InodesUsedPct)
+    if (err != nil) {
+      return nil, err
+    }
+
+    i, ok := byTime[ts]
+    if (!ok) {
+      continue
+    }
+
+    ms[i].Disks = append(ms[i].Disks, d)
+  }
+
+  return ms, ds.Err()
+}
+
+//
+// Get the disk list that came in with a report
+//
+
+func (s *sqlStore) disks(host string, ts int64) ([]DiskInfo, error) {
+  var disks []DiskInfo
+
+  rs, err := s.reportDisks.Query(host, ts)
+  if (err != nil) {
+    return nil, err
+  }
+
+  defer rs.Close()
+
+  for rs.Next() {
+    var d DiskInfo
+
+    err = rs.Scan(&d.MountPoint, &d.Device, &d.FSType, &d.TotalBytes, &d.UsedBytes, &d.AvailBytes, &d.UsedPct,
+      &d.InodesTotal, &d.InodesUsed, &d.InodesUsedPct)
+    if (err != nil) {
+      return nil, err
+    }
+
+    disks = append(disks, d)
+  }
+
+  return disks, rs.Err()
+}
+
+//
+// Fill in which collectors ran for a report, and the errors from those that
+//  failed
+//
+
+func (s *sqlStore) collectors(m *Message) error {
+  rs, err := s.reportCollectors.Query(m.Hostname, m.Timestamp)
+  if (err != nil) {
+    return err
+  }
+
+  defer rs.Close()
+
+  for rs.Next() {
+    var c, e string
+
+    err = rs.Scan(&c, &e)
+    if (err != nil) {
+      return err
+    }
+
+    if (e == "") {
+      m.Collectors = append(m.Collectors, c)
+    } else {
+      if (m.CollectorErrors == nil) {
+        m.CollectorErrors = make(map[string]string)
+      }
+      m.CollectorErrors[c] = e
+    }
+  }
+
+  return rs.Err()
+}
+
+//
+// Get the check script results, with their metrics, that came in with a
+//  report
+//
+
+func (s *sqlStore) checks(host string, ts int64) ([]CheckResult, error) {
+  var checks []CheckResult
+
+  rs, err := s.reportChecks.Query(host, ts)
+  if (err != nil) {
+    return nil, err
+  }
+
+  defer rs.Close()
+
+  byName := make(map[string]int)
+
+  for rs.Next() {
+    var k CheckResult
+
+    err = rs.Scan(&k.Name, &k.Status, &k.Output)
+    if (err != nil) {
+      return nil, err
+    }
+
+    byName[k.Name] = len(checks)
+    checks = append(checks, k)
+  }
+
+  err = rs.Err()
+  if ((err != nil) || (len(checks) == 0)) {
+    return checks, err
+  }
+
+  ms, err := s.reportCheckMetrics.Query(host, ts)
+  if (err != nil) {
+    return nil, err
+  }
+
+  defer ms.Close()
+
+  for ms.Next() {
+    var cn, mn string
+    var mv float64
+
+    err = ms.Scan(&cn, &mn, &mv)
+    if (err != nil) {
+      return nil, err
+    }
+
+    i, ok := byName[cn]
+    if (!ok) {
+      continue
+    }
+
+    if (checks[i].Metrics == nil) {
+      checks[i].Metrics = make(map[string]float64)
+    }
+    checks[i].Metrics[mn] = mv
+  }
+
+  return checks, ms.Err()
+}
+
+func (s *sqlStore) ListHosts() ([]string, error) {
+  var hosts []string
+
+  rs, err := s.listHosts.Query()
+  if (err != nil) {
+    return nil, err
+  }
+
+  defer rs.Close()
+
+  for rs.Next() {
+    var h string
+
+    err = rs.Scan(&h)
+    if (err != nil) {
+      return nil, err
+    }
+
+    hosts = append(hosts, h)
+  }
+
+  return hosts, rs.Err()
+}
+
+func (s *sqlStore) HostToken(host string) (string, error) {
+  var token string
+
+  err := s.tokenSelect.QueryRow(host).Scan(&token)
+  if (err == sql.ErrNoRows) {
+    return "", errNoToken
+  }
+
+  return token, err
+}
+
+//
+// Replace a host's token. An empty token revokes it.
+//
+
+func (s *sqlStore) SetHostToken(host string, token string) error {
+  tx, err := s.db.Begin()
+  if (err != nil) {
+    return err
+  }
+
+  _, err = tx.Stmt(s.tokenDelete).Exec(host)
+  if ((err == nil) && (token != "")) {
+    _, err = tx.Stmt(s.tokenInsert).Exec(host, token)
+  }
+
+  if (err != nil) {
+    tx.Rollback()
+    return err
+  }
+
+  return tx.Commit()
+}
+
+const notificationColumns = "id, created, notifier, kind, hostname, checkname, mount, severity, subject, payload, status, attempts, " +
+  "nextattempt, lasterror, sent"
+
+func (s *sqlStore) AddNotification(e OutboxEntry) (int64, error) {
+  r, err := s.notificationInsert.Exec(e.Created, e.Notifier, e.Kind, e.Hostname, e.Check, e.Mount, e.Severity, e.Subject, string(e.payload),
+    e.Status, e.Attempts, e.NextAttempt, e.LastError, e.Sent)
+  if (err != nil) {
+    return 0, err
+  }
+
+  return r.LastInsertId()
+}
+
+func (s *sqlStore) UpdateNotification(e OutboxEntry) error {
+  _, err := s.notificationUpdate.Exec(e.Status, e.Attempts, e.NextAttempt, e.LastError, e.Sent, e.ID)
+
+  return err
+}
+
+func (s *sqlStore) DueNotifications(now int64) ([]OutboxEntry, error) {
+  rs, err := s.notificationsDue.Query(now)
+  if (err != nil) {
+    return nil, err
+  }
+
+  return scanNotifications(rs)
+}
+
+func (s *sqlStore) RecentNotifications(host string, status string, n int) ([]OutboxEntry, error) {
+  rs, err := s.notificationsRecent.Query(host, host, status, status, n)
+  if (err != nil) {
+    return nil, err
+  }
+
+  return scanNotifications(rs)
+}
+
+func scanNotifications(rs *sql.Rows) ([]OutboxEntry, error) {
+  var es []OutboxEntry
+
+  defer rs.Close()
+
+  for rs.Next() {
+    var e OutboxEntry
+    var payload string
+
+    err := rs.Scan(&e.ID, &e.Created, &e.Notifier, &e.Kind, &e.Hostname, &e.Check, &e.Mount, &e.Severity, &e.Subject, &payload,
+      &e.Status, &e.Attempts, &e.NextAttempt, &e.LastError, &e.Sent)
+    if (err != nil) {
+      return nil, err
+    }
+
+    e.payload = []byte(payload)
+    es = append(es, e)
+  }
+
+  return es, rs.Err()
+}
+
+func (s *sqlStore) AddMaintenance(mw Maintenance) (int64, error) {
+  r, err := s.maintenanceInsert.Exec(strings.Join(mw.Hosts, ","), mw.Start, mw.End, mw.Cron, mw.Duration, mw.Comment, mw.By)
+  if (err != nil) {
+    return 0, err
+  }
+
+  return r.LastInsertId()
+}
+
+func (s *sqlStore) DeleteMaintenance(id int64) error {
+  _, err := s.maintenanceDelete.Exec(id)
+
+  return err
+}
+
+func (s *sqlStore) ListMaintenance() ([]Maintenance, error) {
+  var ws []Maintenance
+
+  rs, err := s.maintenanceList.Query()
+  if (err != nil) {
+    return nil, err
+  }
+
+  defer rs.Close()
+
+  for rs.Next() {
+    var mw Maintenance
+    var id int64
+    var hosts string
+
+    err = rs.Scan(&id, &hosts, &mw.Start, &mw.End, &mw.Cron, &mw.Duration, &mw.Comment, &mw.By)
+    if (err != nil) {
+      return nil, err
+    }
+
+    mw.ID, mw.Hosts = strconv.FormatInt(id, 10), strings.Split(hosts, ",")
+    ws = append(ws, mw)
+  }
+
+  return ws, rs.Err()
+}
+
+func (s *sqlStore) Close() error {
+  for _, st := range s.prepared {
+    st.Close()
+  }
+
+  return s.db.Close()
+}
+
+//
+// In-memory store. Nothing survives a restart, useful for small sites and for
+//  testing the server without a database.
+//
+
+type memStore struct {
+  mu sync.Mutex
+  reports map[string][]Message
+  tokens map[string]string
+  notifications []OutboxEntry
+  notificationID int64
+  maintenance []Maintenance
+  maintenanceID int64
+}
+
+// Notifications the memory store keeps. The oldest finished one, sent,
+//  suppressed or given up on, makes way for a new one; those still to be
+//  delivered are never dropped.
+const memNotifications = 1000
+
+var errOutboxFull = errors.New("notification outbox is full of undelivered messages")
+
+func newMemStore() *memStore {
+  return &memStore{reports: make(map[string][]Message), tokens: make(map[string]string)}
+}
+
+func (s *memStore) StoreReport(m Message) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  // Keep each host's reports sorted oldest first
+  rl := s.reports[m.Hostname]
+  i := sort.Search(len(rl), func(i int) bool { return rl[i].Timestamp > m.Timestamp })
+  rl = append(rl, Message{})
+  copy(rl[i+1:], rl[i:])
+  rl[i] = m
+  s.reports[m.Hostname] = rl
+
+  return nil
+}
+
+func (s *memStore) LatestReport(host string) (Message, error) {
+  ms, _ := s.LastReports(host, 1)
+
+  if (len(ms) == 0) {
+    return Message{}, errNoReports
+  }
+
+  return ms[0], nil
+}
+
+func (s *memStore) LastReports(host string, n int) ([]Message, error) {
+  var ms []Message
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  rl := s.reports[host]
+  for i := len(rl)-1; (i >= 0) && (len(ms) < n); i-- {
+    ms = append(ms, rl[i])
+  }
+
+  return ms, nil
+}
+
+func (s *memStore) ReportsBetween(host string, from int64, to int64) ([]Message, error) {
+  var ms []Message
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  rl := s.reports[host]
+  for i := sort.Search(len(rl), func(i int) bool { return rl[i].Timestamp >= from }); (i < len(rl)) && (rl[i].Timestamp <= to); i++ {
+    ms = append(ms, rl[i])
+  }
+
+  return ms, nil
+}
+
+func (s *memStore) ListHosts() ([]string, error) {
+  var hosts []string
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for h := range s.reports {
+    hosts = append(hosts, h)
+  }
+
+  sort.Strings(hosts)
+
+  return hosts, nil
+}
+
+func (s *memStore) HostToken(host string) (string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  token, ok := s.tokens[host]
+  if (!ok) {
+    return "", errNoToken
+  }
+
+  return token, nil
+}
+
+func (s *memStore) SetHostToken(host string, token string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if (token == "") {
+    delete(s.tokens, host)
+  } else {
+    s.tokens[host] = token
+  }
+
+  return nil
+}
+
+func (s *memStore) AddNotification(e OutboxEntry) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if (len(s.notifications) >= memNotifications) {
+    i := 0
+    for ((i < len(s.notifications)) && (s.notifications[i].Status == outboxPending)) {
+      i++
+    }
+    if (i == len(s.notifications)) {
+      return 0, errOutboxFull
+    }
+    s.notifications = append(s.notifications[:i], s.notifications[i+1:]...)
+  }
+
+  s.notificationID++
+  e.ID = s.notificationID
+
+  s.notifications = append(s.notifications, e)
+
+  return e.ID, nil
+}
+
+func (s *memStore) UpdateNotification(e OutboxEntry) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  i := sort.Search(len(s.notifications), func(i int) bool { return s.notifications[i].ID >= e.ID })
+  if ((i < len(s.notifications)) && (s.notifications[i].ID == e.ID)) {
+    s.notifications[i] = e
+  }
+
+  return nil
+}
+
+func (s *memStore) DueNotifications(now int64) ([]OutboxEntry, error) {
+  var es []OutboxEntry
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for _, e := range s.notifications {
+    if ((e.Status == outboxPending) && (e.NextAttempt <= now)) {
+      es = append(es, e)
+    }
+  }
+
+  return es, nil
+}
+
+func (s *memStore) RecentNotifications(host string, status string, n int) ([]OutboxEntry, error) {
+  var es []OutboxEntry
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for i := len(s.notifications)-1; (i >= 0) && (len(es) < n); i-- {
+    e := s.notifications[i]
+    if (((host == "") || (e.Hostname == host)) && ((status == "") || (e.Status == status))) {
+      es = append(es, e)
+    }
+  }
+
+  return es, nil
+}
+
+func (s *memStore) AddMaintenance(mw Maintenance) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.maintenanceID++
+  mw.ID = strconv.FormatInt(s.maintenanceID, 10)
+  s.maintenance = append(s.maintenance, mw)
+
+  return s.maintenanceID, nil
+}
+
+func (s *memStore) DeleteMaintenance(id int64) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for i, mw := range s.maintenance {
+    if (mw.ID == strconv.FormatInt(id, 10)) {
+      s.maintenance = append(s.maintenance[:i], s.maintenance[i+1:]...)
+      break
+    }
+  }
+
+  return nil
+}
+
+func (s *memStore) ListMaintenance() ([]Maintenance, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  return append([]Maintenance(nil), s.maintenance...), nil
+}
+
+func (s *memStore) Close() error {
+  return nil
+}
@@ -0,0 +1,66 @@
+//
+// Host monitor data collection server, storage backend tests
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "testing"
+)
+
+func TestMemOutboxFull(t *testing.T) {
+  tests := []struct {
+    name string
+    status func(i int) string
+    err error
+    evicted int64
+  }{
+    {"all failed", func(i int) string { return outboxFailed }, nil, 1},
+    {"all sent", func(i int) string { return outboxSent }, nil, 1},
+    {"all pending", func(i int) string { return outboxPending }, errOutboxFull, 0},
+    {"oldest finished", func(i int) string {
+      switch {
+        case i < 10:
+          return outboxPending
+        case i == 10:
+          return outboxFailed
+      }
+      return outboxSuppressed
+    }, nil, 11},
+  }
+
+  for _, tt := range tests {
+    s := newMemStore()
+
+    for i := 0; i < memNotifications; i++ {
+      _, err := s.AddNotification(OutboxEntry{Notifier: "oncall", Status: tt.status(i)})
+      if (err != nil) {
+        t.Fatalf("%s: %v", tt.name, err)
+      }
+    }
+
+    id, err := s.AddNotification(OutboxEntry{Notifier: "oncall", Status: outboxPending})
+    if (err != tt.err) {
+      t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+      continue
+    }
+    if (err != nil) {
+      continue
+    }
+
+    es, _ := s.RecentNotifications("", "", 2*memNotifications)
+    if (len(es) != memNotifications) {
+      t.Errorf("%s: %d notifications kept, want %d", tt.name, len(es), memNotifications)
+    }
+
+    for _, e := range es {
+      if (e.ID == tt.evicted) {
+        t.Errorf("%s: notification %d kept, want it dropped", tt.name, tt.evicted)
+      }
+    }
+    if (es[0].ID != id) {
+      t.Errorf("%s: newest notification %d, want %d", tt.name, es[0].ID, id)
+    }
+  }
+}
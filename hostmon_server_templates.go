@@ -0,0 +1,222 @@
+//
+// Host monitor data collection server, notification templates
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  htmltemplate "html/template"
+  "os"
+  "strings"
+  "text/template"
+  "time"
+)
+
+//
+// The subject, plain text body and HTML body of a notification are each a
+//  Go template, which may be given per kind of notification in the
+//  configuration file as
+//
+//  notifyTemplate kind part file
+//
+//  kind  firing, repeat, escalated, recovered, or default for any of those
+//        that doesn't have its own, or digest
+//  part  subject, body or html
+//
+// Templates are executed with the Notification: .Kind, .Alert (with .Value,
+//  .Previous, .Threshold and .Op for rule alerts), .Host, the host's latest
+//  report, and .Groups, its hostgroups. Digests have .Count and .Digest, the
+//  notifications grouped by check.
+//
+
+type notifyTemplates struct {
+  subject *template.Template
+  body *template.Template
+  html *htmltemplate.Template
+}
+
+var notifyKinds = map[string]bool{"firing": true, "repeat": true, "escalated": true, "recovered": true, "default": true, "digest": true}
+
+var g_notifyTemplates = make(map[string]*notifyTemplates)
+
+//
+// Functions for notification and webhook templates
+//
+
+var notifyFuncs = template.FuncMap{
+  // Quote a value for use in JSON
+  "json": func(v interface{}) (string, error) {
+    b, err := json.Marshal(v)
+    return string(b), err
+  },
+  "upper": strings.ToUpper,
+  "lower": strings.ToLower,
+  "join": strings.Join,
+  "time": func(t int64) string {
+    return time.Unix(t, 0).Format("2006-01-02 15:04:05 MST")
+  },
+  // Dereference one of an alert's optional values
+  "num": func(v *float64) float64 {
+    if (v == nil) {
+      return 0
+    }
+    return *v
+  },
+}
+
+const defaultSubjectTemplate = `{{if eq .Kind "recovered"}}Recovered: {{else if eq .Kind "repeat"}}Still {{upper .Alert.Severity}}: {{else}}{{upper .Alert.Severity}}: {{end}}` +
+  `{{.Alert.Check}}{{with .Alert.Mount}} {{.}}{{end}} on {{.Alert.Hostname}}`
+
+const defaultBodyTemplate = `{{if eq .Kind "recovered"}}Recovered, was: {{.Alert.Message}}{{else}}{{.Alert.Message}}{{end}}
+
+Host:      {{.Alert.Hostname}}{{with .Groups}} ({{join . ", "}}){{end}}
+Check:     {{.Alert.Check}}{{with .Alert.Mount}} on {{.}}{{end}}
+Severity:  {{.Alert.Severity}}
+State:     {{.Alert.State}}, since {{time .Alert.Since}}
+{{- if .Alert.Value}}
+Value:     {{num .Alert.Value}}{{if .Alert.Previous}}, previously {{num .Alert.Previous}}{{end}}, threshold {{.Alert.Op}} {{num .Alert.Threshold}}
+{{- end}}
+{{- with .Host}}
+Release:   {{.Release}}, kernel {{.KernelVer}}, {{.NumCPUs}} CPUs
+Reported:  {{time .Timestamp}}
+{{- end}}
+`
+
+const defaultHTMLTemplate = `<html><body>
+<p><b>{{.Alert.Message}}</b></p>
+<table>
+<tr><td>Host</td><td>{{.Alert.Hostname}}{{with .Groups}} ({{join . ", "}}){{end}}</td></tr>
+<tr><td>Check</td><td>{{.Alert.Check}}{{with .Alert.Mount}} on {{.}}{{end}}</td></tr>
+<tr><td>Severity</td><td>{{.Alert.Severity}}</td></tr>
+<tr><td>State</td><td>{{.Alert.State}} since {{time .Alert.Since}}</td></tr>
+{{- if .Alert.Value}}
+<tr><td>Value</td><td>{{num .Alert.Value}}{{if .Alert.Previous}}, previously {{num .Alert.Previous}}{{end}}, threshold {{.Alert.Op}} {{num .Alert.Threshold}}</td></tr>
+{{- end}}
+{{- with .Host}}
+<tr><td>Release</td><td>{{.Release}}, kernel {{.KernelVer}}, {{.NumCPUs}} CPUs</td></tr>
+<tr><td>Reported</td><td>{{time .Timestamp}}</td></tr>
+{{- end}}
+</table>
+</body></html>
+`
+
+const digestSubjectTemplate = `{{.Count}} alerts: {{range $i, $g := .Digest}}{{if $i}}, {{end}}{{$g.Check}} ({{len $g.Notifications}}){{end}}`
+
+const digestBodyTemplate = `{{range .Digest}}{{.Check}}:
+{{range .Notifications}}  {{.Alert.Hostname}}{{with .Alert.Mount}} {{.}}{{end}}: {{if eq .Kind "recovered"}}recovered, was {{else}}{{upper .Alert.Severity}} {{end}}{{.Alert.Message}}
+{{end}}
+{{end}}`
+
+const digestHTMLTemplate = `<html><body>
+{{range .Digest}}<h3>{{.Check}}</h3>
+<table>
+{{range .Notifications}}<tr><td>{{.Alert.Hostname}}{{with .Alert.Mount}} {{.}}{{end}}</td><td>{{if eq .Kind "recovered"}}recovered{{else}}{{.Alert.Severity}}{{end}}</td><td>{{.Alert.Message}}</td></tr>
+{{end}}</table>
+{{end}}</body></html>
+`
+
+func init() {
+  g_notifyTemplates["default"] = &notifyTemplates{
+    subject: template.Must(template.New("subject").Funcs(notifyFuncs).Parse(defaultSubjectTemplate)),
+    body: template.Must(template.New("body").Funcs(notifyFuncs).Parse(defaultBodyTemplate)),
+    html: htmltemplate.Must(htmltemplate.New("html").Funcs(htmltemplate.FuncMap(notifyFuncs)).Parse(defaultHTMLTemplate)),
+  }
+
+  g_notifyTemplates["digest"] = &notifyTemplates{
+    subject: template.Must(template.New("subject").Funcs(notifyFuncs).Parse(digestSubjectTemplate)),
+    body: template.Must(template.New("body").Funcs(notifyFuncs).Parse(digestBodyTemplate)),
+    html: htmltemplate.Must(htmltemplate.New("html").Funcs(htmltemplate.FuncMap(notifyFuncs)).Parse(digestHTMLTemplate)),
+  }
+}
+
+//
+// Parse the fields of a notifyTemplate line, less the leading
+//  "notifyTemplate"
+//
+
+func addNotifyTemplate(fields []string) error {
+  if (len(fields) != 3) {
+    return fmt.Errorf("notifyTemplate needs a kind, a part and a file")
+  }
+
+  kind, part, file := fields[0], fields[1], fields[2]
+
+  if (!notifyKinds[kind]) {
+    return fmt.Errorf("notifyTemplate: unknown kind %s", kind)
+  }
+
+  text, err := os.ReadFile(file)
+  if (err != nil) {
+    return err
+  }
+
+  nt := g_notifyTemplates[kind]
+  if (nt == nil) {
+    nt = &notifyTemplates{}
+    g_notifyTemplates[kind] = nt
+  }
+
+  switch part {
+    case "subject":
+      nt.subject, err = template.New(file).Funcs(notifyFuncs).Parse(string(text))
+    case "body":
+      nt.body, err = template.New(file).Funcs(notifyFuncs).Parse(string(text))
+    case "html":
+      nt.html, err = htmltemplate.New(file).Funcs(htmltemplate.FuncMap(notifyFuncs)).Parse(string(text))
+    default:
+      return fmt.Errorf("notifyTemplate: part must be subject, body or html, not %s", part)
+  }
+
+  return err
+}
+
+//
+// Fill in a notification's subject and bodies from the templates for its
+//  kind, falling back on the defaults part by part
+//
+
+func renderNotification(n *Notification) error {
+  var subject, body, html bytes.Buffer
+
+  nt := g_notifyTemplates[n.Kind]
+  if (nt == nil) {
+    nt = &notifyTemplates{}
+  }
+  def := g_notifyTemplates["default"]
+
+  st, bt, ht := nt.subject, nt.body, nt.html
+  if (st == nil) {
+    st = def.subject
+  }
+  if (bt == nil) {
+    bt = def.body
+  }
+  if (ht == nil) {
+    ht = def.html
+  }
+
+  err := st.Execute(&subject, n)
+  if (err != nil) {
+    return fmt.Errorf("subject: %v", err)
+  }
+
+  err = bt.Execute(&body, n)
+  if (err != nil) {
+    return fmt.Errorf("body: %v", err)
+  }
+
+  err = ht.Execute(&html, n)
+  if (err != nil) {
+    return fmt.Errorf("html: %v", err)
+  }
+
+  // A subject is one line
+  n.Subject = strings.Join(strings.Fields(subject.String()), " ")
+  n.Body, n.HTML = body.String(), html.String()
+
+  return nil
+}
@@ -0,0 +1,414 @@
+//
+// Host monitor data collection server, report validation
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "math"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+//
+// Widths of the columns in the reports table. Anything longer than this
+//  would be truncated (or refused) by the database, so we refuse it first.
+//
+
+const (
+  maxHostnameLen = 68
+  maxKernelVerLen = 65
+  maxReleaseLen = 65
+  maxUptimeLen = 16
+  maxNumCPUsLen = 8
+  maxPhysMemLen = 16
+  maxLoadLen = 12
+  maxSwapLen = 12
+  maxDiskReportLen = 68
+  maxMemUsedLen = 12
+)
+
+//
+// Widths of the text columns in the disks table
+//
+
+const (
+  maxMountPointLen = 255
+  maxDeviceLen = 255
+  maxFSTypeLen = 32
+)
+
+//
+// Widths of the columns in the collectors table
+//
+
+const (
+  maxCollectorLen = 32
+  maxCollectorErrorLen = 255
+)
+
+//
+// Widths of the columns in the checks and checkmetrics tables
+//
+
+const (
+  maxCheckNameLen = 64
+  maxCheckOutputLen = 255
+  maxCheckMetrics = 32
+)
+
+// Reports timestamped further than this into the future are refused
+const maxClockSkew = 24*60*60
+
+//
+// Collects the problems found with a report so that they can all be sent
+//  back to the agent at once.
+//
+
+type validationErrors []string
+
+func (v *validationErrors) add(field string, format string, args ...interface{}) {
+  *v = append(*v, field + ": " + fmt.Sprintf(format, args...))
+}
+
+func (v validationErrors) Error() string {
+  return "rejected report: " + strings.Join(v, "; ")
+}
+
+//
+// Populate a Message from the form fields POSTed by an agent. Fields that
+//  fail to parse are reported rather than silently left at zero.
+//
+
+func parseFormMessage(r *http.Request) (Message, validationErrors) {
+  var m Message
+  var ve validationErrors
+  var err error
+
+  parseInt := func(field string) int64 {
+    v, e := strconv.ParseInt(r.FormValue(field), 10, 64)
+    if (e != nil) {
+      ve.add(field, "not an integer: %q", r.FormValue(field))
+    }
+    return v
+  }
+
+  parseFloat := func(field string) float64 {
+    v, e := strconv.ParseFloat(r.FormValue(field), 64)
+    if (e != nil) {
+      ve.add(field, "not a number: %q", r.FormValue(field))
+    }
+    return v
+  }
+
+  err = r.ParseForm()
+  if (err != nil) {
+    ve.add("body", "malformed form data: %v", err)
+    return m, ve
+  }
+
+  m.Timestamp = parseInt("Timestamp")
+  m.Hostname = r.FormValue("Hostname")
+  m.NumCPUs = parseInt("NumCPUs")
+  m.Memtotal = parseInt("Memtotal")
+  m.LoadOne = parseFloat("LoadOne")
+  m.LoadFive = parseFloat("LoadFive")
+  m.LoadFifteen = parseFloat("LoadFifteen")
+  m.SwapUsed = parseFloat("SwapUsed")
+  if (r.FormValue("MemUsed") != "") {
+    v := parseFloat("MemUsed")
+    m.MemUsed = &v
+  }
+  m.KernelVer = r.FormValue("KernelVer")
+  m.Release = r.FormValue("Release")
+  m.Uptime = r.FormValue("Uptime")
+  m.DiskReport = r.FormValue("DiskReport")
+
+  //
+  // Newer agents send a structured disk list as JSON. For older agents we
+  //  build one from the disk report, which only has mount points and percent
+  //  utilization. Either way the disk report column is rebuilt from the list.
+  //
+
+  if (r.FormValue("Disks") != "") {
+    err = json.Unmarshal([]byte(r.FormValue("Disks")), &m.Disks)
+    if (err != nil) {
+      ve.add("Disks", "malformed disk list: %v", err)
+    }
+  } else {
+    m.Disks = disksFromReport(m.DiskReport, &ve)
+  }
+
+  m.DiskReport = diskReportFromDisks(m.Disks)
+
+  // Which collectors ran, and why the others failed, from newer agents
+  if (r.FormValue("Collectors") != "") {
+    err = json.Unmarshal([]byte(r.FormValue("Collectors")), &m.Collectors)
+    if (err != nil) {
+      ve.add("Collectors", "malformed collector list: %v", err)
+    }
+  }
+
+  if (r.FormValue("Checks") != "") {
+    err = json.Unmarshal([]byte(r.FormValue("Checks")), &m.Checks)
+    if (err != nil) {
+      ve.add("Checks", "malformed check list: %v", err)
+    }
+  }
+
+  if (r.FormValue("CollectorErrors") != "") {
+    err = json.Unmarshal([]byte(r.FormValue("CollectorErrors")), &m.CollectorErrors)
+    if (err != nil) {
+      ve.add("CollectorErrors", "malformed collector error list: %v", err)
+    }
+  }
+
+  // Older agents send NaN for swap usage on hosts with no swap configured
+  if (math.IsNaN(m.SwapUsed)) {
+    m.SwapUsed = 0.0
+  }
+
+  return m, ve
+}
+
+//
+// Check every field of a report against what the reports table can hold and
+//  what an agent could plausibly have sent. h is the host named in the URL.
+//
+
+func validateMessage(m Message, h string) validationErrors {
+  var ve validationErrors
+
+  if (!validHostname(m.Hostname)) {
+    ve.add("Hostname", "must be 1-%d characters of letters, digits, '-' and '.', got %q", maxHostnameLen, m.Hostname)
+  } else if (m.Hostname != h) {
+    ve.add("Hostname", "%q does not match host %q in the request path", m.Hostname, h)
+  }
+
+  if ((m.Timestamp <= 0) || (m.Timestamp > time.Now().Unix() + maxClockSkew)) {
+    ve.add("Timestamp", "out of range: %d", m.Timestamp)
+  }
+
+  if ((m.NumCPUs < 0) || (len(strconv.FormatInt(m.NumCPUs, 10)) > maxNumCPUsLen)) {
+    ve.add("NumCPUs", "out of range: %d", m.NumCPUs)
+  }
+
+  if ((m.Memtotal < 0) || (len(strconv.FormatInt(m.Memtotal, 10)) > maxPhysMemLen)) {
+    ve.add("Memtotal", "out of range: %d", m.Memtotal)
+  }
+
+  checkFloat := func(field string, v float64, max float64, width int) {
+    if (math.IsNaN(v) || (v < 0) || (v > max) || (len(strconv.FormatFloat(v, 'f', 6, 64)) > width)) {
+      ve.add(field, "out of range: %f", v)
+    }
+  }
+
+  checkFloat("LoadOne", m.LoadOne, math.MaxFloat64, maxLoadLen)
+  checkFloat("LoadFive", m.LoadFive, math.MaxFloat64, maxLoadLen)
+  checkFloat("LoadFifteen", m.LoadFifteen, math.MaxFloat64, maxLoadLen)
+  checkFloat("SwapUsed", m.SwapUsed, 100.0, maxSwapLen)
+  if (m.MemUsed != nil) {
+    checkFloat("MemUsed", *m.MemUsed, 100.0, maxMemUsedLen)
+  }
+
+  checkString := func(field string, v string, width int) {
+    if (len(v) > width) {
+      ve.add(field, "longer than %d characters", width)
+    }
+    for _, c := range v {
+      if ((c < ' ') || (c == 0x7f)) {
+        ve.add(field, "contains control characters")
+        break
+      }
+    }
+  }
+
+  checkString("KernelVer", m.KernelVer, maxKernelVerLen)
+  checkString("Release", m.Release, maxReleaseLen)
+  checkString("Uptime", m.Uptime, maxUptimeLen)
+
+  if ((m.Uptime != "unknown") && (m.Uptime != "")) {
+    u, err := strconv.ParseFloat(m.Uptime, 64)
+    if ((err != nil) || (u < 0)) {
+      ve.add("Uptime", "not a number of seconds: %q", m.Uptime)
+    }
+  }
+
+  seen := make(map[string]bool)
+
+  for i, d := range m.Disks {
+    field := fmt.Sprintf("Disks[%d]", i)
+
+    if ((!strings.HasPrefix(d.MountPoint, "/")) || seen[d.MountPoint]) {
+      ve.add(field, "bad or duplicate mount point %q", d.MountPoint)
+    }
+    seen[d.MountPoint] = true
+
+    checkString(field + ".MountPoint", d.MountPoint, maxMountPointLen)
+    checkString(field + ".Device", d.Device, maxDeviceLen)
+    checkString(field + ".FSType", d.FSType, maxFSTypeLen)
+
+    if ((d.TotalBytes < 0) || (d.UsedBytes < 0) || (d.AvailBytes < 0) || (d.InodesTotal < 0) || (d.InodesUsed < 0)) {
+      ve.add(field, "negative size or inode count")
+    }
+
+    checkFloat(field + ".UsedPct", d.UsedPct, 100.0, maxSwapLen)
+    checkFloat(field + ".InodesUsedPct", d.InodesUsedPct, 100.0, maxSwapLen)
+  }
+
+  for _, c := range m.Collectors {
+    if (!validCollectorName(c)) {
+      ve.add("Collectors", "bad collector name %q", c)
+    }
+  }
+
+  for c, e := range m.CollectorErrors {
+    if (!validCollectorName(c)) {
+      ve.add("CollectorErrors", "bad collector name %q", c)
+    }
+    checkString("CollectorErrors[" + c + "]", e, maxCollectorErrorLen)
+  }
+
+  checkNames := make(map[string]bool)
+
+  for i, k := range m.Checks {
+    field := fmt.Sprintf("Checks[%d]", i)
+
+    if ((!validCheckName(k.Name)) || checkNames[k.Name]) {
+      ve.add(field, "bad or duplicate check name %q", k.Name)
+    }
+    checkNames[k.Name] = true
+
+    if ((k.Status < checkOK) || (k.Status > checkUnknown)) {
+      ve.add(field, "status out of range: %d", k.Status)
+    }
+
+    checkString(field + ".Output", k.Output, maxCheckOutputLen)
+
+    if (len(k.Metrics) > maxCheckMetrics) {
+      ve.add(field, "more than %d metrics", maxCheckMetrics)
+    }
+
+    for mn, mv := range k.Metrics {
+      if ((!validCheckName(mn)) || math.IsNaN(mv) || math.IsInf(mv, 0)) {
+        ve.add(field, "bad metric %q", mn)
+      }
+    }
+  }
+
+  return ve
+}
+
+//
+// Check and metric names are letters, digits, '.', '-' and '_'
+//
+
+func validCheckName(s string) bool {
+  if ((len(s) == 0) || (len(s) > maxCheckNameLen)) {
+    return false
+  }
+
+  for _, c := range s {
+    if (!(((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) || ((c >= '0') && (c <= '9')) || (c == '.') || (c == '-') || (c == '_'))) {
+      return false
+    }
+  }
+
+  return true
+}
+
+//
+// Collector names are short lower case identifiers
+//
+
+func validCollectorName(c string) bool {
+  if ((len(c) == 0) || (len(c) > maxCollectorLen)) {
+    return false
+  }
+
+  for _, ch := range c {
+    if (!(((ch >= 'a') && (ch <= 'z')) || ((ch >= '0') && (ch <= '9')) || (ch == '-') || (ch == '_') || (ch == '.'))) {
+      return false
+    }
+  }
+
+  return true
+}
+
+//
+// Turn an old style "/ 45 /home 80" disk report into a disk list
+//
+
+func disksFromReport(dr string, ve *validationErrors) []DiskInfo {
+  var disks []DiskInfo
+
+  f := strings.Fields(dr)
+  if (len(f) % 2 != 0) {
+    ve.add("DiskReport", "not a list of mount point and utilization pairs")
+    return nil
+  }
+
+  for i := 0; i < len(f); i += 2 {
+    p, err := strconv.ParseFloat(f[i+1], 64)
+    if (err != nil) {
+      ve.add("DiskReport", "bad entry %q %q", f[i], f[i+1])
+      continue
+    }
+
+    disks = append(disks, DiskInfo{MountPoint: f[i], UsedPct: p})
+  }
+
+  return disks
+}
+
+//
+// Build the disk report column from a disk list, keeping as many whole
+//  entries as will fit in the column
+//
+
+func diskReportFromDisks(disks []DiskInfo) string {
+  var dr string
+
+  for _, d := range disks {
+    e := d.MountPoint + " " + strconv.FormatFloat(d.UsedPct, 'f', 0, 64)
+    if (len(dr) > 0) {
+      e = " " + e
+    }
+    if (len(dr) + len(e) > maxDiskReportLen) {
+      break
+    }
+    dr += e
+  }
+
+  return dr
+}
+
+//
+// Host names are what the agent reports with the domain stripped: letters,
+//  digits and hyphens, with dots allowed in case a site sends FQDNs.
+//
+
+func validHostname(h string) bool {
+  if ((len(h) == 0) || (len(h) > maxHostnameLen)) {
+    return false
+  }
+
+  for _, label := range strings.Split(h, ".") {
+    if ((len(label) == 0) || (label[0] == '-') || (label[len(label)-1] == '-')) {
+      return false
+    }
+
+    for _, c := range label {
+      if (!(((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) || ((c >= '0') && (c <= '9')) || (c == '-'))) {
+        return false
+      }
+    }
+  }
+
+  return true
+}
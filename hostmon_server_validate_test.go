@@ -0,0 +1,114 @@
+//
+// Host monitor data collection server, report validation tests
+//  Sean Caron scaron@umich.edu
+//
+
+package main
+
+import (
+  "math"
+  "net/http"
+  "net/url"
+  "strings"
+  "testing"
+  "time"
+)
+
+func goodMessage() Message {
+  return Message{Timestamp: time.Now().Unix(), Hostname: "db1", NumCPUs: 8, Memtotal: 16384000, LoadOne: 1.5,
+    LoadFive: 1.2, LoadFifteen: 1.0, SwapUsed: 3.5, KernelVer: "5.14.0", Release: "Rocky 9", Uptime: "86400",
+    Disks: []DiskInfo{{MountPoint: "/", Device: "/dev/sda1", FSType: "xfs", TotalBytes: 100, UsedBytes: 40, AvailBytes: 60, UsedPct: 40}},
+    Checks: []CheckResult{{Name: "ntp", Status: checkOK, Metrics: map[string]float64{"offset": 0.01}}}}
+}
+
+func TestValidateMessage(t *testing.T) {
+  tests := []struct {
+    name string
+    change func(m *Message)
+    field string
+  }{
+    {"good", func(m *Message) {}, ""},
+    {"hostname mismatch", func(m *Message) { m.Hostname = "db2" }, "Hostname"},
+    {"bad hostname", func(m *Message) { m.Hostname = "db_1" }, "Hostname"},
+    {"zero timestamp", func(m *Message) { m.Timestamp = 0 }, "Timestamp"},
+    {"future timestamp", func(m *Message) { m.Timestamp = time.Now().Unix() + 2*maxClockSkew }, "Timestamp"},
+    {"negative cpus", func(m *Message) { m.NumCPUs = -1 }, "NumCPUs"},
+    {"too many cpus", func(m *Message) { m.NumCPUs = 1000000000 }, "NumCPUs"},
+    {"negative memory", func(m *Message) { m.Memtotal = -1 }, "Memtotal"},
+    {"NaN load", func(m *Message) { m.LoadOne = math.NaN() }, "LoadOne"},
+    {"negative load", func(m *Message) { m.LoadFive = -0.5 }, "LoadFive"},
+    {"load too wide", func(m *Message) { m.LoadFifteen = 1e9 }, "LoadFifteen"},
+    {"infinite load", func(m *Message) { m.LoadFifteen = math.Inf(1) }, "LoadFifteen"},
+    {"NaN swap", func(m *Message) { m.SwapUsed = math.NaN() }, "SwapUsed"},
+    {"swap over 100", func(m *Message) { m.SwapUsed = 100.5 }, "SwapUsed"},
+    {"long kernel", func(m *Message) { m.KernelVer = strings.Repeat("x", maxKernelVerLen + 1) }, "KernelVer"},
+    {"control characters", func(m *Message) { m.Release = "Rocky\n9" }, "Release"},
+    {"bad uptime", func(m *Message) { m.Uptime = "forever" }, "Uptime"},
+    {"unknown uptime", func(m *Message) { m.Uptime = "unknown" }, ""},
+    {"relative mount point", func(m *Message) { m.Disks[0].MountPoint = "home" }, "Disks[0]"},
+    {"duplicate mount point", func(m *Message) { m.Disks = append(m.Disks, m.Disks[0]) }, "Disks[1]"},
+    {"negative disk size", func(m *Message) { m.Disks[0].UsedBytes = -1 }, "Disks[0]"},
+    {"NaN disk use", func(m *Message) { m.Disks[0].UsedPct = math.NaN() }, "Disks[0].UsedPct"},
+    {"disk use over 100", func(m *Message) { m.Disks[0].InodesUsedPct = 101 }, "Disks[0].InodesUsedPct"},
+    {"bad collector", func(m *Message) { m.Collectors = []string{"Disk Stats"} }, "Collectors"},
+    {"check status", func(m *Message) { m.Checks[0].Status = 4 }, "Checks[0]"},
+    {"NaN check metric", func(m *Message) { m.Checks[0].Metrics["offset"] = math.NaN() }, "Checks[0]"},
+    {"infinite check metric", func(m *Message) { m.Checks[0].Metrics["offset"] = math.Inf(-1) }, "Checks[0]"},
+  }
+
+  for _, tt := range tests {
+    m := goodMessage()
+    tt.change(&m)
+
+    ve := validateMessage(m, "db1")
+
+    if (tt.field == "") {
+      if (len(ve) != 0) {
+        t.Errorf("%s: unexpected errors %v", tt.name, ve)
+      }
+      continue
+    }
+
+    found := false
+    for _, e := range ve {
+      if (strings.HasPrefix(e, tt.field + ":") || strings.HasPrefix(e, tt.field + ".")) {
+        found = true
+      }
+    }
+    if (!found) {
+      t.Errorf("%s: no error for %s in %v", tt.name, tt.field, ve)
+    }
+  }
+}
+
+func TestParseFormMessage(t *testing.T) {
+  tests := []struct {
+    name string
+    form url.Values
+    errs int
+    swap float64
+  }{
+    {"good", url.Values{"Timestamp": {"1700000000"}, "NumCPUs": {"4"}, "Memtotal": {"1024"}, "LoadOne": {"0.5"},
+      "LoadFive": {"0.4"}, "LoadFifteen": {"0.3"}, "SwapUsed": {"2.5"}, "DiskReport": {"/ 45 /home 80"}}, 0, 2.5},
+    {"NaN swap from old agents", url.Values{"Timestamp": {"1700000000"}, "NumCPUs": {"4"}, "Memtotal": {"1024"}, "LoadOne": {"0.5"},
+      "LoadFive": {"0.4"}, "LoadFifteen": {"0.3"}, "SwapUsed": {"NaN"}}, 0, 0},
+    {"not numbers", url.Values{"Timestamp": {"soon"}, "NumCPUs": {"four"}, "Memtotal": {"1024"}, "LoadOne": {"x"},
+      "LoadFive": {"0.4"}, "LoadFifteen": {"0.3"}, "SwapUsed": {"1"}}, 3, 1},
+    {"odd disk report", url.Values{"Timestamp": {"1700000000"}, "NumCPUs": {"4"}, "Memtotal": {"1024"}, "LoadOne": {"0.5"},
+      "LoadFive": {"0.4"}, "LoadFifteen": {"0.3"}, "SwapUsed": {"1"}, "DiskReport": {"/ 45 /home"}}, 1, 1},
+  }
+
+  for _, tt := range tests {
+    r, _ := http.NewRequest("POST", "/host/db1", strings.NewReader(tt.form.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+    m, ve := parseFormMessage(r)
+
+    if (len(ve) != tt.errs) {
+      t.Errorf("%s: got errors %v, want %d", tt.name, ve, tt.errs)
+    }
+    if (m.SwapUsed != tt.swap) {
+      t.Errorf("%s: SwapUsed %v, want %v", tt.name, m.SwapUsed, tt.swap)
+    }
+  }
+}